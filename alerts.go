@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"webtrack/storage"
+)
+
+type alertRule struct {
+	// Normalized text of the rule, identifies the persisted state
+	text      string
+	kind      string
+	threshold float64
+	window    time.Duration
+}
+
+// Parses the rules like "above 100", "change_percent 5" or "change 10 1h"
+func parseAlertRule(text string) (rule alertRule, err error) {
+	var parts = strings.Fields(text)
+	rule.text = strings.Join(parts, " ")
+	if len(parts) == 0 {
+		return rule, errors.New("alert rule must not be empty")
+	}
+	rule.kind = parts[0]
+	var expectedParts = 2
+	switch rule.kind {
+	case "above", "below", "equal", "change_percent":
+	case "change":
+		expectedParts = 3
+	default:
+		return rule, errors.New("Invalid alert rule " + text + ". Only \"above\", \"below\", \"equal\", \"change_percent\" and \"change\" rules are supported")
+	}
+	if len(parts) != expectedParts {
+		return rule, errors.New("Invalid alert rule " + text + ". Expected a threshold after " + rule.kind)
+	}
+	rule.threshold, err = strconv.ParseFloat(parts[1], 64)
+	if err != nil {
+		return rule, fmt.Errorf("invalid threshold of the alert rule %v: %w", text, err)
+	}
+	if (rule.kind == "change" || rule.kind == "change_percent") && rule.threshold <= 0 {
+		return rule, errors.New("threshold of the alert rule " + text + " must be positive")
+	}
+	if rule.kind == "change" {
+		rule.window, err = time.ParseDuration(parts[2])
+		if err != nil {
+			return rule, fmt.Errorf("invalid window of the alert rule %v: %w", text, err)
+		}
+		if rule.window <= 0 {
+			return rule, errors.New("window of the alert rule " + text + " must be positive")
+		}
+	}
+	return
+}
+
+func parseAlertRules(texts []string) (result []alertRule, err error) {
+	for _, text := range texts {
+		rule, err := parseAlertRule(text)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, rule)
+	}
+	return
+}
+
+type alertSample struct {
+	time  time.Time
+	value float64
+}
+
+// Tracks whether the alert rules of a query are firing, the changes of the state are persisted if the storage supports it
+type alertEvaluator struct {
+	config QueryConfig
+	log    storage.AlertLog
+	rules  []alertRule
+	firing map[string]bool
+	// Values within the longest window of the rules, the last one is the previous value
+	history   []alertSample
+	maxWindow time.Duration
+}
+
+func newAlertEvaluator(store storage.Storage, config QueryConfig) (result *alertEvaluator, err error) {
+	rules, err := parseAlertRules(config.Alerts)
+	if err != nil {
+		return nil, err
+	}
+	var log, _ = storage.As[storage.AlertLog](store)
+	result = &alertEvaluator{config: config, log: log, rules: rules, firing: map[string]bool{}}
+	for _, rule := range rules {
+		result.maxWindow = max(result.maxWindow, rule.window)
+		if log == nil {
+			continue
+		}
+		// Restore the state, so the firing alerts are not reported again after a restart
+		last, err := log.LastAlert(config.Name, rule.text)
+		if err != nil {
+			return nil, err
+		}
+		result.firing[rule.text] = last != nil && last.State == "firing"
+	}
+
+	// The last stored value is the previous one for the changes
+	last, err := store.LastRecord(context.Background(), config.Name)
+	if err != nil {
+		return nil, err
+	}
+	if last != nil {
+		if value, err := strconv.ParseFloat(last.Value, 64); err == nil {
+			result.history = append(result.history, alertSample{time: time.UnixMilli(last.Timestamp), value: value})
+		}
+	}
+	return result, nil
+}
+
+func (e *alertEvaluator) matches(rule alertRule, value float64, now time.Time) bool {
+	switch rule.kind {
+	case "above":
+		return value > rule.threshold
+	case "below":
+		return value < rule.threshold
+	case "equal":
+		return value == rule.threshold
+	case "change_percent":
+		if len(e.history) == 0 {
+			return false
+		}
+		var previous = e.history[len(e.history)-1].value
+		if previous == 0 {
+			return value != 0
+		}
+		return math.Abs(value-previous)/math.Abs(previous)*100 >= rule.threshold
+	case "change":
+		for _, sample := range e.history {
+			if now.Sub(sample.time) <= rule.window && math.Abs(value-sample.value) >= rule.threshold {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Evaluates the rules with the new value and returns the changes of their state
+func (e *alertEvaluator) Evaluate(value string, now time.Time) (changes []storage.AlertRecord) {
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		fmt.Printf("Failed to evaluate the alerts of %v: %v\n", e.config.Name, err)
+		return nil
+	}
+
+	for _, rule := range e.rules {
+		var firing = e.matches(rule, number, now)
+		if firing == e.firing[rule.text] {
+			continue
+		}
+		e.firing[rule.text] = firing
+
+		var record = storage.AlertRecord{Timestamp: now.UnixMilli(), Name: e.config.Name, Rule: rule.text, State: "resolved", Value: value, Version: e.config.Version}
+		if firing {
+			record.State = "firing"
+		}
+		fmt.Printf("Alert \"%v\" of %v is %v with the value %v\n", rule.text, e.config.Name, record.State, value)
+		if e.log != nil {
+			err = e.log.AppendAlert(record)
+			if err != nil {
+				fmt.Printf("Failed to record the alert of %v: %v\n", e.config.Name, err)
+			}
+		}
+		changes = append(changes, record)
+	}
+
+	// Only the previous value is needed without the change rules
+	var keepFrom = len(e.history)
+	for i, sample := range e.history {
+		if now.Sub(sample.time) < e.maxWindow {
+			keepFrom = i
+			break
+		}
+	}
+	e.history = append(e.history[keepFrom:], alertSample{time: now, value: number})
+	return
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+	"webtrack/storage"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAlertRule(t *testing.T) {
+	var assert = assert.New(t)
+
+	var rule, err = parseAlertRule(" above  100.5 ")
+	assert.Equal(nil, err, "Returned an error 1")
+	assert.Equal(alertRule{text: "above 100.5", kind: "above", threshold: 100.5}, rule, "Incorrect threshold rule")
+
+	rule, err = parseAlertRule("change 10 1h")
+	assert.Equal(nil, err, "Returned an error 2")
+	assert.Equal(alertRule{text: "change 10 1h", kind: "change", threshold: 10, window: time.Hour}, rule, "Incorrect change rule")
+
+	for _, text := range []string{"", "above", "above ten", "between 1 2", "change 10", "change 10 soon", "change_percent -5", "change 10 -1h"} {
+		_, err = parseAlertRule(text)
+		assert.NotEqual(nil, err, "Did not return an error for "+text)
+	}
+}
+
+func TestAlertEvaluator(t *testing.T) {
+	var assert = assert.New(t)
+
+	var store = newTestStorage(t)
+	store.CreateSeries("price")
+	var config = QueryConfig{Name: "price", Version: 1, Alerts: []string{"above 100", "change_percent 50", "change 30 1h"}}
+	var start = time.Date(2024, 10, 18, 12, 0, 0, 0, time.UTC)
+
+	alerts, err := newAlertEvaluator(store, config)
+	assert.Equal(nil, err, "Returned an error 1")
+	assert.Equal(0, len(alerts.Evaluate("80", start)), "Fired without a reason")
+	assert.Equal(0, len(alerts.Evaluate("95", start.Add(10*time.Minute))), "Fired for a small change")
+
+	// Crossed the threshold and changed by 30 within an hour since the first value
+	var changes = alerts.Evaluate("110", start.Add(20*time.Minute))
+	assert.Equal([]storage.AlertRecord{
+		{Timestamp: start.Add(20 * time.Minute).UnixMilli(), Name: "price", Rule: "above 100", State: "firing", Value: "110", Version: 1},
+		{Timestamp: start.Add(20 * time.Minute).UnixMilli(), Name: "price", Rule: "change 30 1h", State: "firing", Value: "110", Version: 1},
+	}, changes, "Incorrect fired alerts")
+	assert.Equal(0, len(alerts.Evaluate("112", start.Add(30*time.Minute))), "Fired again")
+
+	// The state is restored after a restart, but the values of the window are not
+	alerts, err = newAlertEvaluator(store, config)
+	assert.Equal(nil, err, "Returned an error 2")
+	changes = alerts.Evaluate("112", start.Add(40*time.Minute))
+	assert.Equal(1, len(changes), "Fired again after a restart")
+	assert.Equal("change 30 1h", changes[0].Rule, "Did not resolve the change alert")
+	assert.Equal("resolved", changes[0].State, "Did not resolve the change alert")
+
+	// A drop resolves the threshold alert and fires the change alerts
+	changes = alerts.Evaluate("20", start.Add(90*time.Minute))
+	assert.Equal(3, len(changes), "Incorrect number of changes")
+	assert.Equal("resolved", changes[0].State, "Did not resolve the threshold alert")
+	assert.Equal("change_percent 50", changes[1].Rule, "Did not fire the percent alert")
+	assert.Equal("firing", changes[2].State, "Did not fire the change alert for the drop")
+
+	changes = alerts.Evaluate("21", start.Add(180*time.Minute))
+	assert.Equal(2, len(changes), "Did not resolve the change alerts")
+
+	record, err := store.LastAlert("price", "above 100")
+	assert.Equal(nil, err, "Returned an error 3")
+	assert.Equal("resolved", record.State, "Did not persist the state")
+}
+
+func TestAlertEvaluatorPreviousValue(t *testing.T) {
+	var assert = assert.New(t)
+
+	var store = newTestStorage(t)
+	store.CreateSeries("price")
+	store.AppendRecord(context.Background(), "price", storage.Record{Timestamp: time.Now().UnixMilli(), Value: "100", Version: 0})
+
+	// The last stored value is compared with the first new one
+	alerts, err := newAlertEvaluator(store, QueryConfig{Name: "price", Alerts: []string{"change_percent 10"}})
+	assert.Equal(nil, err, "Returned an error")
+	assert.Equal(1, len(alerts.Evaluate("120", time.Now())), "Did not compare with the stored value")
+}
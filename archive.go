@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"webtrack/storage"
+)
+
+func compressBody(body string) ([]byte, error) {
+	var buffer bytes.Buffer
+	var writer = gzip.NewWriter(&buffer)
+	_, err := writer.Write([]byte(body))
+	if err != nil {
+		return nil, err
+	}
+	err = writer.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func decompressBody(data []byte) (string, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	body, err := io.ReadAll(reader)
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+
+func getArchive(store storage.Storage) (storage.Archive, error) {
+	// Archiving is not buffered, so it is done directly in the wrapped storage
+	if archive, ok := storage.As[storage.Archive](store); ok {
+		return archive, nil
+	}
+	return nil, errors.New("storage backend does not support response archiving")
+}
+
+func archiveResponse(archive storage.Archive, config QueryConfig, timestamp int64, body string) error {
+	var hash = GetStringHash(body)
+
+	// Bodies are stored only once per unique content, snapshots only reference them
+	compressed, err := compressBody(body)
+	if err != nil {
+		return err
+	}
+	err = archive.ArchiveBody(hash, compressed)
+	if err != nil {
+		return err
+	}
+
+	return archive.AppendSnapshot(storage.Snapshot{Name: config.Name, Timestamp: timestamp, Hash: hash, Version: config.Version})
+}
+
+func ReplayQuery(ctx context.Context, store storage.Storage, configPath string) (err error) {
+	archive, err := getArchive(store)
+	if err != nil {
+		return err
+	}
+
+	configs, err := ReadQueries(configPath)
+	if err != nil {
+		return err
+	}
+	for _, config := range configs {
+		err = replaySeries(ctx, store, archive, config, configPath)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func replaySeries(ctx context.Context, store storage.Storage, archive storage.Archive, config QueryConfig, configPath string) (err error) {
+	if config.Source != "page" {
+		return errors.New("replay is only supported for the page source")
+	}
+	err = createQuerySeries(store, config)
+	if err != nil {
+		return err
+	}
+	config.Version, err = checkQueryVersion(store, config.Name, configPath)
+	if err != nil {
+		return err
+	}
+
+	snapshots, err := archive.Snapshots(config.Name)
+	if err != nil {
+		return err
+	}
+
+	var lastValue = ""
+	var written = 0
+	for _, snapshot := range snapshots {
+		// Snapshots collected with the current version were already processed by the tracker
+		if snapshot.Version == config.Version {
+			continue
+		}
+
+		compressed, err := archive.LoadBody(snapshot.Hash)
+		if err != nil {
+			return err
+		}
+		body, err := decompressBody(compressed)
+		if err != nil {
+			return err
+		}
+
+		res, err := extractValue(config, body)
+		if err != nil {
+			fmt.Printf("Skipping snapshot taken at %v: %v\n", snapshot.Timestamp, err)
+			continue
+		}
+
+		if config.OnlyIfDifferent && lastValue == res {
+			continue
+		}
+
+		// Do not duplicate the records if the same replay is executed more than once
+		existing, err := archive.FindByTimestamp(config.Name, snapshot.Timestamp, config.Version)
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			lastValue = res
+			continue
+		}
+
+		if config.OnlyIfUnique {
+			existing, err = store.FindByValue(ctx, config.Name, res, config.Version)
+			if err != nil {
+				return err
+			}
+			if existing != nil {
+				continue
+			}
+		}
+
+		err = store.AppendRecord(ctx, config.Name, storage.Record{Timestamp: snapshot.Timestamp, Value: res, Version: config.Version})
+		if err != nil {
+			return err
+		}
+		lastValue = res
+		written++
+	}
+
+	fmt.Printf("Replayed %v snapshots into collection %v with version %v\n", written, config.Name, config.Version)
+	return
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompressBody(t *testing.T) {
+	var assert = assert.New(t)
+
+	var body = strings.Repeat("<div>hello world</div>", 100)
+	var compressed, err = compressBody(body)
+	assert.Equal(nil, err, "Returned an error 1")
+	assert.Less(len(compressed), len(body), "Body was not compressed")
+
+	decompressed, err := decompressBody(compressed)
+	assert.Equal(nil, err, "Returned an error 2")
+	assert.Equal(body, decompressed, "Incorrect decompressed body")
+
+	compressed, err = compressBody("")
+	assert.Equal(nil, err, "Returned an error 3")
+	decompressed, err = decompressBody(compressed)
+	assert.Equal(nil, err, "Returned an error 4")
+	assert.Equal("", decompressed, "Incorrect decompressed empty body")
+
+	_, err = decompressBody([]byte("not compressed"))
+	assert.NotEqual(nil, err, "Did not return an error for invalid data")
+}
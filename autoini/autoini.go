@@ -26,6 +26,10 @@ type ImplementsDefaultBool interface {
 	DefaultBool(key string) bool
 }
 
+type ImplementsDefaultStringSlice interface {
+	DefaultStringSlice(key string) []string
+}
+
 type ImplementsPostInit interface {
 	// Must be implemented as a pointer receiver
 	PostInit() (err error)
@@ -118,6 +122,20 @@ func setBoolKey[T Configurable](result T, key string, value reflect.Value, cfg *
 	)
 }
 
+func setStringSliceKey[T Configurable](result T, key string, value reflect.Value, cfg *ini.File) (err error) {
+	return setGenericKey(result, key, value, cfg,
+		func(value reflect.Value, valueInConfig *ini.Key) (err error) {
+			// Values are comma-separated, the spaces around each value are trimmed
+			value.Set(reflect.ValueOf(valueInConfig.Strings(",")))
+			return
+		},
+		func(def ImplementsDefaultStringSlice, key string, value reflect.Value) (err error) {
+			value.Set(reflect.ValueOf(def.DefaultStringSlice(key)))
+			return
+		},
+	)
+}
+
 func ReadIni[T Configurable](path string) (result T, err error) {
 	cfg, err := ini.Load(path)
 	if err != nil {
@@ -129,6 +147,10 @@ func ReadIni[T Configurable](path string) (result T, err error) {
 
 	for i := 0; i < reflect.Indirect(configReflection).NumField(); i++ {
 		var fieldName = typeOfConfig.Field(i).Name
+		// Fields tagged with ini:"-" are not read from the file
+		if typeOfConfig.Field(i).Tag.Get("ini") == "-" {
+			continue
+		}
 		if len(fieldName) == 0 || !unicode.IsUpper(rune(fieldName[0])) {
 			return result, errors.New("field does not exist or is not exported: " + fieldName)
 		}
@@ -143,6 +165,12 @@ func ReadIni[T Configurable](path string) (result T, err error) {
 			err = setIntKey(result, fieldName, reflect.Indirect(configReflection).Field(i), cfg)
 		case "bool":
 			err = setBoolKey(result, fieldName, reflect.Indirect(configReflection).Field(i), cfg)
+		case "":
+			// Unnamed types are supported only for the string slices
+			if configValueType.Kind() != reflect.Slice || configValueType.Elem().Kind() != reflect.String {
+				return result, errors.New("unsupported ini value type: " + configValueType.String())
+			}
+			err = setStringSliceKey(result, fieldName, reflect.Indirect(configReflection).Field(i), cfg)
 		default:
 			return result, errors.New("unsupported ini value type: " + configValueType.Name())
 		}
@@ -55,6 +55,29 @@ func (v ValuesDefault) PostInit() (err error) {
 	return nil
 }
 
+type SliceValues struct {
+	Value1 []string
+	Value2 []string
+	Value3 []string
+}
+
+func (v SliceValues) Optional(key string) bool {
+	return key == "Value3"
+}
+
+func (v SliceValues) DefaultStringSlice(key string) []string {
+	return []string{"default"}
+}
+
+type SkippedValues struct {
+	Value1 bool
+	Value2 map[string]string `ini:"-"`
+}
+
+type UnsupportedSliceValues struct {
+	Value1 []int
+}
+
 func TestReadIniInvalid(t *testing.T) {
 	var assert = assert.New(t)
 
@@ -98,3 +121,26 @@ func TestReadIniOptionalImplementationsValid(t *testing.T) {
 	assert.Contains(err.Error(), "42 is not allowed")
 	assert.Equal(42, ini.Value2, "Incorrect new Value2 returned")
 }
+
+func TestReadIniStringSlice(t *testing.T) {
+	var assert = assert.New(t)
+
+	var ini, err = ReadIni[SliceValues]("./test/d.ini")
+	assert.Equal(nil, err, "Was not able to read a valid ini file")
+	assert.Equal([]string{"a", "b", "c"}, ini.Value1, "Incorrect Value1 returned")
+	assert.Equal([]string{}, ini.Value2, "Incorrect Value2 returned")
+	assert.Equal([]string{"default"}, ini.Value3, "Incorrect Value3 returned")
+
+	_, err = ReadIni[UnsupportedSliceValues]("./test/d.ini")
+	assert.NotEqual(nil, err, "Was able to read an unsupported slice type")
+	assert.Contains(err.Error(), "unsupported ini value type: []int")
+}
+
+func TestReadIniSkippedField(t *testing.T) {
+	var assert = assert.New(t)
+
+	var ini, err = ReadIni[SkippedValues]("./test/c.ini")
+	assert.Equal(nil, err, "Was not able to read a valid ini file")
+	assert.Equal(true, ini.Value1, "Incorrect Value1 returned")
+	assert.Equal(map[string]string(nil), ini.Value2, "Skipped field was set")
+}
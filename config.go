@@ -1,12 +1,241 @@
 package main
 
+import (
+	"errors"
+	"slices"
+)
+
 type Config struct {
-	MongodbConnectionUrl  string
-	DatabaseName          string
-	VersionCollectionName string
+	StorageBackend                   string
+	AdditionalSinks                  []string
+	MongodbConnectionUrl             string
+	DatabaseName                     string
+	MongodbBatchSize                 int
+	MongodbBatchIntervalMilliseconds int
+	SqlitePath                       string
+	FileDirectory                    string
+	FileRotateDaily                  bool
+	FileMaxSizeBytes                 int
+	VersionCollectionName            string
+	ArchiveCollectionName            string
+	SnapshotCollectionName           string
+	ErrorCollectionName              string
+	ErrorDeduplicationSeconds        int
+	AlertCollectionName              string
+	BufferDirectory                  string
+	BufferMaxRecords                 int
+	BufferOverflowPolicy             string
+	BufferRetryIntervalSeconds       int
+	BufferMaxAttempts                int
+	MetricsAddress                   string
+	MaintenanceIntervalMinutes       int
+	ShutdownTimeoutSeconds           int
+	QueryReloadIntervalSeconds       int
+	JitterPercent                    int
+	StartupStaggerSeconds            int
+	WorkerPoolSize                   int
 }
 
 func (cfg Config) Optional(key string) bool {
-	// All values are mandatory
-	return false
+	switch key {
+	case "StorageBackend":
+		return true
+	case "AdditionalSinks":
+		return true
+	case "MongodbConnectionUrl":
+		return true
+	case "DatabaseName":
+		return true
+	case "MongodbBatchSize":
+		return true
+	case "MongodbBatchIntervalMilliseconds":
+		return true
+	case "SqlitePath":
+		return true
+	case "FileDirectory":
+		return true
+	case "FileRotateDaily":
+		return true
+	case "FileMaxSizeBytes":
+		return true
+	case "ArchiveCollectionName":
+		return true
+	case "SnapshotCollectionName":
+		return true
+	case "ErrorCollectionName":
+		return true
+	case "ErrorDeduplicationSeconds":
+		return true
+	case "AlertCollectionName":
+		return true
+	case "BufferDirectory":
+		return true
+	case "BufferMaxRecords":
+		return true
+	case "BufferOverflowPolicy":
+		return true
+	case "BufferRetryIntervalSeconds":
+		return true
+	case "BufferMaxAttempts":
+		return true
+	case "MetricsAddress":
+		return true
+	case "MaintenanceIntervalMinutes":
+		return true
+	case "ShutdownTimeoutSeconds":
+		return true
+	case "QueryReloadIntervalSeconds":
+		return true
+	case "JitterPercent":
+		return true
+	case "StartupStaggerSeconds":
+		return true
+	case "WorkerPoolSize":
+		return true
+	default:
+		return false
+	}
+}
+
+func (cfg Config) DefaultString(key string) string {
+	switch key {
+	case "StorageBackend":
+		return "mongodb"
+	case "SqlitePath":
+		return "webtrack.db"
+	case "FileDirectory":
+		return "data"
+	case "ArchiveCollectionName":
+		return "_archive"
+	case "SnapshotCollectionName":
+		return "_snapshots"
+	case "ErrorCollectionName":
+		return "_errors"
+	case "AlertCollectionName":
+		return "_alerts"
+	case "BufferDirectory":
+		return "buffer"
+	case "BufferOverflowPolicy":
+		return "drop-oldest"
+	default:
+		return ""
+	}
+}
+
+func (cfg Config) DefaultInt(key string) int {
+	switch key {
+	case "MongodbBatchIntervalMilliseconds":
+		return 1000
+	case "ErrorDeduplicationSeconds":
+		return 3600
+	case "BufferMaxRecords":
+		return 10000
+	case "BufferRetryIntervalSeconds":
+		return 30
+	case "BufferMaxAttempts":
+		return 120
+	case "MaintenanceIntervalMinutes":
+		return 60
+	case "ShutdownTimeoutSeconds":
+		return 30
+	case "QueryReloadIntervalSeconds":
+		return 5
+	case "WorkerPoolSize":
+		return 8
+	default:
+		return 0
+	}
+}
+
+func (cfg Config) DefaultBool(key string) bool {
+	switch key {
+	case "FileRotateDaily":
+		return true
+	default:
+		return false
+	}
+}
+
+func (cfg Config) DefaultStringSlice(key string) []string {
+	return []string{}
+}
+
+func validateBackend(cfg Config, backend string) error {
+	switch backend {
+	case "mongodb":
+		if cfg.MongodbConnectionUrl == "" || cfg.DatabaseName == "" {
+			return errors.New("MongodbConnectionUrl and DatabaseName are required by the mongodb storage backend")
+		}
+	case "sqlite":
+		// No action required, the database file is created if missing
+	case "csv", "jsonl":
+		// No action required, the directory is created if missing
+	default:
+		return errors.New("Invalid storage backend " + backend + ". Only \"mongodb\", \"sqlite\", \"csv\" and \"jsonl\" storage backends are supported")
+	}
+	return nil
+}
+
+func (cfg *Config) PostInit() (err error) {
+	err = validateBackend(*cfg, cfg.StorageBackend)
+	if err != nil {
+		return err
+	}
+
+	for i, sink := range cfg.AdditionalSinks {
+		err = validateBackend(*cfg, sink)
+		if err != nil {
+			return err
+		}
+		if sink == cfg.StorageBackend || slices.Contains(cfg.AdditionalSinks[:i], sink) {
+			return errors.New("sink " + sink + " is used more than once")
+		}
+	}
+	if cfg.FileMaxSizeBytes < 0 {
+		return errors.New("FileMaxSizeBytes must not be negative")
+	}
+	if cfg.MongodbBatchSize < 0 {
+		return errors.New("MongodbBatchSize must not be negative")
+	}
+	if cfg.MongodbBatchIntervalMilliseconds <= 0 {
+		return errors.New("MongodbBatchIntervalMilliseconds must be positive")
+	}
+	if cfg.BufferMaxRecords < 0 {
+		return errors.New("BufferMaxRecords must not be negative")
+	}
+	// Batched values are only kept in memory, so they would bypass the buffer
+	if cfg.MongodbBatchSize > 0 && cfg.BufferMaxRecords > 0 {
+		return errors.New("MongodbBatchSize can not be used with the buffering, set BufferMaxRecords to 0")
+	}
+	if cfg.BufferOverflowPolicy != "drop-oldest" && cfg.BufferOverflowPolicy != "drop-newest" {
+		return errors.New("Invalid buffer overflow policy " + cfg.BufferOverflowPolicy + ". Only \"drop-oldest\" and \"drop-newest\" policies are supported")
+	}
+	if cfg.BufferRetryIntervalSeconds <= 0 {
+		return errors.New("BufferRetryIntervalSeconds must be positive")
+	}
+	if cfg.BufferMaxAttempts < 0 {
+		return errors.New("BufferMaxAttempts must not be negative")
+	}
+	if cfg.ErrorDeduplicationSeconds < 0 {
+		return errors.New("ErrorDeduplicationSeconds must not be negative")
+	}
+	if cfg.MaintenanceIntervalMinutes <= 0 {
+		return errors.New("MaintenanceIntervalMinutes must be positive")
+	}
+	if cfg.QueryReloadIntervalSeconds < 0 {
+		return errors.New("QueryReloadIntervalSeconds must not be negative")
+	}
+	if cfg.JitterPercent < 0 || cfg.JitterPercent > 100 {
+		return errors.New("JitterPercent must be between 0 and 100")
+	}
+	if cfg.StartupStaggerSeconds < 0 {
+		return errors.New("StartupStaggerSeconds must not be negative")
+	}
+	if cfg.WorkerPoolSize <= 0 {
+		return errors.New("WorkerPoolSize must be positive")
+	}
+	if cfg.ShutdownTimeoutSeconds <= 0 {
+		return errors.New("ShutdownTimeoutSeconds must be positive")
+	}
+	return
 }
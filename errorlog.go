@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+	"webtrack/storage"
+)
+
+// Failure of a single stage of the tracker cycle: fetch, extract, convert or write
+type stageError struct {
+	stage string
+	err   error
+}
+
+func (e stageError) Error() string {
+	return e.err.Error()
+}
+
+func (e stageError) Unwrap() error {
+	return e.err
+}
+
+type errorKey struct {
+	stage   string
+	message string
+}
+
+type reportedError struct {
+	time     time.Time
+	repeated int64
+}
+
+// Records the failures of a query into the storage, the identical ones are recorded once per window
+type errorReporter struct {
+	log      storage.ErrorLog
+	config   QueryConfig
+	window   time.Duration
+	reported map[errorKey]*reportedError
+	// The notifications are reported from their own goroutine
+	lock sync.Mutex
+}
+
+func newErrorReporter(store storage.Storage, config QueryConfig, window time.Duration) *errorReporter {
+	var errorLog, _ = storage.As[storage.ErrorLog](store)
+	return &errorReporter{log: errorLog, config: config, window: window, reported: map[errorKey]*reportedError{}}
+}
+
+func (r *errorReporter) Report(err error, now time.Time) {
+	if r.log == nil {
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	var key = errorKey{stage: "unknown", message: err.Error()}
+	var failure stageError
+	if errors.As(err, &failure) {
+		key.stage = failure.stage
+	}
+
+	var previous, found = r.reported[key]
+	if found && now.Sub(previous.time) < r.window {
+		previous.repeated++
+		return
+	}
+	// Forget the errors which did not happen for a while
+	for existing, reported := range r.reported {
+		if existing != key && now.Sub(reported.time) >= r.window {
+			delete(r.reported, existing)
+		}
+	}
+
+	var record = storage.ErrorRecord{Timestamp: now.UnixMilli(), Name: r.config.Name, Stage: key.stage, Message: key.message, Version: r.config.Version}
+	if found {
+		record.Repeated = previous.repeated
+	}
+	var writeErr = r.log.AppendError(record)
+	if writeErr != nil {
+		fmt.Printf("Failed to record the error of %v: %v\n", r.config.Name, writeErr)
+		return
+	}
+	r.reported[key] = &reportedError{time: now}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"webtrack/storage"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorReporter(t *testing.T) {
+	var assert = assert.New(t)
+
+	var dir = t.TempDir()
+	var store, err = storage.NewFileStorage(storage.FileConfig{Directory: dir, Format: "csv", VersionCollectionName: "_version", ErrorCollectionName: "_errors"})
+	assert.Equal(nil, err, "Did not create a storage")
+
+	var reporter = newErrorReporter(store, QueryConfig{Name: "test", Version: 2}, time.Minute)
+	var now = time.UnixMilli(1000)
+	reporter.Report(stageError{stage: "fetch", err: errors.New("timeout")}, now)
+	// Identical errors are skipped within the window
+	reporter.Report(stageError{stage: "fetch", err: errors.New("timeout")}, now.Add(time.Second))
+	reporter.Report(stageError{stage: "fetch", err: errors.New("timeout")}, now.Add(2*time.Second))
+	reporter.Report(stageError{stage: "extract", err: errors.New("timeout")}, now.Add(3*time.Second))
+	reporter.Report(stageError{stage: "fetch", err: errors.New("timeout")}, now.Add(time.Minute))
+	reporter.Report(errors.New("other"), now.Add(time.Minute))
+
+	data, err := os.ReadFile(filepath.Join(dir, "_errors.csv"))
+	assert.Equal(nil, err, "Did not write the errors")
+	assert.Equal([]string{
+		"timestamp,name,stage,message,version,repeated",
+		"1000,test,fetch,timeout,2,0",
+		"4000,test,extract,timeout,2,0",
+		"61000,test,fetch,timeout,2,2",
+		"61000,test,unknown,other,2,0",
+	}, strings.Split(strings.TrimSpace(string(data)), "\n"), "Incorrect errors recorded")
+}
+
+func TestExtractValueStages(t *testing.T) {
+	var assert = assert.New(t)
+
+	var failure stageError
+	var _, err = extractValue(QueryConfig{Before: "<b>", After: "</b>", AnyTag: "*"}, "<i>1</i>")
+	assert.True(errors.As(err, &failure), "Did not return a stage error 1")
+	assert.Equal("extract", failure.stage, "Incorrect stage 1")
+
+	_, err = extractValue(QueryConfig{Before: "<b>", After: "</b>", AnyTag: "*", ResultType: "number"}, "<b>abc</b>")
+	assert.True(errors.As(err, &failure), "Did not return a stage error 2")
+	assert.Equal("convert", failure.stage, "Incorrect stage 2")
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"webtrack/storage"
+)
+
+type feedItem struct {
+	Guid      string
+	Title     string
+	Link      string
+	Published string
+}
+
+type rssDocument struct {
+	Items []struct {
+		Guid    string `xml:"guid"`
+		Title   string `xml:"title"`
+		Link    string `xml:"link"`
+		PubDate string `xml:"pubDate"`
+	} `xml:"channel>item"`
+}
+
+// RSS 1.0 keeps the items next to the channel
+type rdfDocument struct {
+	Items []struct {
+		About string `xml:"about,attr"`
+		Title string `xml:"title"`
+		Link  string `xml:"link"`
+		Date  string `xml:"date"`
+	} `xml:"item"`
+}
+
+type atomDocument struct {
+	Entries []struct {
+		Id    string `xml:"id"`
+		Title string `xml:"title"`
+		Links []struct {
+			Href string `xml:"href,attr"`
+			Rel  string `xml:"rel,attr"`
+		} `xml:"link"`
+		Published string `xml:"published"`
+		Updated   string `xml:"updated"`
+	} `xml:"entry"`
+}
+
+var feedDateFormats = []string{time.RFC1123Z, time.RFC1123, time.RFC3339, "Mon, 2 Jan 2006 15:04:05 -0700", "Mon, 2 Jan 2006 15:04:05 MST", "2 Jan 2006 15:04:05 -0700"}
+
+// Converts the dates to RFC 3339 in UTC, the dates in unknown formats are kept as they are
+func normalizeFeedDate(value string) string {
+	value = strings.TrimSpace(value)
+	for _, format := range feedDateFormats {
+		if parsed, err := time.Parse(format, value); err == nil {
+			return parsed.UTC().Format(time.RFC3339)
+		}
+	}
+	return value
+}
+
+// Returns the items of an RSS 2.0, RSS 1.0 or Atom feed in the order of the document
+func parseFeed(body string) (result []feedItem, err error) {
+	var decoder = xml.NewDecoder(strings.NewReader(body))
+	var root xml.StartElement
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, errors.New("failed to find the feed element: " + err.Error())
+		}
+		if start, ok := token.(xml.StartElement); ok {
+			root = start
+			break
+		}
+	}
+
+	switch root.Name.Local {
+	case "rss":
+		var document rssDocument
+		err = decoder.DecodeElement(&document, &root)
+		for _, item := range document.Items {
+			result = append(result, feedItem{Guid: item.Guid, Title: item.Title, Link: item.Link, Published: item.PubDate})
+		}
+	case "RDF":
+		var document rdfDocument
+		err = decoder.DecodeElement(&document, &root)
+		for _, item := range document.Items {
+			result = append(result, feedItem{Guid: item.About, Title: item.Title, Link: item.Link, Published: item.Date})
+		}
+	case "feed":
+		var document atomDocument
+		err = decoder.DecodeElement(&document, &root)
+		for _, entry := range document.Entries {
+			var item = feedItem{Guid: entry.Id, Title: entry.Title, Published: entry.Published}
+			if item.Published == "" {
+				item.Published = entry.Updated
+			}
+			for _, link := range entry.Links {
+				if link.Rel == "" || link.Rel == "alternate" {
+					item.Link = link.Href
+					break
+				}
+			}
+			result = append(result, item)
+		}
+	default:
+		return nil, errors.New("unsupported feed format: " + root.Name.Local)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range result {
+		result[i].Guid = strings.TrimSpace(result[i].Guid)
+		result[i].Title = strings.TrimSpace(result[i].Title)
+		result[i].Link = strings.TrimSpace(result[i].Link)
+		result[i].Published = normalizeFeedDate(result[i].Published)
+		// Not every feed has the identifiers of the items
+		if result[i].Guid == "" {
+			result[i].Guid = result[i].Link
+		}
+	}
+	return
+}
+
+// Writes the items which are not in the storage yet, the oldest first. The record is used as a template for the items.
+func recordFeedItems(ctx context.Context, config QueryConfig, store storage.Storage, sinks []querySink, html string, record storage.Record) (written int, err error) {
+	items, err := parseFeed(html)
+	if err != nil {
+		return 0, stageError{stage: "extract", err: fmt.Errorf("failed to parse the feed: %w", err)}
+	}
+
+	var errs []error
+	// Feeds usually list the newest items first
+	for i := len(items) - 1; i >= 0; i-- {
+		var item = items[i]
+		if item.Guid == "" {
+			continue
+		}
+		// Same check as OnlyIfUnique, the guid is the value of the record
+		existing, err := store.FindByValue(ctx, config.Name, item.Guid, config.Version)
+		if err != nil {
+			fmt.Printf("Failed the search for an existing record in the storage: %v\n", err)
+			continue
+		}
+		if existing != nil {
+			continue
+		}
+
+		record.Value = item.Guid
+		record.Fields = map[string]string{"title": item.Title, "link": item.Link, "published": item.Published}
+		sinksWritten, err := writeToSinks(ctx, sinks, config.Name, record)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		if len(sinksWritten) > 0 {
+			written++
+		}
+	}
+	if len(errs) > 0 {
+		return written, stageError{stage: "write", err: errors.Join(errs...)}
+	}
+	return written, nil
+}
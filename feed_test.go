@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"webtrack/storage"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testRssFeed = `<?xml version="1.0" encoding="UTF-8"?>
+<rss version="2.0"><channel><title>News</title>
+<item><guid>2</guid><title>Second</title><link>https://example.com/2</link><pubDate>Fri, 18 Oct 2024 12:00:00 +0200</pubDate></item>
+<item><title>First</title><link>https://example.com/1</link><pubDate>Thu, 17 Oct 2024 12:00:00 GMT</pubDate></item>
+</channel></rss>`
+
+const testAtomFeed = `<?xml version="1.0" encoding="utf-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom"><title>News</title>
+<entry><id>urn:1</id><title> First </title><link rel="self" href="https://example.com/self"/><link href="https://example.com/1"/><updated>2024-10-18T10:00:00Z</updated></entry>
+</feed>`
+
+func TestParseFeed(t *testing.T) {
+	var assert = assert.New(t)
+
+	var items, err = parseFeed(testRssFeed)
+	assert.Equal(nil, err, "Returned an error 1")
+	assert.Equal([]feedItem{
+		{Guid: "2", Title: "Second", Link: "https://example.com/2", Published: "2024-10-18T10:00:00Z"},
+		{Guid: "https://example.com/1", Title: "First", Link: "https://example.com/1", Published: "2024-10-17T12:00:00Z"},
+	}, items, "Incorrect RSS items")
+
+	items, err = parseFeed(testAtomFeed)
+	assert.Equal(nil, err, "Returned an error 2")
+	assert.Equal([]feedItem{{Guid: "urn:1", Title: "First", Link: "https://example.com/1", Published: "2024-10-18T10:00:00Z"}}, items, "Incorrect Atom items")
+
+	items, err = parseFeed(`<rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#" xmlns:dc="http://purl.org/dc/elements/1.1/"><item rdf:about="https://example.com/1"><title>First</title><link>https://example.com/1</link><dc:date>2024-10-18T10:00:00Z</dc:date></item></rdf:RDF>`)
+	assert.Equal(nil, err, "Returned an error 3")
+	assert.Equal([]feedItem{{Guid: "https://example.com/1", Title: "First", Link: "https://example.com/1", Published: "2024-10-18T10:00:00Z"}}, items, "Incorrect RDF items")
+
+	_, err = parseFeed("<html><body></body></html>")
+	assert.NotEqual(nil, err, "Did not return an error for a page")
+	_, err = parseFeed("not a feed")
+	assert.NotEqual(nil, err, "Did not return an error for a text")
+}
+
+func TestRecordFeedItems(t *testing.T) {
+	var assert = assert.New(t)
+
+	var store = newTestStorage(t)
+	store.CreateSeries("news")
+	var config = QueryConfig{Name: "news", Source: "feed"}
+	var sinks = []querySink{{name: "storage", sink: store}}
+
+	written, err := recordFeedItems(context.Background(), config, store, sinks, testRssFeed, storage.Record{Timestamp: 1})
+	assert.Equal(nil, err, "Returned an error 1")
+	assert.Equal(2, written, "Did not write the new items")
+
+	// The newest item is written last
+	record, err := store.LastRecord(context.Background(), "news")
+	assert.Equal(nil, err, "Did not return the last record")
+	assert.Equal("2", record.Value, "Incorrect order of the items")
+
+	// Known items are skipped
+	written, err = recordFeedItems(context.Background(), config, store, sinks, testRssFeed, storage.Record{Timestamp: 2})
+	assert.Equal(nil, err, "Returned an error 2")
+	assert.Equal(0, written, "Wrote the known items again")
+
+	_, err = recordFeedItems(context.Background(), config, store, sinks, "not a feed", storage.Record{Timestamp: 3})
+	var failure stageError
+	assert.ErrorAs(err, &failure, "Did not return a stage error")
+	assert.Equal("extract", failure.stage, "Incorrect stage")
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"log"
 	"os"
 	"path/filepath"
 	"strings"
@@ -11,8 +10,8 @@ func GetFileNameWithoutExtension(path string) string {
 	return strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
 }
 
-func ListIniFiles(directory string) (result []string) {
-	err := filepath.Walk(directory, func(path string, info os.FileInfo, err error) error {
+func ListIniFiles(directory string) (result []string, err error) {
+	err = filepath.Walk(directory, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
@@ -23,8 +22,5 @@ func ListIniFiles(directory string) (result []string) {
 		}
 		return nil
 	})
-	if err != nil {
-		log.Fatalln(err)
-	}
 	return
 }
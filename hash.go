@@ -23,3 +23,7 @@ func GetFileHash(path string) (hash string, err error) {
 	hash = fmt.Sprintf("%x", hashFunction.Sum(nil))
 	return
 }
+
+func GetStringHash(data string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(data)))
+}
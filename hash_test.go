@@ -1,6 +1,7 @@
 package main
 
 import (
+	"os"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -24,3 +25,14 @@ func TestGetFileHashInvalid(t *testing.T) {
 	var _, err = GetFileHash("invalid.exe")
 	assert.NotEqual(nil, err, "Did not return an error 1")
 }
+
+func TestGetStringHash(t *testing.T) {
+	var assert = assert.New(t)
+
+	var fileHash, err = GetFileHash("test/example.txt")
+	assert.Equal(nil, err, "Returned an error")
+	data, err := os.ReadFile("test/example.txt")
+	assert.Equal(nil, err, "Failed to read the file")
+	assert.Equal(fileHash, GetStringHash(string(data)), "String hash does not match the file hash")
+	assert.Equal("e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", GetStringHash(""), "Incorrect empty string hash")
+}
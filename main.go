@@ -1,14 +1,20 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"syscall"
+	"time"
 
 	"webtrack/autoini"
-	"webtrack/mongodb"
+	"webtrack/storage"
 )
 
 func main() {
@@ -17,31 +23,125 @@ func main() {
 		log.Fatal(err)
 	}
 
-	mongo, err := mongodb.NewMongoDB(config.MongodbConnectionUrl, config.DatabaseName)
+	store, err := newStorage(config, config.StorageBackend)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer mongo.Disconnect()
+	if config.BufferMaxRecords > 0 {
+		store, err = storage.NewBufferedStorage(store, config.StorageBackend, newBufferConfig(config))
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	defer store.Close()
 
-	// Create the default versions collection
-	err = mongo.CreateCollection(config.VersionCollectionName)
-	if err != nil {
-		log.Fatal(err)
+	if config.MetricsAddress != "" {
+		// expvar registers the metrics handler at /debug/vars
+		go func() {
+			log.Fatal(http.ListenAndServe(config.MetricsAddress, nil))
+		}()
 	}
 
+	// Cancelled on SIGINT or SIGTERM to interrupt the running requests
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		awaitTermination()
+		fmt.Println("Gracefully exiting...")
+		cancel()
+	}()
+
 	var dir = "./queries"
-	var stopRequest = make(chan any)
+	if len(os.Args) > 1 {
+		err = runCommand(ctx, os.Args[1:], dir, store)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	var registry = NewSinkRegistry(config, store)
+	defer registry.Close()
+
 	var stopResponse = make(chan any)
-	err = StartTrackers(ListIniFiles(dir), config, mongo, stopRequest, stopResponse)
+	err = StartTrackers(ctx, dir, config, store, registry, stopResponse)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	var maintenanceStopResponse = make(chan any)
+	StartMaintenance(ctx, dir, config, store, maintenanceStopResponse)
+
 	fmt.Println("webtrack initialized. Waiting for termination...")
-	awaitTermination()
-	fmt.Println("Gracefully exiting...")
-	close(stopRequest)
-	<-stopResponse
+	<-ctx.Done()
+
+	// Trackers which are stuck are abandoned, the storage is closed by the deferred calls in any case
+	var deadline = time.After(time.Duration(config.ShutdownTimeoutSeconds) * time.Second)
+	for _, c := range []chan any{stopResponse, maintenanceStopResponse} {
+		select {
+		case <-c:
+		case <-deadline:
+			fmt.Println("Shutdown timeout reached, exiting without waiting for the remaining trackers")
+			return
+		}
+	}
+}
+
+func newStorage(config Config, backend string) (storage.Storage, error) {
+	switch backend {
+	case "mongodb":
+		return storage.NewMongoStorage(storage.MongoConfig{
+			ConnectionUrl:          config.MongodbConnectionUrl,
+			DatabaseName:           config.DatabaseName,
+			VersionCollectionName:  config.VersionCollectionName,
+			ArchiveCollectionName:  config.ArchiveCollectionName,
+			SnapshotCollectionName: config.SnapshotCollectionName,
+			ErrorCollectionName:    config.ErrorCollectionName,
+			AlertCollectionName:    config.AlertCollectionName,
+			BatchSize:              config.MongodbBatchSize,
+			BatchInterval:          time.Duration(config.MongodbBatchIntervalMilliseconds) * time.Millisecond,
+		})
+	case "sqlite":
+		return storage.NewSqliteStorage(storage.SqliteConfig{
+			Path:                   config.SqlitePath,
+			VersionCollectionName:  config.VersionCollectionName,
+			ArchiveCollectionName:  config.ArchiveCollectionName,
+			SnapshotCollectionName: config.SnapshotCollectionName,
+			ErrorCollectionName:    config.ErrorCollectionName,
+			AlertCollectionName:    config.AlertCollectionName,
+		})
+	case "csv", "jsonl":
+		return storage.NewFileStorage(storage.FileConfig{
+			Directory:             config.FileDirectory,
+			Format:                backend,
+			RotateDaily:           config.FileRotateDaily,
+			MaxSizeBytes:          int64(config.FileMaxSizeBytes),
+			VersionCollectionName: config.VersionCollectionName,
+			ErrorCollectionName:   config.ErrorCollectionName,
+			AlertCollectionName:   config.AlertCollectionName,
+		})
+	default:
+		// PostInit should have validated the backend
+		return nil, errors.New("unknown storage backend: " + backend)
+	}
+}
+
+func runCommand(ctx context.Context, args []string, dir string, store storage.Storage) error {
+	if len(args) != 2 {
+		return errors.New("usage: webtrack <replay|migrate> <query>")
+	}
+	var configPath = args[1]
+	if !strings.HasSuffix(configPath, ".ini") {
+		configPath = filepath.Join(dir, configPath+".ini")
+	}
+
+	switch args[0] {
+	case "replay":
+		return ReplayQuery(ctx, store, configPath)
+	case "migrate":
+		return MigrateQuery(store, configPath)
+	default:
+		return errors.New("unknown command: " + args[0])
+	}
 }
 
 func awaitTermination() {
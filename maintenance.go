@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+	"webtrack/storage"
+)
+
+func rollupSeriesName(queryName string, interval string) string {
+	return queryName + "_" + interval
+}
+
+// Series and rollup names of all query files with the paths of the files. The rollup of one query
+// must not be written into the series of another one, and DependsOn must refer to an existing series.
+type queryNames struct {
+	series  map[string]string
+	rollups map[string]string
+}
+
+// The files which can not be read are skipped, they are reported once they are loaded
+func readQueryNames(queries []string) queryNames {
+	var result = queryNames{series: map[string]string{}, rollups: map[string]string{}}
+	for _, configPath := range queries {
+		configs, err := ReadQueries(configPath)
+		if err != nil {
+			continue
+		}
+		for _, config := range configs {
+			result.series[config.Name] = configPath
+			for _, interval := range config.DownsampleIntervals {
+				result.rollups[rollupSeriesName(config.Name, interval)] = configPath
+			}
+		}
+	}
+	return result
+}
+
+func (n queryNames) checkRollups(config QueryConfig) error {
+	if owner, found := n.rollups[config.Name]; found {
+		return errors.New("series " + config.Name + " is used by the downsampling of " + owner)
+	}
+	for _, interval := range config.DownsampleIntervals {
+		var rollupSeries = rollupSeriesName(config.Name, interval)
+		if owner, found := n.series[rollupSeries]; found {
+			return errors.New("downsampling series " + rollupSeries + " of " + config.Name + " is used by " + owner)
+		}
+	}
+	return nil
+}
+
+func aggregateRecords(records []storage.Record, bucketStart int64) (result []storage.Rollup, err error) {
+	// Records of different query versions are not mixed together
+	var rollups = map[int64]*storage.Rollup{}
+	var versions = []int64{}
+	for _, record := range records {
+		value, err := strconv.ParseFloat(record.Value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to aggregate a non-numeric value %v: %w", record.Value, err)
+		}
+
+		var rollup, ok = rollups[record.Version]
+		if !ok {
+			rollup = &storage.Rollup{Timestamp: bucketStart, Version: record.Version, Min: value, Max: value}
+			rollups[record.Version] = rollup
+			versions = append(versions, record.Version)
+		}
+		rollup.Min = min(rollup.Min, value)
+		rollup.Max = max(rollup.Max, value)
+		// Sum is kept in Avg until all records are processed
+		rollup.Avg += value
+		rollup.Last = value
+		rollup.Count++
+	}
+
+	for _, version := range versions {
+		var rollup = rollups[version]
+		rollup.Avg /= float64(rollup.Count)
+		result = append(result, *rollup)
+	}
+	return
+}
+
+// Maximum period of the records loaded at once by the downsampling
+var maintenanceChunk = 7 * 24 * time.Hour
+
+func downsampleRecords(ctx context.Context, maintainer storage.Maintainer, series string, rollupSeries string, step int64, from int64, to int64) error {
+	records, err := maintainer.RecordsBetween(series, from, to)
+	if err != nil {
+		return err
+	}
+
+	var bucket = []storage.Record{}
+	for i, record := range records {
+		bucket = append(bucket, record)
+		if i == len(records)-1 || records[i+1].Timestamp/step != record.Timestamp/step {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			rollups, err := aggregateRecords(bucket, record.Timestamp/step*step)
+			if err != nil {
+				return err
+			}
+			for _, rollup := range rollups {
+				err = maintainer.AppendRollup(rollupSeries, rollup)
+				if err != nil {
+					return err
+				}
+			}
+			bucket = []storage.Record{}
+		}
+	}
+	return nil
+}
+
+func downsampleQuery(ctx context.Context, maintainer storage.Maintainer, config QueryConfig, interval string, now time.Time) error {
+	duration, err := time.ParseDuration(interval)
+	if err != nil {
+		return err
+	}
+	var step = duration.Milliseconds()
+	var rollupSeries = rollupSeriesName(config.Name, interval)
+
+	err = maintainer.CreateRollupSeries(rollupSeries)
+	if err != nil {
+		return err
+	}
+
+	// Continue after the last complete interval, only the intervals which already ended are aggregated
+	var from int64
+	lastRollup, err := maintainer.LastRollup(rollupSeries)
+	if err != nil {
+		return err
+	}
+	if lastRollup != nil {
+		from = lastRollup.Timestamp + step
+	} else {
+		// Skip the time before the first record instead of reading from the epoch
+		first, err := maintainer.FirstRecord(config.Name)
+		if err != nil || first == nil {
+			return err
+		}
+		from = first.Timestamp / step * step
+	}
+	var to = now.UnixMilli() / step * step
+
+	// The history is read in chunks of whole intervals to limit the memory used by the first run
+	var chunk = max(1, maintenanceChunk.Milliseconds()/step) * step
+	for chunkFrom := from; chunkFrom < to; chunkFrom += chunk {
+		err = downsampleRecords(ctx, maintainer, config.Name, rollupSeries, step, chunkFrom, min(chunkFrom+chunk, to))
+		if err != nil {
+			return err
+		}
+	}
+
+	if config.DownsampleRetentionDays > 0 {
+		return maintainer.DeleteBefore(rollupSeries, now.Add(-time.Duration(config.DownsampleRetentionDays)*24*time.Hour).UnixMilli())
+	}
+	return nil
+}
+
+func maintainQuery(ctx context.Context, maintainer storage.Maintainer, config QueryConfig, now time.Time) error {
+	// Rollups have to be created before the raw records are removed
+	for _, interval := range config.DownsampleIntervals {
+		err := downsampleQuery(ctx, maintainer, config, interval, now)
+		if err != nil {
+			return err
+		}
+	}
+
+	if config.RetentionDays > 0 {
+		return maintainer.DeleteBefore(config.Name, now.Add(-time.Duration(config.RetentionDays)*24*time.Hour).UnixMilli())
+	}
+	return nil
+}
+
+func runMaintenance(ctx context.Context, store storage.Storage, queries []string, now time.Time) error {
+	// The queries with the retention or the downsampling are not started with the other backends
+	maintainer, ok := storage.As[storage.Maintainer](store)
+	if !ok {
+		return nil
+	}
+
+	var names = readQueryNames(queries)
+	for _, configPath := range queries {
+		configs, err := ReadQueries(configPath)
+		if err != nil {
+			// The other queries are maintained while the file is being edited
+			fmt.Printf("Failed to read %v for the maintenance: %v\n", configPath, err)
+			continue
+		}
+		for _, config := range configs {
+			if config.RetentionDays == 0 && len(config.DownsampleIntervals) == 0 {
+				continue
+			}
+
+			err = names.checkRollups(config)
+			if err == nil {
+				err = maintainQuery(ctx, maintainer, config, now)
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err != nil {
+				fmt.Printf("Failed to perform the maintenance of %v: %v\n", config.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func StartMaintenance(ctx context.Context, dir string, globalConfig Config, store storage.Storage, stopResponse chan any) {
+	go func() {
+		defer close(stopResponse)
+
+		var ticker = time.NewTicker(time.Duration(globalConfig.MaintenanceIntervalMinutes) * time.Minute)
+		defer ticker.Stop()
+
+		for {
+			// Query files are read every time to pick up the configuration changes
+			queries, err := ListIniFiles(dir)
+			if err == nil {
+				err = runMaintenance(ctx, store, queries, time.Now())
+			}
+			if err != nil && ctx.Err() == nil {
+				fmt.Printf("Failed to perform the maintenance: %v\n", err)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
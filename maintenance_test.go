@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"webtrack/storage"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAggregateRecords(t *testing.T) {
+	var assert = assert.New(t)
+
+	var records = []storage.Record{{Value: "1", Version: 0}, {Value: "4", Version: 0}, {Value: "10", Version: 1}, {Value: "2", Version: 0}}
+	var rollups, err = aggregateRecords(records, 3600)
+	assert.Equal(nil, err, "Returned an error")
+	assert.Equal([]storage.Rollup{
+		{Timestamp: 3600, Version: 0, Min: 1, Max: 4, Avg: 7.0 / 3, Last: 2, Count: 3},
+		{Timestamp: 3600, Version: 1, Min: 10, Max: 10, Avg: 10, Last: 10, Count: 1},
+	}, rollups, "Incorrect rollups")
+
+	_, err = aggregateRecords([]storage.Record{{Value: "abc"}}, 0)
+	assert.NotEqual(nil, err, "Did not return an error for a non-numeric value")
+}
+
+func TestMaintainQuery(t *testing.T) {
+	var assert = assert.New(t)
+
+	var store, err = storage.NewSqliteStorage(storage.SqliteConfig{
+		Path:                   filepath.Join(t.TempDir(), "test.db"),
+		VersionCollectionName:  "_version",
+		ArchiveCollectionName:  "_archive",
+		SnapshotCollectionName: "_snapshots",
+		ErrorCollectionName:    "_errors",
+		AlertCollectionName:    "_alerts",
+	})
+	assert.Equal(nil, err, "Did not open a database")
+	defer store.Close()
+
+	var hour = int64(60 * 60 * 1000)
+	var day = 24 * hour
+	var now = time.UnixMilli(10*day + hour/2)
+	store.CreateSeries("test")
+	// Two records per hour during the first 10 days
+	for timestamp := int64(0); timestamp < 10*day; timestamp += hour / 2 {
+		store.AppendRecord(context.Background(), "test", storage.Record{Timestamp: timestamp, Value: "1", Version: 0})
+	}
+	// The current hour is not complete yet
+	store.AppendRecord(context.Background(), "test", storage.Record{Timestamp: 10 * day, Value: "2", Version: 0})
+
+	var config = QueryConfig{Name: "test", RetentionDays: 7, DownsampleIntervals: []string{"1h", "24h"}, DownsampleRetentionDays: 8}
+	err = maintainQuery(context.Background(), store, config, now)
+	assert.Equal(nil, err, "Maintenance returned an error 1")
+
+	records, err := store.RecordsBetween("test", 0, 11*day)
+	assert.Equal(nil, err, "Did not return the records")
+	assert.Equal(3*day+hour/2, records[0].Timestamp, "Old records were not removed")
+
+	hourly, err := store.LastRollup("test_1h")
+	assert.Equal(nil, err, "Did not return the hourly rollup")
+	assert.Equal(storage.Rollup{Timestamp: 10*day - hour, Min: 1, Max: 1, Avg: 1, Last: 1, Count: 2}, *hourly, "Incorrect hourly rollup")
+
+	daily, err := store.LastRollup("test_24h")
+	assert.Equal(nil, err, "Did not return the daily rollup")
+	assert.Equal(storage.Rollup{Timestamp: 9 * day, Min: 1, Max: 1, Avg: 1, Last: 1, Count: 48}, *daily, "Incorrect daily rollup")
+
+	// The next run continues after the last rollup
+	now = now.Add(time.Hour)
+	err = maintainQuery(context.Background(), store, config, now)
+	assert.Equal(nil, err, "Maintenance returned an error 2")
+	hourly, err = store.LastRollup("test_1h")
+	assert.Equal(nil, err, "Did not return the hourly rollup 2")
+	assert.Equal(storage.Rollup{Timestamp: 10 * day, Min: 2, Max: 2, Avg: 2, Last: 2, Count: 1}, *hourly, "Incorrect hourly rollup 2")
+}
+
+func TestRunMaintenance(t *testing.T) {
+	var assert = assert.New(t)
+
+	var dir = t.TempDir()
+	var store, err = storage.NewSqliteStorage(storage.SqliteConfig{
+		Path:                   filepath.Join(dir, "test.db"),
+		VersionCollectionName:  "_version",
+		ArchiveCollectionName:  "_archive",
+		SnapshotCollectionName: "_snapshots",
+		ErrorCollectionName:    "_errors",
+		AlertCollectionName:    "_alerts",
+	})
+	assert.Equal(nil, err, "Did not open a database")
+	defer store.Close()
+
+	var day = int64(24 * 60 * 60 * 1000)
+	store.CreateSeries("valid")
+	store.AppendRecord(context.Background(), "valid", storage.Record{Timestamp: 100 * day, Value: "1", Version: 0})
+
+	// A broken file does not stop the maintenance of the others
+	var broken = filepath.Join(dir, "broken.ini")
+	os.WriteFile(broken, []byte("Url=https://example.com/\nBefore=<b>\n"), 0644)
+	var valid = filepath.Join(dir, "valid.ini")
+	os.WriteFile(valid, []byte("Url=https://example.com/\nBefore=<b>\nAfter=</b>\nResultType=number\nDownsampleIntervals=24h\n"), 0644)
+
+	err = runMaintenance(context.Background(), store, []string{broken, valid}, time.UnixMilli(101*day))
+	assert.Equal(nil, err, "Returned an error")
+	rollup, err := store.LastRollup("valid_24h")
+	assert.Equal(nil, err, "Did not return the rollup")
+	assert.Equal(storage.Rollup{Timestamp: 100 * day, Min: 1, Max: 1, Avg: 1, Last: 1, Count: 1}, *rollup, "Did not maintain the valid query")
+
+	// The rollup is not written into the series of another query
+	store.AppendRecord(context.Background(), "valid", storage.Record{Timestamp: 101 * day, Value: "2", Version: 0})
+	var colliding = filepath.Join(dir, "valid_24h.ini")
+	os.WriteFile(colliding, []byte("Url=https://example.com/\nBefore=<b>\nAfter=</b>\n"), 0644)
+	err = runMaintenance(context.Background(), store, []string{valid, colliding}, time.UnixMilli(102*day))
+	assert.Equal(nil, err, "Returned an error for a collision")
+	rollup, err = store.LastRollup("valid_24h")
+	assert.Equal(nil, err, "Did not return the rollup 2")
+	assert.Equal(100*day, rollup.Timestamp, "Wrote the rollup into another query")
+
+	// The shutdown does not wait for the maintenance
+	var ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	err = runMaintenance(ctx, store, []string{valid}, time.UnixMilli(102*day))
+	assert.Equal(context.Canceled, err, "Did not stop the cancelled maintenance")
+}
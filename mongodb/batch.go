@@ -0,0 +1,217 @@
+package mongodb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// Returned for the documents which were dropped from the batch because they can never be inserted
+var ErrRejected = errors.New("rejected by MongoDB")
+
+// Collects the documents written into any collection and inserts them with a single InsertMany per collection
+// once the collection has maxSize documents or when the interval passes
+type BatchWriter struct {
+	db       *MongoDB
+	maxSize  int
+	interval time.Duration
+	mutex    sync.Mutex
+	// Documents waiting for the next flush
+	pending map[string][]bson.D
+	// Documents which are being inserted right now
+	inFlight map[string][]bson.D
+	stop     chan any
+	done     chan any
+}
+
+func (m *MongoDB) NewBatchWriter(maxSize int, interval time.Duration) (result *BatchWriter, err error) {
+	if m.database == nil {
+		return nil, errors.New("database is nil")
+	}
+	if maxSize <= 0 || interval <= 0 {
+		return nil, errors.New("batch size and interval must be positive")
+	}
+
+	result = &BatchWriter{
+		db:       m,
+		maxSize:  maxSize,
+		interval: interval,
+		pending:  map[string][]bson.D{},
+		inFlight: map[string][]bson.D{},
+		stop:     make(chan any),
+		done:     make(chan any),
+	}
+	go result.flushLoop()
+	return result, nil
+}
+
+func (b *BatchWriter) flushLoop() {
+	defer close(b.done)
+
+	var ticker = time.NewTicker(b.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-ticker.C:
+			// The documents stay pending and are inserted again on the next tick
+			err := b.Flush()
+			if err != nil {
+				fmt.Printf("Failed to write a batch to MongoDB: %v\n", err)
+			}
+		}
+	}
+}
+
+// The documents are accepted without waiting for the insert. An error is returned only if the collection
+// already has a full batch which cannot be inserted, so that the caller can keep the document elsewhere.
+func (b *BatchWriter) Write(collection string, data bson.D) error {
+	// Assign the _id upfront so that retrying a partially inserted batch does not create duplicates
+	var document = data
+	if !hasId(data) {
+		document = append(bson.D{{Key: "_id", Value: bson.NewObjectID()}}, data...)
+	}
+
+	b.mutex.Lock()
+	var full = len(b.pending[collection]) >= b.maxSize
+	b.mutex.Unlock()
+
+	if full {
+		err := b.flushCollection(collection)
+		if errors.Is(err, ErrRejected) {
+			fmt.Printf("Failed to write a batch to MongoDB: %v\n", err)
+		} else if err != nil {
+			return err
+		}
+	}
+
+	b.mutex.Lock()
+	b.pending[collection] = append(b.pending[collection], document)
+	full = len(b.pending[collection]) >= b.maxSize
+	b.mutex.Unlock()
+
+	if full {
+		// Other errors are not critical here, the documents stay pending until the next flush
+		err := b.flushCollection(collection)
+		if errors.Is(err, ErrRejected) {
+			fmt.Printf("Failed to write a batch to MongoDB: %v\n", err)
+		}
+	}
+	return nil
+}
+
+func hasId(data bson.D) bool {
+	for _, element := range data {
+		if element.Key == "_id" {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the documents of the collection which are accepted but not yet confirmed to be inserted, oldest first
+func (b *BatchWriter) Pending(collection string) (result []bson.D) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	result = append(result, b.inFlight[collection]...)
+	result = append(result, b.pending[collection]...)
+	return
+}
+
+func (b *BatchWriter) flushCollection(collection string) error {
+	b.mutex.Lock()
+	// Only one insert per collection at a time to keep the order of the documents
+	if len(b.inFlight[collection]) > 0 || len(b.pending[collection]) == 0 {
+		b.mutex.Unlock()
+		return nil
+	}
+	var batch = b.pending[collection]
+	b.inFlight[collection] = batch
+	delete(b.pending, collection)
+	b.mutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	_, err := b.db.database.Collection(collection).InsertMany(ctx, batch, options.InsertMany().SetOrdered(false))
+	var failed, rejected = failedDocuments(batch, err)
+
+	b.mutex.Lock()
+	delete(b.inFlight, collection)
+	if len(failed) > 0 {
+		b.pending[collection] = append(failed, b.pending[collection]...)
+	}
+	b.mutex.Unlock()
+
+	if rejected > 0 {
+		return fmt.Errorf("%w: %v documents of %v: %w", ErrRejected, rejected, collection, err)
+	}
+	if len(failed) > 0 {
+		return err
+	}
+	return nil
+}
+
+// Returns the documents which have to be inserted again after a failed InsertMany
+// and the number of the documents which will never be inserted
+func failedDocuments(batch []bson.D, err error) (retry []bson.D, rejected int) {
+	if err == nil {
+		return nil, 0
+	}
+
+	var bulkErr mongo.BulkWriteException
+	if !errors.As(err, &bulkErr) {
+		// Nothing is known about the inserted documents, retrying the whole batch is safe thanks to the preassigned _id
+		if IsTransientError(err) {
+			return batch, 0
+		}
+		return nil, len(batch)
+	}
+	if bulkErr.WriteConcernError != nil && isTransientCode(func(code int) bool { return bulkErr.WriteConcernError.Code == code }) {
+		return batch, 0
+	}
+	for _, writeErr := range bulkErr.WriteErrors {
+		// Duplicates were inserted by an earlier attempt
+		if mongo.IsDuplicateKeyError(writeErr.WriteError) || writeErr.Index >= len(batch) {
+			continue
+		}
+		if isTransientCode(writeErr.WriteError.HasErrorCode) {
+			retry = append(retry, batch[writeErr.Index])
+		} else {
+			rejected++
+		}
+	}
+	return
+}
+
+func (b *BatchWriter) Flush() (err error) {
+	b.mutex.Lock()
+	var collections = []string{}
+	for collection := range b.pending {
+		collections = append(collections, collection)
+	}
+	b.mutex.Unlock()
+
+	for _, collection := range collections {
+		flushErr := b.flushCollection(collection)
+		if flushErr != nil {
+			err = flushErr
+		}
+	}
+	return
+}
+
+func (b *BatchWriter) Close() error {
+	close(b.stop)
+	<-b.done
+	return b.Flush()
+}
@@ -20,6 +20,35 @@ func BsonToRaw(value bson.D) (document bson.Raw, err error) {
 	return
 }
 
+// Server errors which may succeed on the next attempt, e.g. during an election or a shutdown
+var transientErrorCodes = []int{6, 7, 64, 89, 91, 189, 262, 9001, 10107, 11600, 11602, 13435, 13436}
+
+// Reports whether repeating the write may succeed: network failures, timeouts and retryable server errors.
+// Other server errors, e.g. a failed validation or a document which is too large, are permanent.
+func IsTransientError(err error) bool {
+	if mongo.IsNetworkError(err) || mongo.IsTimeout(err) || errors.Is(err, context.Canceled) {
+		return true
+	}
+	var serverErr mongo.ServerError
+	if !errors.As(err, &serverErr) {
+		// Errors of the driver, e.g. a disconnected client
+		return true
+	}
+	if serverErr.HasErrorLabel("RetryableWriteError") {
+		return true
+	}
+	return isTransientCode(serverErr.HasErrorCode)
+}
+
+func isTransientCode(hasCode func(int) bool) bool {
+	for _, code := range transientErrorCodes {
+		if hasCode(code) {
+			return true
+		}
+	}
+	return false
+}
+
 type MongoDB struct {
 	client   *mongo.Client
 	database *mongo.Database
@@ -59,7 +88,7 @@ func (m *MongoDB) Disconnect() error {
 	return nil
 }
 
-func (m *MongoDB) CreateCollection(collection string) (err error) {
+func (m *MongoDB) CreateCollection(collection string, indexes ...bson.D) (err error) {
 	if m.database == nil {
 		return errors.New("database is nil")
 	}
@@ -71,20 +100,86 @@ func (m *MongoDB) CreateCollection(collection string) (err error) {
 	if err != nil {
 		return err
 	}
-	if len(names) == 1 && names[0] == collection {
-		return
+	if len(names) != 1 || names[0] != collection {
+		err = m.database.CreateCollection(ctx, collection)
+		if err != nil {
+			return err
+		}
 	}
 
-	err = m.database.CreateCollection(ctx, collection)
+	// Creating an existing index is a no-op, so the indexes are ensured for the existing collections as well
+	if len(indexes) > 0 {
+		var models = []mongo.IndexModel{}
+		for _, keys := range indexes {
+			models = append(models, mongo.IndexModel{Keys: keys})
+		}
+		indexCtx, indexCancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer indexCancel()
+		_, err = m.database.Collection(collection).Indexes().CreateMany(indexCtx, models)
+	}
 	return err
 }
 
+func (m *MongoDB) GetCollectionType(collection string) (exists bool, collectionType string, err error) {
+	if m.database == nil {
+		return false, "", errors.New("database is nil")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	specifications, err := m.database.ListCollectionSpecifications(ctx, bson.D{{Key: "name", Value: collection}})
+	if err != nil || len(specifications) == 0 {
+		return false, "", err
+	}
+	return true, specifications[0].Type, nil
+}
+
+func (m *MongoDB) CreateTimeSeriesCollection(collection string, timeField string, metaField string, granularity string, expireAfterSeconds int64) (err error) {
+	exists, collectionType, err := m.GetCollectionType(collection)
+	if err != nil {
+		return err
+	}
+	if exists {
+		if collectionType != "timeseries" {
+			return errors.New("collection " + collection + " already exists and is not a time-series collection")
+		}
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	var opts = options.CreateCollection().SetTimeSeriesOptions(options.TimeSeries().SetTimeField(timeField).SetMetaField(metaField).SetGranularity(granularity))
+	if expireAfterSeconds > 0 {
+		opts.SetExpireAfterSeconds(expireAfterSeconds)
+	}
+	return m.database.CreateCollection(ctx, collection, opts)
+}
+
+func (m *MongoDB) RenameCollection(from string, to string) error {
+	if m.database == nil {
+		return errors.New("database is nil")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var databaseName = m.database.Name()
+	return m.client.Database("admin").RunCommand(ctx, bson.D{{Key: "renameCollection", Value: databaseName + "." + from}, {Key: "to", Value: databaseName + "." + to}}).Err()
+}
+
 func (m *MongoDB) Write(collection string, data bson.D) (err error) {
+	return m.WriteContext(context.Background(), collection, data)
+}
+
+// The timeout still applies, the parent context allows cancelling the write earlier
+func (m *MongoDB) WriteContext(parent context.Context, collection string, data bson.D) (err error) {
 	if m.database == nil {
 		return errors.New("database is nil")
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	ctx, cancel := context.WithTimeout(parent, 2*time.Second)
 	defer cancel()
 	mongoCollection := m.database.Collection(collection)
 
@@ -92,24 +187,47 @@ func (m *MongoDB) Write(collection string, data bson.D) (err error) {
 	return err
 }
 
+func (m *MongoDB) WriteMany(collection string, data []bson.D) (err error) {
+	if m.database == nil {
+		return errors.New("database is nil")
+	}
+	if len(data) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	mongoCollection := m.database.Collection(collection)
+
+	_, err = mongoCollection.InsertMany(ctx, data)
+	return err
+}
+
 func (m *MongoDB) GetLastDocumentFiltered(collection string, sortedKey string, filter bson.D) (result *mongo.SingleResult, err error) {
+	return m.GetLastDocumentFilteredContext(context.Background(), collection, sortedKey, filter)
+}
+
+func (m *MongoDB) GetLastDocumentFilteredContext(parent context.Context, collection string, sortedKey string, filter bson.D) (result *mongo.SingleResult, err error) {
 	if m.database == nil {
 		return result, errors.New("database is nil")
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	ctx, cancel := context.WithTimeout(parent, 30*time.Second)
 	defer cancel()
 
-	mongoCollection := m.database.Collection(collection)
-	count, err := mongoCollection.CountDocuments(ctx, filter)
-	if err != nil || count == 0 {
-		return result, err
+	// Documents with equal keys are ordered by insertion, since ObjectIDs are increasing
+	var sort = bson.D{{Key: sortedKey, Value: -1}}
+	if sortedKey != "_id" {
+		sort = append(sort, bson.E{Key: "_id", Value: -1})
 	}
-	opts := options.FindOne().SetSort(bson.D{{Key: sortedKey, Value: 1}}).SetSkip(count - 1)
 
-	result = mongoCollection.FindOne(ctx, filter, opts)
+	mongoCollection := m.database.Collection(collection)
+	result = mongoCollection.FindOne(ctx, filter, options.FindOne().SetSort(sort))
+	if errors.Is(result.Err(), mongo.ErrNoDocuments) {
+		return nil, nil
+	}
 	if result.Err() != nil {
-		return result, result.Err()
+		return nil, result.Err()
 	}
 
 	return
@@ -119,7 +237,36 @@ func (m *MongoDB) GetLastDocument(collection string, sortedKey string) (result *
 	return m.GetLastDocumentFiltered(collection, sortedKey, bson.D{})
 }
 
+func (m *MongoDB) GetFirstDocument(collection string, sortedKey string) (result *mongo.SingleResult, err error) {
+	if m.database == nil {
+		return result, errors.New("database is nil")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var sort = bson.D{{Key: sortedKey, Value: 1}}
+	if sortedKey != "_id" {
+		sort = append(sort, bson.E{Key: "_id", Value: 1})
+	}
+
+	mongoCollection := m.database.Collection(collection)
+	result = mongoCollection.FindOne(ctx, bson.D{}, options.FindOne().SetSort(sort))
+	if errors.Is(result.Err(), mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if result.Err() != nil {
+		return nil, result.Err()
+	}
+
+	return
+}
+
 func (m *MongoDB) GetAllDocuments(collection string) (result []bson.D, err error) {
+	return m.GetAllDocumentsFiltered(collection, "", bson.D{})
+}
+
+func (m *MongoDB) GetAllDocumentsFiltered(collection string, sortedKey string, filter bson.D) (result []bson.D, err error) {
 	if m.database == nil {
 		return result, errors.New("database is nil")
 	}
@@ -127,8 +274,13 @@ func (m *MongoDB) GetAllDocuments(collection string) (result []bson.D, err error
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
+	var opts = options.Find()
+	if sortedKey != "" {
+		opts.SetSort(bson.D{{Key: sortedKey, Value: 1}})
+	}
+
 	mongoCollection := m.database.Collection(collection)
-	cur, err := mongoCollection.Find(ctx, bson.D{})
+	cur, err := mongoCollection.Find(ctx, filter, opts)
 	if err != nil {
 		return result, err
 	}
@@ -149,6 +301,21 @@ func (m *MongoDB) GetAllDocuments(collection string) (result []bson.D, err error
 	return
 }
 
+func (m *MongoDB) DeleteMany(collection string, filter bson.D) (deleted int64, err error) {
+	if m.database == nil {
+		return 0, errors.New("database is nil")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	result, err := m.database.Collection(collection).DeleteMany(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	return result.DeletedCount, nil
+}
+
 func (m *MongoDB) DropCollection(collection string) (err error) {
 	if m.database == nil {
 		return errors.New("database is nil")
@@ -1,11 +1,16 @@
 package mongodb
 
 import (
+	"context"
+	"errors"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
 )
 
 func TestNewMongoDBValid(t *testing.T) {
@@ -71,6 +76,33 @@ func TestCreateCollection(t *testing.T) {
 	assert.NotEqual(nil, err, "Was able to use an initialized database")
 }
 
+func TestCreateCollectionIndexes(t *testing.T) {
+	var assert = assert.New(t)
+
+	var db, err = NewMongoDB("mongodb://0.0.0.0:27017", "test")
+	assert.Equal(nil, err, "Did not connect to a database")
+
+	err = db.DropCollection("indexed")
+	assert.Equal(nil, err, "Did not drop a collection")
+
+	err = db.CreateCollection("indexed", bson.D{{Key: "timestamp", Value: 1}}, bson.D{{Key: "value", Value: 1}, {Key: "version", Value: 1}})
+	assert.Equal(nil, err, "Did not create a collection with indexes")
+
+	// Indexes are ensured for the existing collections too
+	err = db.CreateCollection("indexed", bson.D{{Key: "timestamp", Value: 1}}, bson.D{{Key: "name", Value: 1}})
+	assert.Equal(nil, err, "Did not add an index to an existing collection")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	specifications, err := db.database.Collection("indexed").Indexes().ListSpecifications(ctx)
+	assert.Equal(nil, err, "Did not list the indexes")
+	var names = []string{}
+	for _, specification := range specifications {
+		names = append(names, specification.Name)
+	}
+	assert.ElementsMatch([]string{"_id_", "timestamp_1", "value_1_version_1", "name_1"}, names, "Incorrect indexes")
+}
+
 func TestWrite(t *testing.T) {
 	var assert = assert.New(t)
 
@@ -98,6 +130,23 @@ func TestWrite(t *testing.T) {
 	assert.NotEqual(nil, err, "Was able to use an initialized database")
 }
 
+func TestWriteContext(t *testing.T) {
+	var assert = assert.New(t)
+
+	var db, err = NewMongoDB("mongodb://0.0.0.0:27017", "test")
+	assert.Equal(nil, err, "Did not connect to a database")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	err = db.WriteContext(ctx, "a", bson.D{{Key: "hello", Value: "world"}})
+	assert.Equal(nil, err, "Did not write to a collection")
+
+	cancel()
+	err = db.WriteContext(ctx, "a", bson.D{{Key: "hello", Value: "world"}})
+	assert.True(errors.Is(err, context.Canceled), "Was able to write with a cancelled context")
+	_, err = db.GetLastDocumentFilteredContext(ctx, "a", "_id", bson.D{})
+	assert.True(errors.Is(err, context.Canceled), "Was able to read with a cancelled context")
+}
+
 func TestGetLastDocument(t *testing.T) {
 	var assert = assert.New(t)
 
@@ -183,6 +232,63 @@ func TestGetLastDocumentFiltered(t *testing.T) {
 	assert.Equal("c", rawDocument.Lookup("hello").StringValue(), "Incorrect document value 2")
 }
 
+// Creates a collection with the same indexes as the storage series
+func newBenchmarkCollection(b *testing.B) MongoDB {
+	var db, err = NewMongoDB("mongodb://0.0.0.0:27017", "test")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	err = db.DropCollection("benchmark")
+	if err != nil {
+		b.Fatal(err)
+	}
+	err = db.CreateCollection("benchmark",
+		bson.D{{Key: "timestamp", Value: 1}, {Key: "_id", Value: 1}},
+		bson.D{{Key: "value", Value: 1}, {Key: "version", Value: 1}, {Key: "timestamp", Value: 1}, {Key: "_id", Value: 1}})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	// Simulate a long-running query with a limited set of values
+	var documents = []any{}
+	for i := 0; i < 100000; i++ {
+		documents = append(documents, bson.D{{Key: "timestamp", Value: int64(i)}, {Key: "value", Value: strconv.Itoa(i % 1000)}, {Key: "version", Value: int64(0)}})
+	}
+	_, err = db.database.Collection("benchmark").InsertMany(context.Background(), documents)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return db
+}
+
+// Same as LastRecord
+func BenchmarkGetLastDocument(b *testing.B) {
+	var db = newBenchmarkCollection(b)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := db.GetLastDocumentFiltered("benchmark", "timestamp", bson.D{})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Same as FindByValue
+func BenchmarkGetLastDocumentFiltered(b *testing.B) {
+	var db = newBenchmarkCollection(b)
+	var err error
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err = db.GetLastDocumentFiltered("benchmark", "timestamp", bson.D{{Key: "value", Value: strconv.Itoa(i % 1000)}, {Key: "version", Value: int64(0)}})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
 func TestGetAllDocuments(t *testing.T) {
 	var assert = assert.New(t)
 
@@ -213,6 +319,59 @@ func TestGetAllDocuments(t *testing.T) {
 	assert.Equal("notok", rawDocument2.Lookup("filter").StringValue(), "Incorrect document value 2-2")
 }
 
+func TestGetAllDocumentsFiltered(t *testing.T) {
+	var assert = assert.New(t)
+
+	var db, err = NewMongoDB("mongodb://0.0.0.0:27017", "test")
+	assert.Equal(nil, err, "Did not connect to a database")
+
+	// Drop the test collection before validating
+	err = db.DropCollection("test")
+	assert.Equal(nil, err, "Did not drop a collection")
+
+	db.Write("test", bson.D{{Key: "filter", Value: "ok"}, {Key: "hello", Value: "c"}})
+	db.Write("test", bson.D{{Key: "filter", Value: "notok"}, {Key: "hello", Value: "b"}})
+	db.Write("test", bson.D{{Key: "filter", Value: "ok"}, {Key: "hello", Value: "a"}})
+
+	documents, err := db.GetAllDocumentsFiltered("test", "hello", bson.D{{Key: "filter", Value: "ok"}})
+	assert.Equal(nil, err, "Did not return documents")
+	assert.Equal(2, len(documents), "Incorrect documents count")
+	rawDocument1, err := BsonToRaw(documents[0])
+	assert.Equal(nil, err, "Failed to convert a document 1")
+	rawDocument2, err := BsonToRaw(documents[1])
+	assert.Equal(nil, err, "Failed to convert a document 2")
+	assert.Equal("a", rawDocument1.Lookup("hello").StringValue(), "Incorrect document order 1")
+	assert.Equal("c", rawDocument2.Lookup("hello").StringValue(), "Incorrect document order 2")
+
+	_, err = (&MongoDB{}).GetAllDocumentsFiltered("test", "hello", bson.D{})
+	assert.NotEqual(nil, err, "Was able to use an initialized database")
+}
+
+func TestDeleteMany(t *testing.T) {
+	var assert = assert.New(t)
+
+	var db, err = NewMongoDB("mongodb://0.0.0.0:27017", "test")
+	assert.Equal(nil, err, "Did not connect to a database")
+
+	err = db.DropCollection("test")
+	assert.Equal(nil, err, "Did not drop a collection")
+
+	db.Write("test", bson.D{{Key: "timestamp", Value: 1}})
+	db.Write("test", bson.D{{Key: "timestamp", Value: 2}})
+	db.Write("test", bson.D{{Key: "timestamp", Value: 3}})
+
+	deleted, err := db.DeleteMany("test", bson.D{{Key: "timestamp", Value: bson.D{{Key: "$lt", Value: 3}}}})
+	assert.Equal(nil, err, "Did not delete documents")
+	assert.Equal(int64(2), deleted, "Incorrect number of deleted documents")
+
+	documents, err := db.GetAllDocuments("test")
+	assert.Equal(nil, err, "Did not return documents")
+	assert.Equal(1, len(documents), "Incorrect number of remaining documents")
+
+	_, err = (&MongoDB{}).DeleteMany("test", bson.D{})
+	assert.NotEqual(nil, err, "Was able to use an initialized database")
+}
+
 func TestDropCollection(t *testing.T) {
 	var assert = assert.New(t)
 
@@ -231,3 +390,75 @@ func TestDropCollection(t *testing.T) {
 	err = (&MongoDB{}).DropCollection("a")
 	assert.NotEqual(nil, err, "Was able to use an initialized database")
 }
+
+func TestBatchWriter(t *testing.T) {
+	var assert = assert.New(t)
+
+	var db, err = NewMongoDB("mongodb://0.0.0.0:27017", "test")
+	assert.Equal(nil, err, "Did not connect to a database")
+
+	// Drop the test collection before validating
+	err = db.DropCollection("batch")
+	assert.Equal(nil, err, "Did not drop a collection")
+
+	batch, err := db.NewBatchWriter(3, time.Hour)
+	assert.Equal(nil, err, "Did not create a batch writer")
+
+	err = batch.Write("batch", bson.D{{Key: "hello", Value: "a"}})
+	assert.Equal(nil, err, "Did not write a document 1")
+	err = batch.Write("batch", bson.D{{Key: "hello", Value: "b"}})
+	assert.Equal(nil, err, "Did not write a document 2")
+	assert.Equal(2, len(batch.Pending("batch")), "Incorrect number of pending documents")
+
+	documents, err := db.GetAllDocuments("batch")
+	assert.Equal(nil, err, "Did not return documents 1")
+	assert.Equal(0, len(documents), "Documents were inserted before the batch was full")
+
+	// The third document fills the batch
+	err = batch.Write("batch", bson.D{{Key: "hello", Value: "c"}})
+	assert.Equal(nil, err, "Did not write a document 3")
+	assert.Equal(0, len(batch.Pending("batch")), "Pending documents were not flushed")
+	documents, err = db.GetAllDocuments("batch")
+	assert.Equal(nil, err, "Did not return documents 2")
+	assert.Equal(3, len(documents), "Incorrect number of inserted documents")
+
+	err = batch.Write("batch", bson.D{{Key: "hello", Value: "d"}})
+	assert.Equal(nil, err, "Did not write a document 4")
+	err = batch.Close()
+	assert.Equal(nil, err, "Did not flush the documents on close")
+	documents, err = db.GetAllDocuments("batch")
+	assert.Equal(nil, err, "Did not return documents 3")
+	assert.Equal(4, len(documents), "Pending documents were not inserted on close")
+
+	_, err = (&MongoDB{}).NewBatchWriter(3, time.Hour)
+	assert.NotEqual(nil, err, "Was able to use an initialized database")
+	_, err = db.NewBatchWriter(0, time.Hour)
+	assert.NotEqual(nil, err, "Was able to use an empty batch")
+}
+
+func TestFailedDocuments(t *testing.T) {
+	var assert = assert.New(t)
+
+	var batch = []bson.D{{{Key: "a", Value: 1}}, {{Key: "b", Value: 2}}, {{Key: "c", Value: 3}}}
+
+	retry, rejected := failedDocuments(batch, nil)
+	assert.Equal(0, len(retry)+rejected, "Returned failed documents without an error")
+	retry, rejected = failedDocuments(batch, errors.New("network"))
+	assert.Equal(batch, retry, "Did not retry the whole batch on a generic error")
+
+	// Only the transient errors are retried
+	var bulkErr = mongo.BulkWriteException{WriteErrors: []mongo.BulkWriteError{
+		{WriteError: mongo.WriteError{Index: 0, Code: 11000}},
+		{WriteError: mongo.WriteError{Index: 1, Code: 91}},
+		{WriteError: mongo.WriteError{Index: 2, Code: 121}},
+	}}
+	retry, rejected = failedDocuments(batch, bulkErr)
+	assert.Equal([]bson.D{batch[1]}, retry, "Did not skip the duplicates and the invalid documents")
+	assert.Equal(1, rejected, "Did not reject the invalid document")
+
+	retry, rejected = failedDocuments(batch, mongo.CommandError{Code: 10334})
+	assert.Equal(0, len(retry), "Retried a document which is too large")
+	assert.Equal(3, rejected, "Did not reject the batch")
+	retry, _ = failedDocuments(batch, mongo.BulkWriteException{WriteConcernError: &mongo.WriteConcernError{Code: 64}})
+	assert.Equal(batch, retry, "Did not retry a write concern timeout")
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"text/template"
+	"time"
+	"webtrack/storage"
+)
+
+// Change of the tracked value which is sent to the notification targets
+type valueChange struct {
+	Name    string
+	Version int64
+	Old     string
+	New     string
+	// Milliseconds since the Unix epoch
+	Timestamp int64
+}
+
+type notifier interface {
+	Notify(ctx context.Context, change valueChange) error
+}
+
+const defaultNotifyBody = `{"name": {{json .name}}, "version": {{.version}}, "old": {{json .old}}, "new": {{json .new}}, "timestamp": {{.timestamp}}}`
+
+var notifyFunctions = template.FuncMap{"json": func(value any) (string, error) {
+	encoded, err := json.Marshal(value)
+	return string(encoded), err
+}}
+
+func parseNotifyBody(body string) (*template.Template, error) {
+	if body == "" {
+		body = defaultNotifyBody
+	}
+	return template.New("NotifyWebhookBody").Funcs(notifyFunctions).Option("missingkey=error").Parse(body)
+}
+
+// Renders {{.name}}, {{.version}}, {{.old}}, {{.new}} and {{.timestamp}} in the body, the result must be valid JSON
+func renderNotifyBody(bodyTemplate *template.Template, change valueChange) ([]byte, error) {
+	var data = map[string]any{"name": change.Name, "version": change.Version, "old": change.Old, "new": change.New, "timestamp": change.Timestamp}
+	var result bytes.Buffer
+	var err = bodyTemplate.Execute(&result, data)
+	if err != nil {
+		return nil, err
+	}
+	if !json.Valid(result.Bytes()) {
+		return nil, errors.New("notification body is not valid JSON: " + result.String())
+	}
+	return result.Bytes(), nil
+}
+
+// Sends the changes as a templated JSON body, e.g. to Slack, Teams or any other HTTP endpoint
+type webhookNotifier struct {
+	url     string
+	method  string
+	body    *template.Template
+	retries int
+	// Doubled after every failed attempt
+	retryDelay time.Duration
+	client     *http.Client
+}
+
+// Returns nil if the query has no notifications
+func newNotifier(config QueryConfig) (notifier, error) {
+	if !config.NotifyOnChange {
+		return nil, nil
+	}
+	body, err := parseNotifyBody(config.NotifyWebhookBody)
+	if err != nil {
+		return nil, err
+	}
+	return &webhookNotifier{url: config.NotifyWebhookUrl, method: config.NotifyWebhookMethod, body: body, retries: config.NotifyRetries, retryDelay: time.Second, client: &http.Client{Timeout: 10 * time.Second}}, nil
+}
+
+// Other client errors will not succeed on the next attempt
+func retryNotification(err error) bool {
+	var status storage.WebhookStatusError
+	if !errors.As(err, &status) {
+		return true
+	}
+	return status.StatusCode >= 500 || status.StatusCode == http.StatusTooManyRequests
+}
+
+func (w *webhookNotifier) Notify(ctx context.Context, change valueChange) error {
+	body, err := renderNotifyBody(w.body, change)
+	if err != nil {
+		return err
+	}
+
+	var delay = w.retryDelay
+	for attempt := 0; ; attempt++ {
+		var err = storage.SendJson(ctx, w.client, w.method, w.url, body)
+		if err == nil || !retryNotification(err) || attempt >= w.retries {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// Number of the changes waiting for the notification before the new ones are dropped
+const notificationQueueSize = 100
+
+// Sends the notifications in order without delaying the requests of the tracker
+type notificationQueue struct {
+	changes chan valueChange
+	done    chan any
+}
+
+func startNotificationQueue(ctx context.Context, notifications notifier, onError func(error)) *notificationQueue {
+	var queue = &notificationQueue{changes: make(chan valueChange, notificationQueueSize), done: make(chan any)}
+	go func() {
+		defer close(queue.done)
+		for change := range queue.changes {
+			var err = notifications.Notify(ctx, change)
+			if err != nil && ctx.Err() == nil {
+				onError(err)
+			}
+		}
+	}()
+	return queue
+}
+
+// Returns an error if the queue is full
+func (q *notificationQueue) Push(change valueChange) error {
+	select {
+	case q.changes <- change:
+		return nil
+	default:
+		return errors.New("too many pending notifications, dropped the change of " + change.Name)
+	}
+}
+
+// Waits for the queued notifications, which fail immediately once the context is cancelled
+func (q *notificationQueue) Close() {
+	close(q.changes)
+	<-q.done
+}
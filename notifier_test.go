@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenderNotifyBody(t *testing.T) {
+	var assert = assert.New(t)
+
+	var change = valueChange{Name: "stackoverflow", Version: 2, Old: "How to \"exit\" vim?", New: "New question", Timestamp: 1500}
+	var body, err = parseNotifyBody("")
+	assert.Equal(nil, err, "Returned an error 1")
+	rendered, err := renderNotifyBody(body, change)
+	assert.Equal(nil, err, "Returned an error 2")
+	var decoded map[string]any
+	json.Unmarshal(rendered, &decoded)
+	assert.Equal(map[string]any{"name": "stackoverflow", "version": 2.0, "old": "How to \"exit\" vim?", "new": "New question", "timestamp": 1500.0}, decoded, "Incorrect default body")
+
+	body, err = parseNotifyBody(`{"text": {{json (printf "%v changed to %v" .name .new)}}}`)
+	assert.Equal(nil, err, "Returned an error 3")
+	rendered, err = renderNotifyBody(body, change)
+	assert.Equal(nil, err, "Returned an error 4")
+	assert.Equal(`{"text": "stackoverflow changed to New question"}`, string(rendered), "Incorrect custom body")
+
+	// The values must be escaped with json
+	body, err = parseNotifyBody(`{"text": "{{.old}}"}`)
+	assert.Equal(nil, err, "Returned an error 5")
+	_, err = renderNotifyBody(body, change)
+	assert.NotEqual(nil, err, "Did not return an error for an invalid JSON")
+
+	body, err = parseNotifyBody(`{"text": {{json .missing}}}`)
+	assert.Equal(nil, err, "Returned an error 6")
+	_, err = renderNotifyBody(body, change)
+	assert.NotEqual(nil, err, "Did not return an error for a missing value")
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	var assert = assert.New(t)
+
+	var requests = 0
+	var status = http.StatusOK
+	var failures = 0
+	var received string
+	var server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		body, _ := io.ReadAll(r.Body)
+		received = r.Method + " " + string(body)
+		if failures > 0 {
+			failures--
+			w.WriteHeader(status)
+		}
+	}))
+	defer server.Close()
+
+	var config = QueryConfig{Name: "test", NotifyOnChange: true, NotifyWebhookUrl: server.URL, NotifyWebhookMethod: "PUT", NotifyWebhookBody: `{"new": {{json .new}}}`, NotifyRetries: 2}
+	var notifier, err = newNotifier(config)
+	assert.Equal(nil, err, "Returned an error 1")
+	notifier.(*webhookNotifier).retryDelay = time.Millisecond
+
+	err = notifier.Notify(context.Background(), valueChange{Name: "test", New: "b"})
+	assert.Equal(nil, err, "Returned an error 2")
+	assert.Equal(`PUT {"new": "b"}`, received, "Incorrect request")
+
+	// The server errors are retried
+	requests, failures, status = 0, 2, http.StatusServiceUnavailable
+	err = notifier.Notify(context.Background(), valueChange{Name: "test", New: "c"})
+	assert.Equal(nil, err, "Did not retry the request")
+	assert.Equal(3, requests, "Incorrect number of attempts")
+
+	requests, failures = 0, 5
+	err = notifier.Notify(context.Background(), valueChange{Name: "test", New: "d"})
+	assert.NotEqual(nil, err, "Did not return an error after the retries")
+	assert.Equal(3, requests, "Did not respect NotifyRetries")
+
+	// The client errors are not
+	requests, failures, status = 0, 1, http.StatusBadRequest
+	err = notifier.Notify(context.Background(), valueChange{Name: "test", New: "e"})
+	assert.NotEqual(nil, err, "Did not return an error for a bad request")
+	assert.Equal(1, requests, "Retried a bad request")
+
+	config.NotifyOnChange = false
+	notifier, err = newNotifier(config)
+	assert.Equal(nil, err, "Returned an error 3")
+	assert.True(notifier == nil, "Created a notifier without NotifyOnChange")
+}
+
+func TestNotificationQueue(t *testing.T) {
+	var assert = assert.New(t)
+
+	var started = make(chan any, notificationQueueSize+2)
+	var release = make(chan any)
+	var received = 0
+	var server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- nil
+		<-release
+		received++
+	}))
+	defer server.Close()
+
+	var config = QueryConfig{Name: "test", NotifyOnChange: true, NotifyWebhookUrl: server.URL, NotifyWebhookMethod: "POST", NotifyWebhookBody: `{"new": {{json .new}}}`}
+	var notifier, err = newNotifier(config)
+	assert.Equal(nil, err, "Returned an error 1")
+	var failures = 0
+	var queue = startNotificationQueue(context.Background(), notifier, func(err error) { failures++ })
+
+	// A slow webhook does not block the tracker
+	assert.Equal(nil, queue.Push(valueChange{Name: "test", New: "a"}), "Returned an error 2")
+	<-started
+	for i := 0; i < notificationQueueSize; i++ {
+		assert.Equal(nil, queue.Push(valueChange{Name: "test", New: "b"}), "Dropped a change")
+	}
+	assert.NotEqual(nil, queue.Push(valueChange{Name: "test", New: "c"}), "Did not drop a change from a full queue")
+
+	close(release)
+	queue.Close()
+	assert.Equal(notificationQueueSize+1, received, "Did not send the queued notifications")
+	assert.Equal(0, failures, "Reported a failure")
+}
+
+func TestNotifyWebhookUrlDefault(t *testing.T) {
+	var assert = assert.New(t)
+
+	var config = QueryConfig{Source: "page", Before: "<b>", After: "</b>", ResultType: "string", RequestBackend: "go", RequestIntervalSeconds: 60, Timezone: "UTC", TimeSeriesGranularity: "seconds", MaxPages: 1,
+		NotifyOnChange: true, NotifyWebhookMethod: "POST", WebhookUrl: "http://example.com/hook"}
+	assert.Equal(nil, config.PostInit(), "Returned an error")
+	assert.Equal("http://example.com/hook", config.NotifyWebhookUrl, "Did not use WebhookUrl")
+
+	config.WebhookUrl, config.NotifyWebhookUrl = "", ""
+	assert.NotEqual(nil, config.PostInit(), "Did not require a webhook")
+}
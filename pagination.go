@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"html"
+	"net/url"
+	"strings"
+	"time"
+	"webtrack/webfetch"
+)
+
+// Separates the bodies of the pages in the combined response, so that the values can be extracted from every
+// page separately, including the archived responses
+const pageSeparator = "\n<!-- webtrack page break -->\n"
+
+func splitPages(config QueryConfig, body string) []string {
+	if config.NextPageExtractor == "" {
+		return []string{body}
+	}
+	return strings.Split(body, pageSeparator)
+}
+
+// Returns the size of the pages without the separators and the hash of the page hashes,
+// which is the same as the hash of the body for a single page
+func describePages(config QueryConfig, body string) (size int64, hash string) {
+	var pages = splitPages(config, body)
+	if len(pages) == 1 {
+		return int64(len(body)), GetStringHash(body)
+	}
+	var hashes []string
+	for _, page := range pages {
+		size += int64(len(page))
+		hashes = append(hashes, GetStringHash(page))
+	}
+	return size, GetStringHash(strings.Join(hashes, "\n"))
+}
+
+// Returns the address of the next page, or an empty string after the last page
+func nextPageUrl(config QueryConfig, pageUrl string, body string, fetchStart time.Time, values *urlValues) (string, error) {
+	switch config.NextPageExtractor {
+	case "page":
+		// The listing ends with the first page without matches
+		if _, err := ExtractValueFromString(body, config.Before, config.After, config.AnyTag); err != nil {
+			return "", nil
+		}
+		values.page++
+		return renderUrl(config, fetchStart, *values)
+	case "link", "cursor":
+		next, err := ExtractValueFromString(body, config.NextPageBefore, config.NextPageAfter, config.AnyTag)
+		next = strings.TrimSpace(next)
+		if err != nil || next == "" {
+			return "", nil
+		}
+		if config.NextPageExtractor == "cursor" {
+			values.cursor = next
+			return renderUrl(config, fetchStart, *values)
+		}
+
+		// Links are usually relative and HTML-escaped
+		base, err := url.Parse(pageUrl)
+		if err != nil {
+			return "", err
+		}
+		link, err := url.Parse(html.UnescapeString(next))
+		if err != nil {
+			return "", err
+		}
+		return base.ResolveReference(link).String(), nil
+	default:
+		return "", nil
+	}
+}
+
+// Requests the pages of the query until there is no next page or MaxPages is reached.
+// The bodies are combined into a single response with the highest status code of the pages.
+func fetchPages(ctx context.Context, scheduler *scheduler, config QueryConfig, pageUrl string, fetchStart time.Time, due time.Time, values urlValues) (result webfetch.Response, err error) {
+	var bodies []string
+	var visited = map[string]bool{}
+	for page := 1; ; page++ {
+		visited[pageUrl] = true
+		response, err := scheduler.Fetch(ctx, config, pageUrl, due)
+		if err != nil {
+			return result, err
+		}
+		bodies = append(bodies, response.Body)
+		// A failed page is more interesting than the successful ones
+		result.StatusCode = max(result.StatusCode, response.StatusCode)
+		result.Duration += response.Duration
+		result.Body = strings.Join(bodies, pageSeparator)
+
+		if page >= config.MaxPages {
+			return result, nil
+		}
+		pageUrl, err = nextPageUrl(config, pageUrl, response.Body, fetchStart, &values)
+		if err != nil {
+			return result, err
+		}
+		// Links pointing back to a visited page would repeat the same values
+		if pageUrl == "" || visited[pageUrl] {
+			return result, nil
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFetchPages(t *testing.T) {
+	var assert = assert.New(t)
+
+	// Three pages with two items each
+	var server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var page, _ = strconv.Atoi(r.URL.Query().Get("page"))
+		if cursor := r.URL.Query().Get("cursor"); cursor != "" {
+			page, _ = strconv.Atoi(cursor)
+		}
+		if page == 0 {
+			page = 1
+		}
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`<ul><li>0</li></ul>`))
+			return
+		}
+		if page > 3 {
+			w.Write([]byte("<ul></ul>"))
+			return
+		}
+		var body = fmt.Sprintf("<ul><li>%v</li><li>%v</li></ul>", 2*page-1, 2*page)
+		if page < 3 {
+			body += fmt.Sprintf(`<a rel="next" href="/list?page=%v&amp;sort=new">Next</a>{"cursor": "%v"}`, page+1, page+1)
+		}
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	var ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	var scheduler = newScheduler(1)
+	scheduler.Start(ctx, make(chan any))
+
+	var base = QueryConfig{Name: "test", Before: "<li>", After: "</li>", AnyTag: "*", ResultType: "string", RequestBackend: "go", Timezone: "UTC", MaxPages: 10}
+	var configs = map[string]QueryConfig{}
+	configs["link"] = func(c QueryConfig) QueryConfig {
+		c.Url, c.NextPageExtractor, c.NextPageBefore, c.NextPageAfter = server.URL+"/list", "link", `<a rel="next" href="`, `"`
+		return c
+	}(base)
+	configs["cursor"] = func(c QueryConfig) QueryConfig {
+		c.Url, c.NextPageExtractor, c.NextPageBefore, c.NextPageAfter = server.URL+"/list?cursor={{.cursor}}", "cursor", `"cursor": "`, `"`
+		return c
+	}(base)
+	configs["page"] = func(c QueryConfig) QueryConfig {
+		c.Url, c.NextPageExtractor = server.URL+"/list?page={{.page}}", "page"
+		return c
+	}(base)
+
+	for name, config := range configs {
+		var values = urlValues{page: 1}
+		var url, err = renderUrl(config, time.Now(), values)
+		assert.Equal(nil, err, "Returned an error for "+name)
+		response, err := fetchPages(ctx, scheduler, config, url, time.Now(), time.Now(), values)
+		assert.Equal(nil, err, "Returned an error for "+name)
+		value, err := extractValue(config, response.Body)
+		assert.Equal(nil, err, "Returned an error for "+name)
+		assert.Equal("1\n2\n3\n4\n5\n6", value, "Incorrect value for "+name)
+	}
+
+	// The highest status code of the pages is returned
+	var config = configs["page"]
+	response, err := fetchPages(ctx, scheduler, config, server.URL+"/missing", time.Now(), time.Now(), urlValues{page: 1})
+	assert.Equal(nil, err, "Returned an error for a missing page")
+	assert.Equal(http.StatusNotFound, response.StatusCode, "Did not return the failed status")
+
+	// The number of pages is limited
+	config = configs["link"]
+	config.MaxPages = 2
+	response, err = fetchPages(ctx, scheduler, config, config.Url, time.Now(), time.Now(), urlValues{page: 1})
+	assert.Equal(nil, err, "Returned an error")
+	value, err := extractValue(config, response.Body)
+	assert.Equal(nil, err, "Returned an error")
+	assert.Equal("1\n2\n3\n4", value, "MaxPages was not respected")
+}
+
+func TestExtractValuePages(t *testing.T) {
+	var assert = assert.New(t)
+
+	// A section must not start on one page and end on the next one
+	var config = QueryConfig{Before: "<li>", After: "</li>", AnyTag: "*", ResultType: "string", NextPageExtractor: "page"}
+	var value, err = extractValue(config, "<li>1</li><li>2"+pageSeparator+"3</li><li>4</li>")
+	assert.Equal(nil, err, "Returned an error")
+	assert.Equal("1\n4", value, "Extracted a value across the pages")
+
+	size, hash := describePages(config, "ab"+pageSeparator+"c")
+	assert.Equal(int64(3), size, "Counted the separators")
+	assert.NotEqual(GetStringHash("ab"+pageSeparator+"c"), hash, "Hashed the combined body")
+
+	size, hash = describePages(QueryConfig{}, "abc")
+	assert.Equal(int64(3), size, "Incorrect size of a single page")
+	assert.Equal(GetStringHash("abc"), hash, "Incorrect hash of a single page")
+}
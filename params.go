@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+	"webtrack/autoini"
+
+	"gopkg.in/ini.v1"
+)
+
+const paramsSection = "params"
+
+var urlFunctions = template.FuncMap{"env": os.Getenv}
+
+// Characters which are not allowed in the series names created from the parameter values
+var unsafeSeriesCharacters = regexp.MustCompile(`[^A-Za-z0-9-]+`)
+
+func parseUrlTemplate(url string) (*template.Template, error) {
+	return template.New("Url").Funcs(urlFunctions).Option("missingkey=error").Parse(url)
+}
+
+// Values of the URL template which change between the requests of a query
+type urlValues struct {
+	upstream string
+	page     int
+	cursor   string
+}
+
+// Replaces {{.date}}, {{.now}}, {{.param.<name>}}, {{.upstream}}, {{.page}}, {{.cursor}} and {{env "<name>"}} in the URL of the query
+func renderUrl(config QueryConfig, now time.Time, values urlValues) (string, error) {
+	urlTemplate, err := parseUrlTemplate(config.Url)
+	if err != nil {
+		return "", err
+	}
+	location, err := time.LoadLocation(config.Timezone)
+	if err != nil {
+		return "", err
+	}
+
+	now = now.In(location)
+	var data = map[string]any{"date": now.Format("2006-01-02"), "now": now, "param": config.Params}
+	// Only available to the queries which use them, so that using them elsewhere is reported as an error
+	if config.DependsOn != "" {
+		data["upstream"] = values.upstream
+	}
+	switch config.NextPageExtractor {
+	case "page":
+		data["page"] = values.page
+	case "cursor":
+		data["cursor"] = values.cursor
+	}
+	var result strings.Builder
+	err = urlTemplate.Execute(&result, data)
+	return result.String(), err
+}
+
+// Addresses within the error messages, e.g. Get "https://example.com/?key=secret": ...
+var urlPattern = regexp.MustCompile(`[A-Za-z][A-Za-z0-9+.-]*://[^\s"'<>]+`)
+
+// Names of the environment variables used by the URL template
+var envPattern = regexp.MustCompile(`\benv\s+"([^"]+)"`)
+
+// Hides the secrets of the addresses before they are printed or stored: the query strings, the user information,
+// the paths of the webhooks and the values of the environment variables used by the URL template
+func redactMessage(config QueryConfig, message string) string {
+	// Webhooks such as Slack and Teams carry the secret in the path
+	for _, webhook := range []string{config.WebhookUrl, config.NotifyWebhookUrl} {
+		parsed, err := url.Parse(webhook)
+		if webhook == "" || err != nil {
+			continue
+		}
+		message = strings.ReplaceAll(message, webhook, parsed.Scheme+"://"+parsed.Host+"/REDACTED")
+		if len(parsed.EscapedPath()) > 1 {
+			message = strings.ReplaceAll(message, parsed.EscapedPath(), "/REDACTED")
+		}
+	}
+	message = urlPattern.ReplaceAllStringFunc(message, func(address string) string {
+		parsed, err := url.Parse(address)
+		if err != nil {
+			return "REDACTED"
+		}
+		parsed.User = nil
+		if parsed.RawQuery != "" {
+			parsed.RawQuery = "REDACTED"
+		}
+		parsed.Fragment = ""
+		return parsed.String()
+	})
+	for _, match := range envPattern.FindAllStringSubmatch(config.Url, -1) {
+		var value = os.Getenv(match[1])
+		if value == "" {
+			continue
+		}
+		message = strings.ReplaceAll(message, value, "REDACTED")
+		message = strings.ReplaceAll(message, url.PathEscape(value), "REDACTED")
+		message = strings.ReplaceAll(message, url.QueryEscape(value), "REDACTED")
+	}
+	return message
+}
+
+// Keeps the original error available to errors.As and errors.Is
+type redactedError struct {
+	err     error
+	message string
+}
+
+func (e redactedError) Error() string {
+	return e.message
+}
+
+func (e redactedError) Unwrap() error {
+	return e.err
+}
+
+func redactError(config QueryConfig, err error) error {
+	if err == nil {
+		return nil
+	}
+	return redactedError{err: err, message: redactMessage(config, err.Error())}
+}
+
+// Returns every combination of the parameter values, the parameters keep the order of the file
+func readQueryParams(configPath string) (result []map[string]string, names []string, err error) {
+	file, err := ini.Load(configPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !file.HasSection(paramsSection) {
+		return nil, nil, nil
+	}
+
+	result = []map[string]string{{}}
+	for _, key := range file.Section(paramsSection).Keys() {
+		var values = key.Strings(",")
+		if len(values) == 0 {
+			return nil, nil, errors.New("parameter " + key.Name() + " has no values")
+		}
+		names = append(names, key.Name())
+
+		var combined []map[string]string
+		for _, params := range result {
+			for _, value := range values {
+				var extended = map[string]string{key.Name(): value}
+				for name, existing := range params {
+					extended[name] = existing
+				}
+				combined = append(combined, extended)
+			}
+		}
+		result = combined
+	}
+	return
+}
+
+// Reads the query file, every combination of the values in its [params] section becomes a separate series
+// named after the file and the values, e.g. weather_london_c
+func ReadQueries(configPath string) (result []QueryConfig, err error) {
+	config, err := autoini.ReadIni[QueryConfig](configPath)
+	if err != nil {
+		return nil, err
+	}
+	config.Name = GetFileNameWithoutExtension(configPath)
+
+	combinations, names, err := readQueryParams(configPath)
+	if err != nil {
+		return nil, err
+	}
+	if combinations == nil {
+		combinations = []map[string]string{nil}
+	}
+
+	var seriesNames = map[string]bool{}
+	for _, params := range combinations {
+		var expanded = config
+		expanded.Params = params
+		for _, name := range names {
+			expanded.Name += "_" + strings.Trim(unsafeSeriesCharacters.ReplaceAllString(params[name], "_"), "_")
+		}
+		if seriesNames[expanded.Name] {
+			return nil, errors.New("parameter values produce the series name " + expanded.Name + " more than once")
+		}
+		seriesNames[expanded.Name] = true
+		if expanded.DependsOn == expanded.Name {
+			return nil, errors.New("query " + expanded.Name + " can not depend on itself")
+		}
+
+		// Fail early on the parameters missing from the [params] section
+		_, err = renderUrl(expanded, time.Now(), urlValues{page: 1})
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, expanded)
+	}
+	return
+}
@@ -10,10 +10,11 @@ import (
 func findIndex(data string, parts []string, moveIndexToTheEnd bool) (idx int) {
 	idx = 0
 	for _, part := range parts {
-		idx = idx + strings.Index(data[idx:], part)
-		if idx < 0 {
-			return
+		var found = strings.Index(data[idx:], part)
+		if found < 0 {
+			return -1
 		}
+		idx = idx + found
 	}
 	if moveIndexToTheEnd {
 		return idx + len(parts[len(parts)-1])
@@ -21,18 +22,40 @@ func findIndex(data string, parts []string, moveIndexToTheEnd bool) (idx int) {
 	return idx
 }
 
-func ExtractValueFromString(data string, before string, after string, anyTag string) (string, error) {
+// Returns the value and the index right after it
+func findValue(data string, before string, after string, anyTag string) (string, int, error) {
 	var beforeArray = strings.Split(before, anyTag)
 	var afterArray = strings.Split(after, anyTag)
 	var begin = findIndex(data, beforeArray, true)
 	if begin < 0 {
-		return "", errors.New("beginning not found")
+		return "", 0, errors.New("beginning not found")
 	}
 	var end = findIndex(data[begin:], afterArray, false)
 	if end < 0 {
-		return "", errors.New("ending not found")
+		return "", 0, errors.New("ending not found")
+	}
+	return data[begin:(begin + end)], begin + end, nil
+}
+
+func ExtractValueFromString(data string, before string, after string, anyTag string) (string, error) {
+	value, _, err := findValue(data, before, after, anyTag)
+	return value, err
+}
+
+// Returns all non-overlapping values in the order of their appearance
+func ExtractAllValuesFromString(data string, before string, after string, anyTag string) (result []string) {
+	for {
+		value, end, err := findValue(data, before, after, anyTag)
+		if err != nil {
+			return
+		}
+		result = append(result, value)
+		if end >= len(data) {
+			return
+		}
+		// Empty Before and After must not match at the same position forever
+		data = data[max(end, 1):]
 	}
-	return data[begin:(begin + end)], nil
 }
 
 func ToNumber(data string) (float64, error) {
@@ -39,3 +39,25 @@ func TestToNumberInvalid(t *testing.T) {
 	_, err = ToNumber("1..2")
 	assert.NotEqual(nil, err, "Did not return an error 2")
 }
+
+func TestExtractValueFromString(t *testing.T) {
+	var assert = assert.New(t)
+
+	var value, err = ExtractValueFromString("<a><b>1</b></a>", "<a>*<b>", "</b>", "*")
+	assert.Equal(nil, err, "Returned an error")
+	assert.Equal("1", value, "Incorrect value")
+
+	// Every part of Before must be present
+	_, err = ExtractValueFromString("<b>1</b>", "<b>*<c>", "</b>", "*")
+	assert.NotEqual(nil, err, "Did not return an error for a missing part")
+}
+
+func TestExtractAllValuesFromString(t *testing.T) {
+	var assert = assert.New(t)
+
+	assert.Equal([]string{"1", "2", "3"}, ExtractAllValuesFromString("<li>1</li><li>2</li><li>3</li>", "<li>", "</li>", "*"), "Incorrect values 1")
+	assert.Equal([]string{"a", "b"}, ExtractAllValuesFromString(`<li class="x">a</li><li class="y">b</li>`, "<li*>", "</li>", "*"), "Incorrect values 2")
+	assert.Equal([]string(nil), ExtractAllValuesFromString("<p>1</p>", "<li>", "</li>", "*"), "Incorrect values 3")
+	// Must not loop forever
+	assert.NotEqual(0, len(ExtractAllValuesFromString("abc", "", "", "*")), "Empty Before and After were not handled")
+}
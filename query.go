@@ -2,20 +2,56 @@ package main
 
 import (
 	"errors"
+	"regexp"
+	"slices"
+	"time"
 )
 
 type QueryConfig struct {
-	Name                   string // Internal only
-	Version                int64  // Internal only
-	Url                    string
-	AnyTag                 string
-	Before                 string
-	After                  string
-	ResultType             string
-	RequestBackend         string
-	RequestIntervalSeconds int
-	OnlyIfDifferent        bool
-	OnlyIfUnique           bool
+	Name                         string            // Internal only
+	Version                      int64             // Internal only
+	Params                       map[string]string `ini:"-"` // Internal only
+	Url                          string
+	Source                       string
+	DependsOn                    string
+	SitemapPattern               string
+	SitemapMaxUrls               int
+	NextPageExtractor            string
+	NextPageBefore               string
+	NextPageAfter                string
+	MaxPages                     int
+	AnyTag                       string
+	Before                       string
+	After                        string
+	ResultType                   string
+	RequestBackend               string
+	RequestIntervalSeconds       int
+	Schedule                     string
+	Timezone                     string
+	ActiveWindows                []string
+	JitterPercent                int
+	StartupStaggerSeconds        int
+	AdaptiveInterval             bool
+	MinIntervalSeconds           int
+	MaxIntervalSeconds           int
+	Priority                     int
+	OnlyIfDifferent              bool
+	OnlyIfUnique                 bool
+	Alerts                       []string
+	NotifyOnChange               bool
+	NotifyWebhookUrl             string
+	NotifyWebhookMethod          string
+	NotifyWebhookBody            string
+	NotifyRetries                int
+	ArchiveResponses             bool
+	Sinks                        []string
+	WebhookUrl                   string
+	TimeSeries                   bool
+	TimeSeriesGranularity        string
+	TimeSeriesExpireAfterSeconds int
+	RetentionDays                int
+	DownsampleIntervals          []string
+	DownsampleRetentionDays      int
 }
 
 func (q QueryConfig) Optional(key string) bool {
@@ -26,22 +62,86 @@ func (q QueryConfig) Optional(key string) bool {
 		return true
 	case "Url":
 		return false
+	case "Source":
+		return true
+	case "DependsOn":
+		return true
+	case "SitemapPattern":
+		return true
+	case "SitemapMaxUrls":
+		return true
+	case "NextPageExtractor":
+		return true
+	case "NextPageBefore":
+		return true
+	case "NextPageAfter":
+		return true
+	case "MaxPages":
+		return true
 	case "AnyTag":
 		return true
 	case "Before":
-		return false
+		return true
 	case "After":
-		return false
+		return true
 	case "ResultType":
 		return true
 	case "RequestBackend":
 		return true
 	case "RequestIntervalSeconds":
 		return true
+	case "Schedule":
+		return true
+	case "Timezone":
+		return true
+	case "ActiveWindows":
+		return true
+	case "JitterPercent":
+		return true
+	case "StartupStaggerSeconds":
+		return true
+	case "AdaptiveInterval":
+		return true
+	case "MinIntervalSeconds":
+		return true
+	case "MaxIntervalSeconds":
+		return true
+	case "Priority":
+		return true
 	case "OnlyIfDifferent":
 		return true
 	case "OnlyIfUnique":
 		return true
+	case "Alerts":
+		return true
+	case "NotifyOnChange":
+		return true
+	case "NotifyWebhookUrl":
+		return true
+	case "NotifyWebhookMethod":
+		return true
+	case "NotifyWebhookBody":
+		return true
+	case "NotifyRetries":
+		return true
+	case "ArchiveResponses":
+		return true
+	case "Sinks":
+		return true
+	case "WebhookUrl":
+		return true
+	case "TimeSeries":
+		return true
+	case "TimeSeriesGranularity":
+		return true
+	case "TimeSeriesExpireAfterSeconds":
+		return true
+	case "RetentionDays":
+		return true
+	case "DownsampleIntervals":
+		return true
+	case "DownsampleRetentionDays":
+		return true
 	default:
 		return false
 	}
@@ -49,12 +149,20 @@ func (q QueryConfig) Optional(key string) bool {
 
 func (q QueryConfig) DefaultString(key string) string {
 	switch key {
+	case "Source":
+		return "page"
 	case "AnyTag":
 		return "<any>"
 	case "ResultType":
 		return "string"
 	case "RequestBackend":
 		return "go"
+	case "TimeSeriesGranularity":
+		return "seconds"
+	case "Timezone":
+		return "Local"
+	case "NotifyWebhookMethod":
+		return "POST"
 	default:
 		return ""
 	}
@@ -64,6 +172,17 @@ func (q QueryConfig) DefaultInt(key string) int {
 	switch key {
 	case "RequestIntervalSeconds":
 		return 1
+	case "MaxPages":
+		return 10
+	case "SitemapMaxUrls":
+		return 1000
+	case "NotifyRetries":
+		return 3
+	// The global values are used by default
+	case "JitterPercent":
+		return -1
+	case "StartupStaggerSeconds":
+		return -1
 	default:
 		return 0
 	}
@@ -73,12 +192,166 @@ func (q QueryConfig) DefaultBool(key string) bool {
 	return false
 }
 
+func (q QueryConfig) DefaultStringSlice(key string) []string {
+	// Empty sinks list means that the global default sinks are used, empty windows mean that the query is always active, empty alerts mean no alerts
+	return []string{}
+}
+
 func (q *QueryConfig) PostInit() (err error) {
+	switch q.Source {
+	case "page":
+		if q.Before == "" || q.After == "" {
+			return errors.New("Before and After are required by the page source")
+		}
+	case "feed":
+		if q.ResultType != "string" || q.NextPageExtractor != "" || q.OnlyIfDifferent {
+			return errors.New("feed source can not be used with ResultType, NextPageExtractor and OnlyIfDifferent")
+		}
+	case "sitemap":
+		if q.Before == "" || q.After == "" {
+			return errors.New("Before and After are required by the sitemap source")
+		}
+		if q.NextPageExtractor != "" || q.OnlyIfUnique || q.ArchiveResponses {
+			return errors.New("sitemap source can not be used with NextPageExtractor, OnlyIfUnique and ArchiveResponses")
+		}
+		_, err = regexp.Compile(q.SitemapPattern)
+		if err != nil {
+			return err
+		}
+		if q.SitemapMaxUrls <= 0 {
+			return errors.New("SitemapMaxUrls must be positive")
+		}
+	default:
+		return errors.New("Invalid source " + q.Source + ". Only \"page\", \"feed\" and \"sitemap\" sources are supported")
+	}
 	if q.ResultType != "string" && q.ResultType != "number" {
 		return errors.New("Invalid result type " + q.ResultType + ". Only \"string\" and \"number\" result types are supported")
 	}
 	if q.RequestBackend != "chrome" && q.RequestBackend != "go" {
 		return errors.New("Invalid request backend " + q.RequestBackend + ". Only \"chrome\" and \"go\" request backends are supported")
 	}
+	_, err = parseUrlTemplate(q.Url)
+	if err != nil {
+		return err
+	}
+	switch q.NextPageExtractor {
+	case "":
+		// Only a single page is requested
+	case "page":
+		// The page number is only used in the URL
+	case "link", "cursor":
+		if q.NextPageBefore == "" || q.NextPageAfter == "" {
+			return errors.New("NextPageBefore and NextPageAfter are required by the " + q.NextPageExtractor + " next page extractor")
+		}
+	default:
+		return errors.New("Invalid next page extractor " + q.NextPageExtractor + ". Only \"link\", \"cursor\" and \"page\" next page extractors are supported")
+	}
+	if q.NextPageExtractor != "" && q.ResultType != "string" {
+		return errors.New("NextPageExtractor can only be used with the \"string\" result type")
+	}
+	if q.MaxPages <= 0 {
+		return errors.New("MaxPages must be positive")
+	}
+	if q.RequestIntervalSeconds <= 0 {
+		return errors.New("RequestIntervalSeconds must be positive")
+	}
+	if q.JitterPercent < -1 || q.JitterPercent > 100 {
+		return errors.New("JitterPercent must be between 0 and 100, or -1 to use the global value")
+	}
+	if q.StartupStaggerSeconds < -1 {
+		return errors.New("StartupStaggerSeconds must not be negative, except -1 to use the global value")
+	}
+	if q.AdaptiveInterval {
+		if !q.OnlyIfDifferent && q.Source != "feed" {
+			return errors.New("AdaptiveInterval can only be used with OnlyIfDifferent or the feed source")
+		}
+		if q.Schedule != "" {
+			return errors.New("AdaptiveInterval can not be used with Schedule")
+		}
+		// The request interval is used as the lower bound by default
+		if q.MinIntervalSeconds == 0 {
+			q.MinIntervalSeconds = q.RequestIntervalSeconds
+		}
+		if q.MinIntervalSeconds < 0 || q.MinIntervalSeconds > q.RequestIntervalSeconds {
+			return errors.New("MinIntervalSeconds must be positive and not greater than RequestIntervalSeconds")
+		}
+		if q.MaxIntervalSeconds < q.RequestIntervalSeconds {
+			return errors.New("MaxIntervalSeconds is required by AdaptiveInterval and must not be less than RequestIntervalSeconds")
+		}
+	}
+	_, err = newQuerySchedule(*q)
+	if err != nil {
+		return err
+	}
+	if len(q.Alerts) > 0 && (q.ResultType != "number" || q.Source != "page") {
+		return errors.New("Alerts can only be used with the \"number\" result type and the page source")
+	}
+	_, err = parseAlertRules(q.Alerts)
+	if err != nil {
+		return err
+	}
+	if q.NotifyOnChange {
+		// A single webhook can receive both the values and the notifications
+		if q.NotifyWebhookUrl == "" {
+			q.NotifyWebhookUrl = q.WebhookUrl
+		}
+		if q.NotifyWebhookUrl == "" || q.Source != "page" {
+			return errors.New("NotifyOnChange requires NotifyWebhookUrl or WebhookUrl and can only be used with the page source")
+		}
+		if q.NotifyWebhookMethod != "POST" && q.NotifyWebhookMethod != "PUT" {
+			return errors.New("Invalid notification webhook method " + q.NotifyWebhookMethod + ". Only \"POST\" and \"PUT\" methods are supported")
+		}
+		if q.NotifyRetries < 0 {
+			return errors.New("NotifyRetries must not be negative")
+		}
+		// Render an example to report the invalid bodies on start
+		body, err := parseNotifyBody(q.NotifyWebhookBody)
+		if err != nil {
+			return err
+		}
+		_, err = renderNotifyBody(body, valueChange{Name: q.Name, Old: "old", New: "new"})
+		if err != nil {
+			return err
+		}
+	}
+	if q.TimeSeries && q.ResultType != "number" {
+		return errors.New("TimeSeries can only be used with the \"number\" result type")
+	}
+	if q.TimeSeriesGranularity != "seconds" && q.TimeSeriesGranularity != "minutes" && q.TimeSeriesGranularity != "hours" {
+		return errors.New("Invalid time-series granularity " + q.TimeSeriesGranularity + ". Only \"seconds\", \"minutes\" and \"hours\" are supported")
+	}
+	if q.TimeSeriesExpireAfterSeconds < 0 {
+		return errors.New("TimeSeriesExpireAfterSeconds must not be negative")
+	}
+	if q.RetentionDays < 0 || q.DownsampleRetentionDays < 0 {
+		return errors.New("RetentionDays and DownsampleRetentionDays must not be negative")
+	}
+	if len(q.DownsampleIntervals) > 0 && q.ResultType != "number" {
+		return errors.New("DownsampleIntervals can only be used with the \"number\" result type")
+	}
+	for _, interval := range q.DownsampleIntervals {
+		duration, err := time.ParseDuration(interval)
+		if err != nil {
+			return err
+		}
+		if duration < time.Minute || duration%time.Minute != 0 {
+			return errors.New("Invalid downsample interval " + interval + ". Must be a whole number of minutes")
+		}
+	}
+	for i, sink := range q.Sinks {
+		if slices.Contains(q.Sinks[:i], sink) {
+			return errors.New("sink " + sink + " is used more than once")
+		}
+		switch sink {
+		case "storage", "mongodb", "sqlite", "csv", "jsonl":
+			// Backend configuration is validated when the sink is created
+		case "webhook":
+			if q.WebhookUrl == "" {
+				return errors.New("WebhookUrl is required by the webhook sink")
+			}
+		default:
+			return errors.New("Invalid sink " + sink + ". Only \"storage\", \"mongodb\", \"sqlite\", \"csv\", \"jsonl\" and \"webhook\" sinks are supported")
+		}
+	}
 	return
 }
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"errors"
+	"math/rand/v2"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+var weekdayNames = []string{"SUN", "MON", "TUE", "WED", "THU", "FRI", "SAT"}
+
+var cronParser = cron.NewParser(cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
+
+// Limits the search for a cron time which is inside of the active windows
+const maxScheduleIterations = 100000
+
+// Daily period when the query is allowed to run, crosses midnight if end is before start
+type activeWindow struct {
+	days  [7]bool
+	start time.Duration
+	end   time.Duration
+}
+
+type querySchedule struct {
+	interval time.Duration
+	// Bounds of the interval which is adjusted to the rate of changes, both are zero if the interval is fixed
+	minInterval time.Duration
+	maxInterval time.Duration
+	// Fraction of the interval by which every delay is randomly shortened or extended
+	jitter float64
+	// Maximum random delay of the first run
+	stagger time.Duration
+	// Replaces the interval if set
+	cron     cron.Schedule
+	windows  []activeWindow
+	location *time.Location
+	// Returns a number in [0, 1)
+	random func() float64
+}
+
+func parseWeekday(name string) (int, error) {
+	for i, weekday := range weekdayNames {
+		if strings.EqualFold(name, weekday) {
+			return i, nil
+		}
+	}
+	return 0, errors.New("Invalid weekday " + name + ". Only \"MON\", \"TUE\", \"WED\", \"THU\", \"FRI\", \"SAT\" and \"SUN\" are supported")
+}
+
+func parseTimeOfDay(value string) (time.Duration, error) {
+	parsed, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, errors.New("Invalid time " + value + ". Must be in the HH:MM format")
+	}
+	return time.Duration(parsed.Hour())*time.Hour + time.Duration(parsed.Minute())*time.Minute, nil
+}
+
+// Parses windows like "09:00-17:00", "MON-FRI 09:30-16:00" or "SAT 22:00-02:00"
+func parseActiveWindow(value string) (window activeWindow, err error) {
+	var fields = strings.Fields(value)
+	if len(fields) == 0 || len(fields) > 2 {
+		return window, errors.New("Invalid active window " + value + ". Must be in the \"[days] HH:MM-HH:MM\" format")
+	}
+
+	if len(fields) == 1 {
+		window.days = [7]bool{true, true, true, true, true, true, true}
+	} else {
+		// Lists of days are not supported since the windows themselves are separated by commas
+		var first, last, isRange = strings.Cut(fields[0], "-")
+		from, err := parseWeekday(first)
+		if err != nil {
+			return window, err
+		}
+		var to = from
+		if isRange {
+			to, err = parseWeekday(last)
+			if err != nil {
+				return window, err
+			}
+		}
+		// Ranges like FRI-MON wrap around the week
+		for day := from; ; day = (day + 1) % 7 {
+			window.days[day] = true
+			if day == to {
+				break
+			}
+		}
+	}
+
+	var start, end, found = strings.Cut(fields[len(fields)-1], "-")
+	if !found {
+		return window, errors.New("Invalid active window " + value + ". Must be in the \"[days] HH:MM-HH:MM\" format")
+	}
+	window.start, err = parseTimeOfDay(start)
+	if err != nil {
+		return
+	}
+	window.end, err = parseTimeOfDay(end)
+	if err != nil {
+		return
+	}
+	if window.start == window.end {
+		return window, errors.New("Invalid active window " + value + ". Start and end must be different")
+	}
+	return
+}
+
+func newQuerySchedule(config QueryConfig) (result *querySchedule, err error) {
+	result = &querySchedule{interval: time.Duration(config.RequestIntervalSeconds) * time.Second, random: rand.Float64}
+	// Negative values are replaced by the global ones before the tracker starts
+	result.jitter = float64(max(config.JitterPercent, 0)) / 100
+	result.stagger = min(time.Duration(max(config.StartupStaggerSeconds, 0))*time.Second, result.interval)
+	if config.AdaptiveInterval {
+		result.minInterval = time.Duration(config.MinIntervalSeconds) * time.Second
+		result.maxInterval = time.Duration(config.MaxIntervalSeconds) * time.Second
+	}
+	result.location, err = time.LoadLocation(config.Timezone)
+	if err != nil {
+		return nil, err
+	}
+	if config.Schedule != "" {
+		result.cron, err = cronParser.Parse(config.Schedule)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, value := range config.ActiveWindows {
+		window, err := parseActiveWindow(value)
+		if err != nil {
+			return nil, err
+		}
+		result.windows = append(result.windows, window)
+	}
+	return
+}
+
+// Uses the wall clock time, so the windows are not shifted by DST changes
+func atTimeOfDay(day time.Time, offset time.Duration) time.Time {
+	return time.Date(day.Year(), day.Month(), day.Day(), int(offset/time.Hour), int(offset%time.Hour/time.Minute), 0, 0, day.Location())
+}
+
+func (s *querySchedule) isActive(t time.Time) bool {
+	if len(s.windows) == 0 {
+		return true
+	}
+
+	t = t.In(s.location)
+	var today = atTimeOfDay(t, 0)
+	var yesterday = today.AddDate(0, 0, -1)
+	for _, window := range s.windows {
+		var start = atTimeOfDay(today, window.start)
+		var end = atTimeOfDay(today, window.end)
+		if window.end < window.start {
+			end = end.AddDate(0, 0, 1)
+			// The window of the previous day may still be open
+			if window.days[yesterday.Weekday()] && t.Before(atTimeOfDay(today, window.end)) {
+				return true
+			}
+		}
+		if window.days[today.Weekday()] && !t.Before(start) && t.Before(end) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the first moment at or after t inside of the active windows
+func (s *querySchedule) nextActive(t time.Time) time.Time {
+	if s.isActive(t) {
+		return t
+	}
+
+	var result time.Time
+	var today = atTimeOfDay(t.In(s.location), 0)
+	for _, window := range s.windows {
+		for i := 0; i <= 7; i++ {
+			var day = today.AddDate(0, 0, i)
+			var start = atTimeOfDay(day, window.start)
+			if window.days[day.Weekday()] && start.After(t) {
+				if result.IsZero() || start.Before(result) {
+					result = start
+				}
+				break
+			}
+		}
+	}
+	return result
+}
+
+// Adjusts the adaptive interval after a value was extracted: doubles it while the value stays the same
+// and returns to the minimum after a change
+func (s *querySchedule) Observe(changed bool) {
+	if s.maxInterval == 0 {
+		return
+	}
+	if changed {
+		s.interval = s.minInterval
+	} else {
+		s.interval = min(s.interval*2, s.maxInterval)
+	}
+}
+
+// Returns the first time at or after now when the query is due
+func (s *querySchedule) First(now time.Time) time.Time {
+	if s.cron != nil {
+		return s.nextCron(now)
+	}
+	// Spread out the trackers which start at the same time
+	return s.nextActive(now.Add(time.Duration(s.random() * float64(s.stagger))))
+}
+
+// Returns the next time the query is due after a fetch which started at the given time.
+// The zero time means that the query will never run again.
+func (s *querySchedule) Next(fetchStart time.Time, now time.Time) time.Time {
+	if s.cron != nil {
+		return s.nextCron(now)
+	}
+	// Time delays properly by taking into account the request time itself
+	var interval = s.interval
+	if s.jitter > 0 {
+		// Trackers with identical intervals do not stay synchronized
+		interval += time.Duration((2*s.random() - 1) * s.jitter * float64(s.interval))
+	}
+	var next = fetchStart.Add(interval)
+	if next.Before(now) {
+		next = now
+	}
+	return s.nextActive(next)
+}
+
+func (s *querySchedule) nextCron(now time.Time) time.Time {
+	var next = now.In(s.location)
+	for i := 0; i < maxScheduleIterations; i++ {
+		next = s.cron.Next(next)
+		if next.IsZero() || s.isActive(next) {
+			return next
+		}
+	}
+	return time.Time{}
+}
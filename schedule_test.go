@@ -0,0 +1,142 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseActiveWindow(t *testing.T) {
+	var assert = assert.New(t)
+
+	var window, err = parseActiveWindow("MON-FRI 09:30-16:00")
+	assert.Equal(nil, err, "Returned an error 1")
+	assert.Equal([7]bool{false, true, true, true, true, true, false}, window.days, "Incorrect days 1")
+	assert.Equal(9*time.Hour+30*time.Minute, window.start, "Incorrect start")
+	assert.Equal(16*time.Hour, window.end, "Incorrect end")
+
+	window, err = parseActiveWindow("fri-mon 22:00-02:00")
+	assert.Equal(nil, err, "Returned an error 2")
+	assert.Equal([7]bool{true, true, false, false, false, true, true}, window.days, "Incorrect days 2")
+
+	window, err = parseActiveWindow("08:00-09:00")
+	assert.Equal(nil, err, "Returned an error 3")
+	assert.Equal([7]bool{true, true, true, true, true, true, true}, window.days, "Incorrect days 3")
+
+	for _, value := range []string{"", "MON", "XYZ 08:00-09:00", "MON 08:00", "MON 25:00-26:00", "MON 08:00-08:00", "MON 08:00-09:00 extra", "SAT,SUN 08:00-09:00"} {
+		_, err = parseActiveWindow(value)
+		assert.NotEqual(nil, err, "Did not return an error for "+value)
+	}
+}
+
+func TestQueryScheduleInterval(t *testing.T) {
+	var assert = assert.New(t)
+
+	var schedule, err = newQuerySchedule(QueryConfig{RequestIntervalSeconds: 60, Timezone: "UTC", ActiveWindows: []string{"MON-FRI 09:00-17:00"}})
+	assert.Equal(nil, err, "Returned an error")
+
+	// Friday 2024-10-18
+	var start = time.Date(2024, 10, 18, 10, 0, 0, 0, time.UTC)
+	assert.Equal(start, schedule.First(start), "Active time was delayed")
+	assert.Equal(start.Add(time.Minute), schedule.Next(start, start.Add(10*time.Second)), "Request time was not taken into account")
+	assert.Equal(start.Add(2*time.Minute), schedule.Next(start, start.Add(2*time.Minute)), "Slow request was not handled")
+
+	// The next window starts on Monday
+	var evening = time.Date(2024, 10, 18, 16, 59, 30, 0, time.UTC)
+	var monday = time.Date(2024, 10, 21, 9, 0, 0, 0, time.UTC)
+	assert.Equal(monday, schedule.Next(evening, evening), "Inactive time was not skipped")
+	assert.Equal(monday, schedule.First(time.Date(2024, 10, 19, 12, 0, 0, 0, time.UTC)), "Weekend was not skipped")
+}
+
+func TestQueryScheduleCron(t *testing.T) {
+	var assert = assert.New(t)
+
+	var schedule, err = newQuerySchedule(QueryConfig{Schedule: "0 9-17 * * MON-FRI", Timezone: "America/New_York"})
+	assert.Equal(nil, err, "Returned an error 1")
+
+	var location, _ = time.LoadLocation("America/New_York")
+	var friday = time.Date(2024, 10, 18, 17, 30, 0, 0, location)
+	assert.Equal(time.Date(2024, 10, 21, 9, 0, 0, 0, location).Unix(), schedule.First(friday).Unix(), "Incorrect next cron time")
+
+	// Cron times outside of the windows are skipped
+	schedule, err = newQuerySchedule(QueryConfig{Schedule: "0 * * * *", Timezone: "UTC", ActiveWindows: []string{"22:00-02:00"}})
+	assert.Equal(nil, err, "Returned an error 2")
+	var now = time.Date(2024, 10, 18, 1, 30, 0, 0, time.UTC)
+	assert.Equal(time.Date(2024, 10, 18, 22, 0, 0, 0, time.UTC), schedule.Next(now, now), "Inactive cron times were not skipped")
+	now = time.Date(2024, 10, 18, 0, 30, 0, 0, time.UTC)
+	assert.Equal(time.Date(2024, 10, 18, 1, 0, 0, 0, time.UTC), schedule.Next(now, now), "Window crossing midnight was not handled")
+
+	_, err = newQuerySchedule(QueryConfig{Schedule: "invalid", Timezone: "UTC"})
+	assert.NotEqual(nil, err, "Did not return an error for an invalid schedule")
+	_, err = newQuerySchedule(QueryConfig{Timezone: "Invalid/Zone"})
+	assert.NotEqual(nil, err, "Did not return an error for an invalid timezone")
+}
+
+func TestQueryScheduleJitter(t *testing.T) {
+	var assert = assert.New(t)
+
+	var schedule, err = newQuerySchedule(QueryConfig{RequestIntervalSeconds: 100, Timezone: "UTC", JitterPercent: 10, StartupStaggerSeconds: 30})
+	assert.Equal(nil, err, "Returned an error")
+
+	var start = time.Date(2024, 10, 18, 10, 0, 0, 0, time.UTC)
+	schedule.random = func() float64 { return 0 }
+	assert.Equal(start, schedule.First(start), "Incorrect minimum stagger")
+	assert.Equal(start.Add(90*time.Second), schedule.Next(start, start.Add(time.Second)), "Incorrect minimum jitter")
+
+	schedule.random = func() float64 { return 0.5 }
+	assert.Equal(start.Add(15*time.Second), schedule.First(start), "Incorrect stagger")
+	assert.Equal(start.Add(100*time.Second), schedule.Next(start, start.Add(time.Second)), "Incorrect jitter")
+	// The request time is still taken into account
+	assert.Equal(start.Add(120*time.Second), schedule.Next(start, start.Add(120*time.Second)), "Slow request was not handled")
+
+	// The stagger does not exceed the interval
+	schedule, err = newQuerySchedule(QueryConfig{RequestIntervalSeconds: 10, Timezone: "UTC", StartupStaggerSeconds: 60})
+	assert.Equal(nil, err, "Returned an error")
+	schedule.random = func() float64 { return 0.5 }
+	assert.Equal(start.Add(5*time.Second), schedule.First(start), "Stagger was not limited by the interval")
+	assert.Equal(start.Add(10*time.Second), schedule.Next(start, start), "Jitter was applied without JitterPercent")
+}
+
+func TestQueryScheduleAdaptive(t *testing.T) {
+	var assert = assert.New(t)
+
+	var schedule, err = newQuerySchedule(QueryConfig{RequestIntervalSeconds: 60, Timezone: "UTC", AdaptiveInterval: true, OnlyIfDifferent: true, MinIntervalSeconds: 30, MaxIntervalSeconds: 200})
+	assert.Equal(nil, err, "Returned an error")
+
+	var start = time.Date(2024, 10, 18, 10, 0, 0, 0, time.UTC)
+	assert.Equal(start.Add(60*time.Second), schedule.Next(start, start), "Incorrect initial interval")
+	schedule.Observe(false)
+	assert.Equal(start.Add(120*time.Second), schedule.Next(start, start), "Did not back off 1")
+	schedule.Observe(false)
+	assert.Equal(start.Add(200*time.Second), schedule.Next(start, start), "Did not respect the maximum interval")
+	schedule.Observe(true)
+	assert.Equal(start.Add(30*time.Second), schedule.Next(start, start), "Did not speed up after a change")
+
+	// Fixed intervals are not adjusted
+	schedule, err = newQuerySchedule(QueryConfig{RequestIntervalSeconds: 60, Timezone: "UTC"})
+	assert.Equal(nil, err, "Returned an error")
+	schedule.Observe(false)
+	assert.Equal(start.Add(60*time.Second), schedule.Next(start, start), "Fixed interval was adjusted")
+}
+
+func TestQueryConfigAdaptive(t *testing.T) {
+	var assert = assert.New(t)
+
+	var config = QueryConfig{Source: "page", Before: "<b>", After: "</b>", ResultType: "string", RequestBackend: "go", RequestIntervalSeconds: 60, Timezone: "UTC", TimeSeriesGranularity: "seconds", MaxPages: 1, AdaptiveInterval: true, OnlyIfDifferent: true, MaxIntervalSeconds: 600}
+	assert.Equal(nil, config.PostInit(), "Returned an error")
+	assert.Equal(60, config.MinIntervalSeconds, "Did not use the request interval as the minimum")
+
+	var invalid = config
+	invalid.OnlyIfDifferent = false
+	assert.NotEqual(nil, invalid.PostInit(), "Did not require OnlyIfDifferent")
+	invalid = config
+	invalid.MaxIntervalSeconds = 0
+	assert.NotEqual(nil, invalid.PostInit(), "Did not require MaxIntervalSeconds")
+	invalid = config
+	invalid.MinIntervalSeconds = 120
+	assert.NotEqual(nil, invalid.PostInit(), "Accepted a minimum above the request interval")
+	invalid = config
+	invalid.Schedule = "* * * * *"
+	assert.NotEqual(nil, invalid.PostInit(), "Accepted a cron schedule")
+}
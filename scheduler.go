@@ -0,0 +1,192 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"expvar"
+	"sync"
+	"time"
+	"webtrack/webfetch"
+)
+
+var queueLength = expvar.NewInt("webtrack_queue_length")
+var queueLag = expvar.NewMap("webtrack_queue_lag_ms")
+
+type fetchResult struct {
+	response webfetch.Response
+	err      error
+}
+
+// Request of a tracker which is due to be fetched
+type fetchJob struct {
+	ctx      context.Context
+	name     string
+	backend  string
+	url      string
+	priority int
+	due      time.Time
+	// Buffered, so the worker never waits for a tracker which stopped waiting
+	result chan fetchResult
+}
+
+// Jobs with a higher priority come first, then the ones which are due for longer
+type fetchQueue []*fetchJob
+
+func (q fetchQueue) Len() int {
+	return len(q)
+}
+
+func (q fetchQueue) Less(i, j int) bool {
+	if q[i].priority != q[j].priority {
+		return q[i].priority > q[j].priority
+	}
+	return q[i].due.Before(q[j].due)
+}
+
+func (q fetchQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+}
+
+func (q *fetchQueue) Push(x any) {
+	*q = append(*q, x.(*fetchJob))
+}
+
+func (q *fetchQueue) Pop() any {
+	var old = *q
+	var job = old[len(old)-1]
+	*q = old[:len(old)-1]
+	return job
+}
+
+// Limits the number of concurrent requests of all trackers to the size of the worker pool.
+// Every worker keeps its own fetcher for each backend, so at most one browser is started per worker.
+type scheduler struct {
+	size  int
+	mutex sync.Mutex
+	queue fetchQueue
+	// Wakes up an idle worker after a job is queued
+	notify chan any
+}
+
+func newScheduler(size int) *scheduler {
+	return &scheduler{size: size, notify: make(chan any, 1)}
+}
+
+func (s *scheduler) wake() {
+	select {
+	case s.notify <- nil:
+	default:
+		// A worker is already going to check the queue
+	}
+}
+
+func (s *scheduler) pop() *fetchJob {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(s.queue) == 0 {
+		return nil
+	}
+	var job = heap.Pop(&s.queue).(*fetchJob)
+	queueLength.Set(int64(len(s.queue)))
+	// Pass the remaining jobs to the next idle worker
+	if len(s.queue) > 0 {
+		s.wake()
+	}
+	return job
+}
+
+func (s *scheduler) worker(ctx context.Context, done chan any) {
+	var fetchers = map[string]*webfetch.Fetcher{}
+	defer close(done)
+	defer func() {
+		for _, fetcher := range fetchers {
+			fetcher.Close()
+		}
+	}()
+
+	for {
+		var job = s.pop()
+		if job == nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-s.notify:
+				continue
+			}
+		}
+		// The tracker stopped waiting for the response
+		if job.ctx.Err() != nil {
+			job.result <- fetchResult{err: job.ctx.Err()}
+			continue
+		}
+
+		s.reportLag(job)
+
+		var fetcher, exists = fetchers[job.backend]
+		if !exists {
+			var created = webfetch.NewFetcher(job.backend)
+			fetcher = &created
+			fetchers[job.backend] = fetcher
+		}
+		response, err := fetcher.Fetch(job.ctx, job.url)
+		job.result <- fetchResult{response: response, err: err}
+	}
+}
+
+func (s *scheduler) reportLag(job *fetchJob) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// The tracker may have stopped and removed its entry in the meantime
+	if job.ctx.Err() != nil {
+		return
+	}
+	var lag = new(expvar.Int)
+	lag.Set(time.Since(job.due).Milliseconds())
+	queueLag.Set(job.name, lag)
+}
+
+// Removes the queue lag of a stopped tracker, so the removed and renamed queries are not reported forever
+func (s *scheduler) forget(name string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	queueLag.Delete(name)
+}
+
+// Workers stop when the context is cancelled, stopResponse is closed once all of them have stopped
+func (s *scheduler) Start(ctx context.Context, stopResponse chan any) {
+	var workerStopResponses []chan any
+	for i := 0; i < s.size; i++ {
+		var done = make(chan any)
+		workerStopResponses = append(workerStopResponses, done)
+		go s.worker(ctx, done)
+	}
+
+	go func() {
+		for _, done := range workerStopResponses {
+			<-done
+		}
+		close(stopResponse)
+	}()
+}
+
+// Waits for a free worker and fetches the page. The due time is the moment the query was supposed to run,
+// the difference between it and the start of the request is reported as the queue lag.
+func (s *scheduler) Fetch(ctx context.Context, config QueryConfig, url string, due time.Time) (webfetch.Response, error) {
+	var job = &fetchJob{ctx: ctx, name: config.Name, backend: config.RequestBackend, url: url, priority: config.Priority, due: due, result: make(chan fetchResult, 1)}
+
+	s.mutex.Lock()
+	heap.Push(&s.queue, job)
+	queueLength.Set(int64(len(s.queue)))
+	s.mutex.Unlock()
+	s.wake()
+
+	select {
+	case <-ctx.Done():
+		// The job is dropped by the worker which picks it up
+		return webfetch.Response{}, ctx.Err()
+	case result := <-job.result:
+		return result.response, result.err
+	}
+}
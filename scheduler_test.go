@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSchedulerPriority(t *testing.T) {
+	var assert = assert.New(t)
+
+	var mutex sync.Mutex
+	var order []string
+	var started = make(chan any)
+	var release = make(chan any)
+	var server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/blocking" {
+			close(started)
+			<-release
+		}
+		mutex.Lock()
+		order = append(order, r.URL.Path)
+		mutex.Unlock()
+	}))
+	defer server.Close()
+
+	var ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	var scheduler = newScheduler(1)
+	var stopResponse = make(chan any)
+	scheduler.Start(ctx, stopResponse)
+
+	var wait sync.WaitGroup
+	var fetch = func(ctx context.Context, path string, priority int) {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			var config = QueryConfig{Name: path, Url: server.URL + path, RequestBackend: "go", Priority: priority}
+			_, err := scheduler.Fetch(ctx, config, config.Url, time.Now())
+			assert.Equal(nil, err, "Returned an error for "+path)
+		}()
+	}
+
+	// The only worker is busy while the other jobs are queued
+	fetch(ctx, "/blocking", 0)
+	<-started
+	fetch(ctx, "/low", -1)
+	time.Sleep(20 * time.Millisecond)
+	fetch(ctx, "/normal", 0)
+	time.Sleep(20 * time.Millisecond)
+	fetch(ctx, "/high", 10)
+	time.Sleep(20 * time.Millisecond)
+
+	// Cancelled jobs are skipped
+	var cancelledCtx, cancelJob = context.WithCancel(ctx)
+	var cancelled = make(chan error)
+	go func() {
+		_, err := scheduler.Fetch(cancelledCtx, QueryConfig{Name: "cancelled", RequestBackend: "go", Priority: 20}, server.URL+"/cancelled", time.Now())
+		cancelled <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	cancelJob()
+	assert.Equal(context.Canceled, <-cancelled, "Did not return the cancellation")
+
+	close(release)
+	wait.Wait()
+	assert.Equal([]string{"/blocking", "/high", "/normal", "/low"}, order, "Incorrect order of the requests")
+	var lag, _ = queueLag.Get("/low").(*expvar.Int)
+	assert.True(lag != nil && lag.Value() >= 40, "Incorrect queue lag")
+
+	cancel()
+	select {
+	case <-stopResponse:
+	case <-time.After(time.Second):
+		assert.Fail("Workers did not stop after the cancellation")
+	}
+}
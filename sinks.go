@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+	"webtrack/storage"
+)
+
+type querySink struct {
+	name string
+	sink storage.Sink
+}
+
+// Creates the shared sinks on demand so that only the backends referenced by the configs are connected
+type SinkRegistry struct {
+	config Config
+	store  storage.Storage
+	sinks  map[string]storage.Sink
+	// Sinks created for a single tracker, they are closed when it stops
+	owned map[storage.Sink]bool
+	mutex sync.Mutex
+}
+
+func newBufferConfig(config Config) storage.BufferConfig {
+	return storage.BufferConfig{
+		Directory:      config.BufferDirectory,
+		MaxRecords:     config.BufferMaxRecords,
+		OverflowPolicy: config.BufferOverflowPolicy,
+		RetryInterval:  time.Duration(config.BufferRetryIntervalSeconds) * time.Second,
+		MaxAttempts:    config.BufferMaxAttempts,
+	}
+}
+
+// Wraps the sink into a durable buffer unless the buffering is disabled
+func bufferSink(config Config, name string, sink storage.Sink) (storage.Sink, error) {
+	if config.BufferMaxRecords == 0 {
+		return sink, nil
+	}
+	return storage.NewBuffer(sink, name, newBufferConfig(config))
+}
+
+func NewSinkRegistry(config Config, store storage.Storage) *SinkRegistry {
+	var registry = &SinkRegistry{config: config, store: store, sinks: map[string]storage.Sink{}, owned: map[storage.Sink]bool{}}
+	// The primary storage can be referenced both by its backend name and as "storage"
+	registry.sinks["storage"] = store
+	registry.sinks[config.StorageBackend] = store
+	return registry
+}
+
+func (r *SinkRegistry) get(name string) (storage.Sink, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if sink, ok := r.sinks[name]; ok {
+		return sink, nil
+	}
+
+	var err = validateBackend(r.config, name)
+	if err != nil {
+		return nil, err
+	}
+	store, err := newStorage(r.config, name)
+	if err != nil {
+		return nil, err
+	}
+	sink, err := bufferSink(r.config, name, store)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	r.sinks[name] = sink
+	return sink, nil
+}
+
+func (r *SinkRegistry) Resolve(config QueryConfig) (result []querySink, err error) {
+	defer func() {
+		if err != nil {
+			r.Release(result)
+			result = nil
+		}
+	}()
+
+	var names = config.Sinks
+	if len(names) == 0 {
+		names = append([]string{"storage"}, r.config.AdditionalSinks...)
+	}
+
+	for _, name := range names {
+		var sink storage.Sink
+		if name == "webhook" {
+			// Webhooks are configured per query, so they are not shared
+			sink, err = bufferSink(r.config, "webhook_"+config.Name, storage.NewWebhookSink(config.WebhookUrl))
+			if err != nil {
+				return result, err
+			}
+			r.mutex.Lock()
+			r.owned[sink] = true
+			r.mutex.Unlock()
+		} else {
+			sink, err = r.get(name)
+			if err != nil {
+				return result, err
+			}
+			// "storage" and the name of the main backend are the same sink
+			if containsSink(result, sink) {
+				return result, errors.New("sink " + name + " of " + config.Name + " is the same as another sink of the query")
+			}
+		}
+		result = append(result, querySink{name: name, sink: sink})
+	}
+
+	// The existing values are searched in the main storage
+	if (config.OnlyIfUnique || config.Source == "feed") && !containsSink(result, r.store) {
+		return result, errors.New("OnlyIfUnique and the feed source require the query to be written into the main storage: " + config.Name)
+	}
+	return
+}
+
+func containsSink(sinks []querySink, sink storage.Sink) bool {
+	for _, s := range sinks {
+		if s.sink == sink {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *SinkRegistry) Close() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for name, sink := range r.sinks {
+		// The primary storage is owned by main
+		if sink != storage.Sink(r.store) {
+			sink.Close()
+		}
+		delete(r.sinks, name)
+	}
+	for sink := range r.owned {
+		sink.Close()
+		delete(r.owned, sink)
+	}
+}
+
+// Closes the sinks created for a single tracker, the shared sinks are kept
+func (r *SinkRegistry) Release(sinks []querySink) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, sink := range sinks {
+		if r.owned[sink.sink] {
+			sink.sink.Close()
+			delete(r.owned, sink.sink)
+		}
+	}
+}
+
+// Writes the record into all sinks in parallel, so a slow or failing sink does not delay the others.
+// Returns the sinks which accepted the record and the errors of the other ones.
+func writeToSinks(ctx context.Context, sinks []querySink, series string, record storage.Record) (written []querySink, err error) {
+	var errs = make([]error, len(sinks))
+	var wg sync.WaitGroup
+	for i, s := range sinks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = s.sink.AppendRecord(ctx, series, record)
+		}()
+	}
+	wg.Wait()
+
+	var failures = []error{}
+	for i, sinkErr := range errs {
+		if sinkErr != nil {
+			fmt.Printf("Failed to write to the %v sink of %v: %v\n", sinks[i].name, series, sinkErr)
+			failures = append(failures, fmt.Errorf("failed to write to the %v sink: %w", sinks[i].name, sinkErr))
+		} else {
+			written = append(written, sinks[i])
+		}
+	}
+	return written, errors.Join(failures...)
+}
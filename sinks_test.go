@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+	"webtrack/storage"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testSink struct {
+	delay   time.Duration
+	err     error
+	records []storage.Record
+}
+
+func (s *testSink) CreateSeries(name string) error {
+	return nil
+}
+
+func (s *testSink) AppendRecord(ctx context.Context, series string, record storage.Record) error {
+	time.Sleep(s.delay)
+	if s.err != nil {
+		return s.err
+	}
+	s.records = append(s.records, record)
+	return nil
+}
+
+func (s *testSink) Close() error {
+	return nil
+}
+
+func TestWriteToSinks(t *testing.T) {
+	var assert = assert.New(t)
+
+	var slow = &testSink{delay: 100 * time.Millisecond}
+	var failing = &testSink{err: errors.New("failed")}
+	var fast = &testSink{}
+	var sinks = []querySink{{name: "slow", sink: slow}, {name: "failing", sink: failing}, {name: "fast", sink: fast}}
+
+	var record = storage.Record{Timestamp: 1, Value: "a"}
+	var written, err = writeToSinks(context.Background(), sinks, "test", record)
+	assert.Equal("failed to write to the failing sink: failed", err.Error(), "Incorrect sink error")
+	assert.Equal(2, len(written), "Incorrect number of successful sinks")
+	assert.Equal("slow", written[0].name, "Incorrect successful sink 1")
+	assert.Equal("fast", written[1].name, "Incorrect successful sink 2")
+	assert.Equal([]storage.Record{record}, slow.records, "Slow sink did not receive the record")
+	assert.Equal([]storage.Record{record}, fast.records, "Fast sink did not receive the record")
+	assert.Equal(0, len(failing.records), "Failing sink received the record")
+}
+
+func TestSinkRegistryResolve(t *testing.T) {
+	var assert = assert.New(t)
+
+	var store = newTestStorage(t)
+	var config = Config{StorageBackend: "jsonl", AdditionalSinks: []string{"csv"}, FileDirectory: t.TempDir()}
+	var registry = NewSinkRegistry(config, store)
+	defer registry.Close()
+
+	sinks, err := registry.Resolve(QueryConfig{Name: "test"})
+	assert.Equal(nil, err, "Did not resolve the default sinks")
+	assert.Equal(2, len(sinks), "Incorrect default sinks count")
+	assert.Equal(storage.Sink(store), sinks[0].sink, "Main storage is not the first default sink")
+	assert.Equal("csv", sinks[1].name, "Additional sink is not included by default")
+
+	sinks, err = registry.Resolve(QueryConfig{Name: "test", Sinks: []string{"jsonl", "webhook"}, WebhookUrl: "http://127.0.0.1"})
+	assert.Equal(nil, err, "Did not resolve the custom sinks")
+	assert.Equal(storage.Sink(store), sinks[0].sink, "Main storage backend name did not resolve to the main storage")
+	assert.Equal("webhook", sinks[1].name, "Webhook sink was not created")
+
+	_, err = registry.Resolve(QueryConfig{Name: "test", Sinks: []string{"csv"}, OnlyIfUnique: true})
+	assert.NotEqual(nil, err, "Allowed OnlyIfUnique without the main storage")
+
+	_, err = registry.Resolve(QueryConfig{Name: "test", Sinks: []string{"mongodb"}})
+	assert.NotEqual(nil, err, "Allowed an unconfigured backend")
+
+	// Every value would be written twice
+	_, err = registry.Resolve(QueryConfig{Name: "test", Sinks: []string{"storage", "jsonl"}})
+	assert.NotEqual(nil, err, "Allowed the main storage under two names")
+	var query = QueryConfig{Source: "page", Before: "<b>", After: "</b>", ResultType: "string", RequestBackend: "go", RequestIntervalSeconds: 60, Timezone: "UTC", TimeSeriesGranularity: "seconds", MaxPages: 1, Sinks: []string{"csv", "csv"}}
+	assert.NotEqual(nil, query.PostInit(), "Allowed a duplicate sink")
+}
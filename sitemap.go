@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+	"webtrack/storage"
+)
+
+type sitemapDocument struct {
+	XMLName xml.Name
+	// Pages of a regular sitemap
+	Urls []struct {
+		Loc string `xml:"loc"`
+	} `xml:"url"`
+	// Sitemaps listed by a sitemap index
+	Sitemaps []struct {
+		Loc string `xml:"loc"`
+	} `xml:"sitemap"`
+}
+
+func parseSitemap(body string) (urls []string, sitemaps []string, err error) {
+	// Sitemaps are often served as .gz files without the Content-Encoding header
+	if strings.HasPrefix(body, "\x1f\x8b") {
+		body, err = decompressBody([]byte(body))
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var document sitemapDocument
+	err = xml.Unmarshal([]byte(body), &document)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch document.XMLName.Local {
+	case "urlset":
+		for _, url := range document.Urls {
+			urls = append(urls, strings.TrimSpace(url.Loc))
+		}
+	case "sitemapindex":
+		for _, sitemap := range document.Sitemaps {
+			sitemaps = append(sitemaps, strings.TrimSpace(sitemap.Loc))
+		}
+	default:
+		return nil, nil, errors.New("unsupported sitemap format: " + document.XMLName.Local)
+	}
+	return
+}
+
+// Returns the page addresses of the sitemap and of the sitemaps listed by it which match the pattern
+func readSitemap(ctx context.Context, scheduler *scheduler, config QueryConfig, sitemapUrl string, due time.Time) (result []string, err error) {
+	pattern, err := regexp.Compile(config.SitemapPattern)
+	if err != nil {
+		return nil, err
+	}
+	// Sitemaps are plain XML, so they do not need a browser
+	var sitemapConfig = config
+	sitemapConfig.RequestBackend = "go"
+
+	var pending = []string{sitemapUrl}
+	var visited = map[string]bool{}
+	for len(pending) > 0 && len(result) < config.SitemapMaxUrls {
+		var current = pending[0]
+		pending = pending[1:]
+		if visited[current] {
+			continue
+		}
+		visited[current] = true
+
+		response, err := scheduler.Fetch(ctx, sitemapConfig, current, due)
+		if err != nil {
+			return result, fmt.Errorf("failed to request the sitemap %v: %w", current, err)
+		}
+		urls, sitemaps, err := parseSitemap(response.Body)
+		if err != nil {
+			return result, fmt.Errorf("failed to parse the sitemap %v: %w", current, err)
+		}
+		pending = append(pending, sitemaps...)
+		for _, url := range urls {
+			if pattern.MatchString(url) && len(result) < config.SitemapMaxUrls {
+				result = append(result, url)
+			}
+		}
+	}
+	return
+}
+
+// Requests every page of the sitemap and writes their values, the address of the page is stored in the url field.
+// The last values are kept per page to respect OnlyIfDifferent, the ones missing after a restart are loaded using the search if it is not nil.
+// Returns the number of written records and the failures of the pages.
+func trackSitemap(ctx context.Context, scheduler *scheduler, config QueryConfig, sinks []querySink, sitemapUrl string, due time.Time, hostname string, lastValues map[string]string, search storage.FieldSearch) (written int, errs []error) {
+	urls, err := readSitemap(ctx, scheduler, config, sitemapUrl, due)
+	if err != nil {
+		return 0, []error{stageError{stage: "fetch", err: err}}
+	}
+
+	for _, url := range urls {
+		response, err := scheduler.Fetch(ctx, config, url, due)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			errs = append(errs, stageError{stage: "fetch", err: fmt.Errorf("failed to request %v: %w", url, err)})
+			continue
+		}
+		res, err := extractValue(config, response.Body)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to process %v: %w", url, err))
+			continue
+		}
+		if _, found := lastValues[url]; !found && config.OnlyIfDifferent && search != nil {
+			last, err := search.LastRecordByField(ctx, config.Name, "url", url)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("failed to find the last value of %v: %w", url, err))
+				continue
+			}
+			if last != nil {
+				lastValues[url] = last.Value
+			}
+		}
+		if config.OnlyIfDifferent && lastValues[url] == res {
+			continue
+		}
+
+		var metadata = storage.RecordMetadata{
+			FetchDurationMilliseconds: response.Duration.Milliseconds(),
+			HttpStatus:                response.StatusCode,
+			ResponseSize:              int64(len(response.Body)),
+			ContentHash:               GetStringHash(response.Body),
+			Backend:                   config.RequestBackend,
+			Hostname:                  hostname,
+		}
+		var record = storage.Record{Timestamp: time.Now().UnixMilli(), Value: res, Version: config.Version, Metadata: &metadata, Fields: map[string]string{"url": url}}
+		sinksWritten, err := writeToSinks(ctx, sinks, config.Name, record)
+		if err != nil {
+			errs = append(errs, stageError{stage: "write", err: err})
+		}
+		if len(sinksWritten) > 0 {
+			lastValues[url] = res
+			written++
+		}
+	}
+	return
+}
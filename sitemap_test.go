@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"webtrack/storage"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSitemap(t *testing.T) {
+	var assert = assert.New(t)
+
+	var urls, sitemaps, err = parseSitemap(`<?xml version="1.0" encoding="UTF-8"?><urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9"><url><loc> https://example.com/a </loc></url><url><loc>https://example.com/b</loc></url></urlset>`)
+	assert.Equal(nil, err, "Returned an error 1")
+	assert.Equal([]string{"https://example.com/a", "https://example.com/b"}, urls, "Incorrect pages")
+	assert.Equal(0, len(sitemaps), "Returned sitemaps for a regular sitemap")
+
+	var buffer bytes.Buffer
+	var writer = gzip.NewWriter(&buffer)
+	writer.Write([]byte(`<sitemapindex xmlns="http://www.sitemaps.org/schemas/sitemap/0.9"><sitemap><loc>https://example.com/sitemap1.xml</loc></sitemap></sitemapindex>`))
+	writer.Close()
+	urls, sitemaps, err = parseSitemap(buffer.String())
+	assert.Equal(nil, err, "Returned an error 2")
+	assert.Equal(0, len(urls), "Returned pages for a sitemap index")
+	assert.Equal([]string{"https://example.com/sitemap1.xml"}, sitemaps, "Incorrect sitemaps of a compressed index")
+
+	_, _, err = parseSitemap("<html><body></body></html>")
+	assert.NotEqual(nil, err, "Did not return an error for a page")
+}
+
+func TestTrackSitemap(t *testing.T) {
+	var assert = assert.New(t)
+
+	var prices = map[string]string{"/product/1": "11", "/product/2": "21", "/product/3": "31"}
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/sitemap.xml":
+			w.Write([]byte(`<sitemapindex><sitemap><loc>` + server.URL + `/products.xml.gz</loc></sitemap><sitemap><loc>` + server.URL + `/sitemap.xml</loc></sitemap></sitemapindex>`))
+		case "/products.xml.gz":
+			var writer = gzip.NewWriter(w)
+			writer.Write([]byte(`<urlset><url><loc>` + server.URL + `/product/1</loc></url><url><loc>` + server.URL + `/product/2</loc></url><url><loc>` + server.URL + `/product/3</loc></url><url><loc>` + server.URL + `/about</loc></url></urlset>`))
+			writer.Close()
+		default:
+			if price, ok := prices[r.URL.Path]; ok {
+				w.Write([]byte("<span>" + price + "</span>"))
+				return
+			}
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	var ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	var scheduler = newScheduler(2)
+	scheduler.Start(ctx, make(chan any))
+
+	var sink = &testSink{}
+	var config = QueryConfig{Name: "prices", Source: "sitemap", SitemapPattern: "/product/", SitemapMaxUrls: 1000, Before: "<span>", After: "</span>", AnyTag: "*", ResultType: "number", RequestBackend: "go", OnlyIfDifferent: true}
+	var sinks = []querySink{{name: "test", sink: sink}}
+	var lastValues = map[string]string{}
+
+	written, errs := trackSitemap(ctx, scheduler, config, sinks, server.URL+"/sitemap.xml", time.Now(), "host", lastValues, nil)
+	assert.Equal(0, len(errs), "Returned an error 1")
+	assert.Equal(3, written, "Did not write the pages")
+	assert.Equal("31", sink.records[2].Value, "Incorrect value")
+	assert.Equal(map[string]string{"url": server.URL + "/product/3"}, sink.records[2].Fields, "Incorrect page address")
+	assert.Equal("host", sink.records[2].Metadata.Hostname, "Incorrect metadata")
+
+	// Only the changed page is written again
+	prices["/product/2"] = "25"
+	written, errs = trackSitemap(ctx, scheduler, config, sinks, server.URL+"/sitemap.xml", time.Now(), "host", lastValues, nil)
+	assert.Equal(0, len(errs), "Returned an error 2")
+	assert.Equal(1, written, "Did not respect OnlyIfDifferent")
+	assert.Equal("25", sink.records[3].Value, "Incorrect changed value")
+	assert.Equal(map[string]string{"url": server.URL + "/product/2"}, sink.records[3].Fields, "Incorrect changed page address")
+
+	config.SitemapPattern = ""
+	config.SitemapMaxUrls = 2
+	config.OnlyIfDifferent = false
+	written, errs = trackSitemap(ctx, scheduler, config, sinks, server.URL+"/sitemap.xml", time.Now(), "host", lastValues, nil)
+	assert.Equal(2, written, "Did not respect SitemapMaxUrls")
+	assert.Equal(0, len(errs), "Returned an error 3")
+
+	// The failures of the pages do not stop the others
+	config.SitemapMaxUrls = 1000
+	written, errs = trackSitemap(ctx, scheduler, config, sinks, server.URL+"/sitemap.xml", time.Now(), "host", lastValues, nil)
+	assert.Equal(3, written, "Did not write the other pages")
+	assert.Equal(1, len(errs), "Did not return the failed page")
+	assert.True(strings.Contains(errs[0].Error(), "/about"), "Failure does not mention the page")
+}
+
+func TestTrackSitemapRestart(t *testing.T) {
+	var assert = assert.New(t)
+
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/sitemap.xml" {
+			w.Write([]byte(`<urlset><url><loc>` + server.URL + `/product/1</loc></url><url><loc>` + server.URL + `/product/2</loc></url></urlset>`))
+			return
+		}
+		w.Write([]byte("<span>" + r.URL.Path + "</span>"))
+	}))
+	defer server.Close()
+
+	var ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	var scheduler = newScheduler(2)
+	scheduler.Start(ctx, make(chan any))
+
+	var store, err = storage.NewSqliteStorage(storage.SqliteConfig{
+		Path:                   filepath.Join(t.TempDir(), "test.db"),
+		VersionCollectionName:  "_version",
+		ArchiveCollectionName:  "_archive",
+		SnapshotCollectionName: "_snapshots",
+		ErrorCollectionName:    "_errors",
+		AlertCollectionName:    "_alerts",
+	})
+	assert.Equal(nil, err, "Did not open a database")
+	defer store.Close()
+
+	var config = QueryConfig{Name: "prices", Source: "sitemap", SitemapMaxUrls: 1000, Before: "<span>", After: "</span>", AnyTag: "*", ResultType: "string", RequestBackend: "go", OnlyIfDifferent: true}
+	err = createQuerySeries(store, config)
+	assert.Equal(nil, err, "Did not create the series")
+	var sinks = []querySink{{name: "storage", sink: store}}
+
+	written, errs := trackSitemap(ctx, scheduler, config, sinks, server.URL+"/sitemap.xml", time.Now(), "host", map[string]string{}, store)
+	assert.Equal(0, len(errs), "Returned an error 1")
+	assert.Equal(2, written, "Did not write the pages")
+
+	// The last values are loaded from the storage after a restart
+	written, errs = trackSitemap(ctx, scheduler, config, sinks, server.URL+"/sitemap.xml", time.Now(), "host", map[string]string{}, store)
+	assert.Equal(0, len(errs), "Returned an error 2")
+	assert.Equal(0, written, "Wrote the unchanged pages again after a restart")
+}
@@ -0,0 +1,456 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"webtrack/mongodb"
+
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+var bufferDepth = expvar.NewMap("webtrack_buffer_depth")
+var bufferDropped = expvar.NewMap("webtrack_buffer_dropped")
+var bufferRejected = expvar.NewMap("webtrack_buffer_rejected")
+
+type BufferConfig struct {
+	Directory      string
+	MaxRecords     int
+	OverflowPolicy string
+	RetryInterval  time.Duration
+	// Failed attempts to write the oldest record before it is rejected, 0 retries forever
+	MaxAttempts int
+}
+
+type seriesQueue struct {
+	mutex sync.Mutex
+	path  string
+	depth int
+	// Failed attempts to write the oldest record
+	attempts int
+}
+
+// Persists the records which failed to be written into the sink and writes them again in the original order
+// once the sink becomes available. New records are queued behind the existing ones to preserve the order.
+type Buffer struct {
+	sink   Sink
+	name   string
+	config BufferConfig
+	queues map[string]*seriesQueue
+	mutex  sync.Mutex
+	stop   chan any
+	done   chan any
+}
+
+func NewBuffer(sink Sink, name string, config BufferConfig) (result *Buffer, err error) {
+	if config.OverflowPolicy != "drop-oldest" && config.OverflowPolicy != "drop-newest" {
+		return nil, errors.New("unsupported buffer overflow policy: " + config.OverflowPolicy)
+	}
+	if config.MaxRecords <= 0 || config.RetryInterval <= 0 {
+		return nil, errors.New("buffer size and retry interval must be positive")
+	}
+	if config.MaxAttempts < 0 {
+		return nil, errors.New("buffer attempts must not be negative")
+	}
+	err = os.MkdirAll(filepath.Join(config.Directory, name), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	result = &Buffer{sink: sink, name: name, config: config, queues: map[string]*seriesQueue{}, stop: make(chan any), done: make(chan any)}
+
+	// Pick up the records left from the previous run
+	entries, err := os.ReadDir(filepath.Join(config.Directory, name))
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if series, found := strings.CutSuffix(entry.Name(), ".jsonl"); found && !entry.IsDir() {
+			var queue = result.queue(series)
+			records, err := queue.read()
+			if err != nil {
+				return nil, err
+			}
+			queue.setDepth(result.metricName(series), len(records))
+		}
+	}
+
+	go result.retryLoop()
+	return result, nil
+}
+
+func (b *Buffer) metricName(series string) string {
+	return b.name + "/" + series
+}
+
+func (b *Buffer) queue(series string) *seriesQueue {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if queue, ok := b.queues[series]; ok {
+		return queue
+	}
+	var queue = &seriesQueue{path: filepath.Join(b.config.Directory, b.name, series+".jsonl")}
+	b.queues[series] = queue
+	return queue
+}
+
+func (q *seriesQueue) setDepth(metricName string, depth int) {
+	q.depth = depth
+	var value = new(expvar.Int)
+	value.Set(int64(depth))
+	bufferDepth.Set(metricName, value)
+}
+
+func (q *seriesQueue) read() (result []Record, err error) {
+	file, err := os.Open(q.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var scanner = bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var record Record
+		var keys map[string]json.RawMessage
+		err = json.Unmarshal(scanner.Bytes(), &record)
+		if err == nil {
+			err = json.Unmarshal(scanner.Bytes(), &keys)
+		}
+		// A line may be incomplete after a crash during the append
+		if err != nil {
+			fmt.Printf("Skipping a broken line of %v: %v\n", q.path, err)
+			continue
+		}
+		// Records buffered by older versions have the timestamps in seconds
+		if _, ok := keys["metadata"]; !ok {
+			record.Timestamp *= 1000
+		}
+		result = append(result, record)
+	}
+	return result, scanner.Err()
+}
+
+func encodeRecords(records []Record) ([]byte, error) {
+	var builder strings.Builder
+	for _, record := range records {
+		line, err := json.Marshal(newJsonRecord(record))
+		if err != nil {
+			return nil, err
+		}
+		builder.Write(line)
+		builder.WriteByte('\n')
+	}
+	return []byte(builder.String()), nil
+}
+
+func (q *seriesQueue) write(records []Record) error {
+	if len(records) == 0 {
+		err := os.Remove(q.path)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	content, err := encodeRecords(records)
+	if err != nil {
+		return err
+	}
+	// Replace the file atomically so that a crash does not lose the queue
+	var temporaryPath = q.path + ".tmp"
+	err = os.WriteFile(temporaryPath, content, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(temporaryPath, q.path)
+}
+
+func appendRecords(path string, records []Record) error {
+	content, err := encodeRecords(records)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(content)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func (b *Buffer) enqueue(series string, queue *seriesQueue, record Record) error {
+	if queue.depth < b.config.MaxRecords {
+		var err = appendRecords(queue.path, []Record{record})
+		if err != nil {
+			return err
+		}
+		queue.setDepth(b.metricName(series), queue.depth+1)
+		return nil
+	}
+
+	bufferDropped.Add(b.metricName(series), 1)
+	if b.config.OverflowPolicy == "drop-newest" {
+		return fmt.Errorf("buffer of %v is full, dropped the record", b.metricName(series))
+	}
+	// Only a full buffer has to be rewritten
+	records, err := queue.read()
+	if err != nil {
+		return err
+	}
+	records = append(records[max(0, len(records)-b.config.MaxRecords+1):], record)
+	err = queue.write(records)
+	if err != nil {
+		return err
+	}
+	queue.setDepth(b.metricName(series), len(records))
+	fmt.Printf("Buffer of %v is full, dropped the oldest record\n", b.metricName(series))
+	return nil
+}
+
+// Moves the record which can not be written into the rejected directory, so that it does not block the others
+func (b *Buffer) reject(series string, record Record, err error) error {
+	var directory = filepath.Join(b.config.Directory, b.name, "rejected")
+	var mkdirErr = os.MkdirAll(directory, 0755)
+	if mkdirErr != nil {
+		return mkdirErr
+	}
+	var appendErr = appendRecords(filepath.Join(directory, series+".jsonl"), []Record{record})
+	if appendErr != nil {
+		return appendErr
+	}
+	bufferRejected.Add(b.metricName(series), 1)
+	fmt.Printf("Rejected the buffered record of %v with timestamp %v: %v\n", b.metricName(series), record.Timestamp, err)
+	return nil
+}
+
+// Must be called with the queue mutex locked. Only the retries count as the failed attempts of a transient error,
+// so that a record is not rejected sooner because of the frequent writes of the query.
+func (b *Buffer) flush(ctx context.Context, series string, queue *seriesQueue, retry bool) error {
+	if queue.depth == 0 {
+		return nil
+	}
+
+	records, err := queue.read()
+	if err != nil {
+		return err
+	}
+
+	// Records which were either written or rejected
+	var removed = 0
+	for ; removed < len(records); removed++ {
+		err = b.sink.AppendRecord(ctx, series, records[removed])
+		if err == nil {
+			queue.attempts = 0
+			continue
+		}
+		// A cancelled write says nothing about the record
+		if ctx.Err() != nil {
+			break
+		}
+		if IsTransientError(err) {
+			if retry {
+				queue.attempts++
+			}
+			if b.config.MaxAttempts == 0 || queue.attempts < b.config.MaxAttempts {
+				break
+			}
+		}
+		var rejectErr = b.reject(series, records[removed], err)
+		if rejectErr != nil {
+			err = rejectErr
+			break
+		}
+		queue.attempts = 0
+		err = nil
+	}
+
+	if removed > 0 {
+		var writeErr = queue.write(records[removed:])
+		if writeErr != nil {
+			return writeErr
+		}
+		queue.setDepth(b.metricName(series), len(records)-removed)
+		if queue.depth == 0 {
+			fmt.Printf("Flushed all buffered records of %v\n", b.metricName(series))
+		}
+	}
+	return err
+}
+
+// Reports whether writing the record again may succeed, e.g. after the connection is restored.
+// Invalid records are returned to the caller instead of being buffered.
+func IsTransientError(err error) bool {
+	var status WebhookStatusError
+	var number *strconv.NumError
+	var unsupportedValue *json.UnsupportedValueError
+	var unsupportedType *json.UnsupportedTypeError
+	var serverErr mongo.ServerError
+	var sqliteErr *sqlite.Error
+	switch {
+	case errors.As(err, &status):
+		return status.StatusCode >= 500 || status.StatusCode == http.StatusRequestTimeout || status.StatusCode == http.StatusTooManyRequests
+	case errors.As(err, &number), errors.As(err, &unsupportedValue), errors.As(err, &unsupportedType):
+		return false
+	case errors.As(err, &serverErr):
+		return mongodb.IsTransientError(err)
+	case errors.As(err, &sqliteErr):
+		var code = sqliteErr.Code() & 0xff
+		return code != sqlite3.SQLITE_CONSTRAINT && code != sqlite3.SQLITE_MISMATCH && code != sqlite3.SQLITE_TOOBIG
+	}
+	return true
+}
+
+func (b *Buffer) retryLoop() {
+	defer close(b.done)
+
+	var ticker = time.NewTicker(b.config.RetryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-ticker.C:
+			b.retry()
+		}
+	}
+}
+
+func (b *Buffer) retry() {
+	b.mutex.Lock()
+	var queues = map[string]*seriesQueue{}
+	for series, queue := range b.queues {
+		queues[series] = queue
+	}
+	b.mutex.Unlock()
+
+	for series, queue := range queues {
+		queue.mutex.Lock()
+		b.flush(context.Background(), series, queue, true)
+		queue.mutex.Unlock()
+	}
+}
+
+func (b *Buffer) Depth(series string) int {
+	var queue = b.queue(series)
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	return queue.depth
+}
+
+func (b *Buffer) CreateSeries(name string) error {
+	return b.sink.CreateSeries(name)
+}
+
+// Returns an error only if the record could neither be written nor buffered
+// Cancelling the context buffers the record instead of losing it.
+func (b *Buffer) AppendRecord(ctx context.Context, series string, record Record) error {
+	var queue = b.queue(series)
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	// Records must not overtake the ones already waiting in the buffer
+	var err = b.flush(ctx, series, queue, false)
+	if err == nil {
+		err = b.sink.AppendRecord(ctx, series, record)
+		if err == nil {
+			return nil
+		}
+		// Writing an invalid record again would not help
+		if !IsTransientError(err) {
+			return err
+		}
+	}
+
+	fmt.Printf("Failed to write to %v, buffering the record: %v\n", b.metricName(series), err)
+	return b.enqueue(series, queue, record)
+}
+
+// Returns the buffered records of the series which were not yet written into the sink
+func (b *Buffer) Pending(series string) ([]Record, error) {
+	var queue = b.queue(series)
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	if queue.depth == 0 {
+		return nil, nil
+	}
+	return queue.read()
+}
+
+func (b *Buffer) Close() error {
+	close(b.stop)
+	<-b.done
+	return b.sink.Close()
+}
+
+// Buffers the writes into the main storage. The reads take the buffered records into account.
+type BufferedStorage struct {
+	Storage
+	buffer *Buffer
+}
+
+func NewBufferedStorage(store Storage, name string, config BufferConfig) (*BufferedStorage, error) {
+	var buffer, err = NewBuffer(store, name, config)
+	if err != nil {
+		return nil, err
+	}
+	return &BufferedStorage{Storage: store, buffer: buffer}, nil
+}
+
+func (b *BufferedStorage) Unwrap() Storage {
+	return b.Storage
+}
+
+func (b *BufferedStorage) AppendRecord(ctx context.Context, series string, record Record) error {
+	return b.buffer.AppendRecord(ctx, series, record)
+}
+
+func (b *BufferedStorage) LastRecord(ctx context.Context, series string) (*Record, error) {
+	pending, err := b.buffer.Pending(series)
+	if err != nil {
+		return nil, err
+	}
+	if len(pending) > 0 {
+		return &pending[len(pending)-1], nil
+	}
+	return b.Storage.LastRecord(ctx, series)
+}
+
+func (b *BufferedStorage) FindByValue(ctx context.Context, series string, value string, version int64) (*Record, error) {
+	pending, err := b.buffer.Pending(series)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(pending) - 1; i >= 0; i-- {
+		if pending[i].Value == value && pending[i].Version == version {
+			return &pending[i], nil
+		}
+	}
+	return b.Storage.FindByValue(ctx, series, value, version)
+}
+
+func (b *BufferedStorage) Close() error {
+	return b.buffer.Close()
+}
@@ -0,0 +1,253 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type flakySink struct {
+	mutex   sync.Mutex
+	fail    bool
+	records []Record
+	// Value which is never accepted, either as an invalid one or because of a transient error
+	invalid string
+	stuck   string
+}
+
+func (s *flakySink) setFail(fail bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.fail = fail
+}
+
+func (s *flakySink) written() []Record {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]Record{}, s.records...)
+}
+
+func (s *flakySink) CreateSeries(name string) error {
+	return nil
+}
+
+func (s *flakySink) AppendRecord(ctx context.Context, series string, record Record) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.fail || (s.stuck != "" && record.Value == s.stuck) {
+		return errors.New("unavailable")
+	}
+	if s.invalid != "" && record.Value == s.invalid {
+		_, err := strconv.ParseFloat(record.Value, 64)
+		return err
+	}
+	s.records = append(s.records, record)
+	return nil
+}
+
+func (s *flakySink) Close() error {
+	return nil
+}
+
+func newTestBufferConfig(t *testing.T, maxRecords int, policy string) BufferConfig {
+	return BufferConfig{Directory: t.TempDir(), MaxRecords: maxRecords, OverflowPolicy: policy, RetryInterval: time.Hour}
+}
+
+func TestBufferInvalid(t *testing.T) {
+	var assert = assert.New(t)
+
+	var _, err = NewBuffer(&flakySink{}, "test", newTestBufferConfig(t, 10, "invalid"))
+	assert.NotEqual(nil, err, "Was able to use an invalid overflow policy")
+
+	_, err = NewBuffer(&flakySink{}, "test", newTestBufferConfig(t, 0, "drop-oldest"))
+	assert.NotEqual(nil, err, "Was able to use an empty buffer")
+}
+
+func TestBufferReplayInOrder(t *testing.T) {
+	var assert = assert.New(t)
+
+	var sink = &flakySink{fail: true}
+	var config = newTestBufferConfig(t, 10, "drop-oldest")
+	var buffer, err = NewBuffer(sink, "test", config)
+	assert.Equal(nil, err, "Did not create a buffer")
+
+	err = buffer.AppendRecord(context.Background(), "a", Record{Timestamp: 1, Value: "1"})
+	assert.Equal(nil, err, "Did not buffer a record 1")
+	err = buffer.AppendRecord(context.Background(), "a", Record{Timestamp: 2, Value: "2"})
+	assert.Equal(nil, err, "Did not buffer a record 2")
+	assert.Equal(2, buffer.Depth("a"), "Incorrect buffer depth")
+	assert.Equal(0, len(sink.written()), "Wrote to an unavailable sink")
+
+	// Buffered records survive a restart
+	buffer.Close()
+	buffer, err = NewBuffer(sink, "test", config)
+	assert.Equal(nil, err, "Did not reopen a buffer")
+	assert.Equal(2, buffer.Depth("a"), "Buffered records were lost on restart")
+
+	sink.setFail(false)
+	err = buffer.AppendRecord(context.Background(), "a", Record{Timestamp: 3, Value: "3"})
+	assert.Equal(nil, err, "Did not write a record")
+	assert.Equal(0, buffer.Depth("a"), "Buffer was not flushed")
+	assert.Equal([]Record{{Timestamp: 1, Value: "1"}, {Timestamp: 2, Value: "2"}, {Timestamp: 3, Value: "3"}}, sink.written(), "Records were not written in order")
+	buffer.Close()
+}
+
+func TestBufferLegacyRecords(t *testing.T) {
+	var assert = assert.New(t)
+
+	// Records buffered by older versions have the timestamps in seconds
+	var config = newTestBufferConfig(t, 10, "drop-oldest")
+	os.MkdirAll(filepath.Join(config.Directory, "test"), 0755)
+	var err = os.WriteFile(filepath.Join(config.Directory, "test", "a.jsonl"), []byte("{\"timestamp\":1,\"value\":\"1\",\"version\":0}\n"), 0644)
+	assert.Equal(nil, err, "Did not write a buffer file")
+
+	var sink = &flakySink{}
+	buffer, err := NewBuffer(sink, "test", config)
+	assert.Equal(nil, err, "Did not create a buffer")
+	defer buffer.Close()
+	assert.Equal(1, buffer.Depth("a"), "Did not load the legacy record")
+
+	err = buffer.AppendRecord(context.Background(), "a", Record{Timestamp: 2000, Value: "2"})
+	assert.Equal(nil, err, "Did not write a record")
+	assert.Equal([]Record{{Timestamp: 1000, Value: "1"}, {Timestamp: 2000, Value: "2"}}, sink.written(), "Did not convert the legacy timestamp")
+}
+
+func TestBufferOverflow(t *testing.T) {
+	var assert = assert.New(t)
+
+	var sink = &flakySink{fail: true}
+	var buffer, err = NewBuffer(sink, "test", newTestBufferConfig(t, 2, "drop-oldest"))
+	assert.Equal(nil, err, "Did not create a buffer 1")
+	for i := int64(1); i <= 3; i++ {
+		err = buffer.AppendRecord(context.Background(), "a", Record{Timestamp: i})
+		assert.Equal(nil, err, "Did not buffer a record with drop-oldest")
+	}
+	pending, err := buffer.Pending("a")
+	assert.Equal(nil, err, "Did not return pending records 1")
+	assert.Equal([]Record{{Timestamp: 2}, {Timestamp: 3}}, pending, "Did not drop the oldest record")
+	buffer.Close()
+
+	buffer, err = NewBuffer(sink, "test", newTestBufferConfig(t, 2, "drop-newest"))
+	assert.Equal(nil, err, "Did not create a buffer 2")
+	buffer.AppendRecord(context.Background(), "a", Record{Timestamp: 1})
+	buffer.AppendRecord(context.Background(), "a", Record{Timestamp: 2})
+	err = buffer.AppendRecord(context.Background(), "a", Record{Timestamp: 3})
+	assert.NotEqual(nil, err, "Did not report a dropped record with drop-newest")
+	pending, err = buffer.Pending("a")
+	assert.Equal(nil, err, "Did not return pending records 2")
+	assert.Equal([]Record{{Timestamp: 1}, {Timestamp: 2}}, pending, "Did not drop the newest record")
+	buffer.Close()
+}
+
+func TestBufferRetryLoop(t *testing.T) {
+	var assert = assert.New(t)
+
+	var sink = &flakySink{fail: true}
+	var config = newTestBufferConfig(t, 10, "drop-oldest")
+	config.RetryInterval = 10 * time.Millisecond
+	var buffer, err = NewBuffer(sink, "test", config)
+	assert.Equal(nil, err, "Did not create a buffer")
+	defer buffer.Close()
+
+	buffer.AppendRecord(context.Background(), "a", Record{Timestamp: 1})
+	sink.setFail(false)
+	assert.Eventually(func() bool { return buffer.Depth("a") == 0 }, time.Second, 10*time.Millisecond, "Buffer was not flushed in the background")
+	assert.Equal([]Record{{Timestamp: 1}}, sink.written(), "Buffered record was not written")
+}
+
+func TestBufferedStorageReads(t *testing.T) {
+	var assert = assert.New(t)
+
+	var store = newTestSqliteStorage(t)
+	store.CreateSeries("a")
+	store.AppendRecord(context.Background(), "a", Record{Timestamp: 1, Value: "stored"})
+
+	var buffered, err = NewBufferedStorage(store, "main", newTestBufferConfig(t, 10, "drop-oldest"))
+	assert.Equal(nil, err, "Did not create a buffered storage")
+	defer buffered.Close()
+
+	// Simulate the unavailable storage by queueing the record directly
+	var queue = buffered.buffer.queue("a")
+	buffered.buffer.enqueue("a", queue, Record{Timestamp: 2, Value: "pending"})
+
+	record, err := buffered.LastRecord(context.Background(), "a")
+	assert.Equal(nil, err, "Did not return the last record")
+	assert.Equal("pending", record.Value, "Last record does not include the buffered records")
+
+	record, err = buffered.FindByValue(context.Background(), "a", "pending", 0)
+	assert.Equal(nil, err, "Did not find a record by value 1")
+	assert.Equal(int64(2), record.Timestamp, "Did not find a buffered record")
+
+	record, err = buffered.FindByValue(context.Background(), "a", "stored", 0)
+	assert.Equal(nil, err, "Did not find a record by value 2")
+	assert.Equal(int64(1), record.Timestamp, "Did not find a stored record")
+
+	assert.Equal(Storage(store), buffered.Unwrap(), "Incorrect unwrapped storage")
+}
+
+func TestBufferRejectsInvalidRecords(t *testing.T) {
+	var assert = assert.New(t)
+
+	var sink = &flakySink{invalid: "invalid"}
+	var config = newTestBufferConfig(t, 10, "drop-oldest")
+	config.MaxAttempts = 2
+	var buffer, err = NewBuffer(sink, "test", config)
+	assert.Equal(nil, err, "Did not create a buffer")
+	defer buffer.Close()
+
+	// Invalid records are returned instead of being buffered
+	err = buffer.AppendRecord(context.Background(), "a", Record{Timestamp: 1, Value: "invalid"})
+	assert.NotEqual(nil, err, "Did not return an invalid record")
+	assert.Equal(0, buffer.Depth("a"), "Buffered an invalid record")
+
+	// A buffered record which became invalid does not block the next ones
+	var rejected = rejectedCount("test/a")
+	sink.setFail(true)
+	for i, value := range []string{"1", "invalid", "2"} {
+		err = buffer.AppendRecord(context.Background(), "a", Record{Timestamp: int64(i + 2), Value: value})
+		assert.Equal(nil, err, "Did not buffer a record")
+	}
+	sink.setFail(false)
+	err = buffer.AppendRecord(context.Background(), "a", Record{Timestamp: 5, Value: "3"})
+	assert.Equal(nil, err, "Returned an error after the rejection")
+	assert.Equal([]string{"1", "2", "3"}, recordValues(sink.written()), "Did not skip the invalid record")
+	assert.Equal(rejected+1, rejectedCount("test/a"), "Did not count the rejected record")
+	content, err := os.ReadFile(filepath.Join(config.Directory, "test", "rejected", "a.jsonl"))
+	assert.Equal(nil, err, "Did not keep the rejected record")
+	assert.Contains(string(content), `"value":"invalid"`, "Incorrect rejected record")
+
+	// A record failing for too long is rejected as well
+	sink.stuck = "stuck"
+	err = buffer.AppendRecord(context.Background(), "b", Record{Timestamp: 1, Value: "stuck"})
+	assert.Equal(nil, err, "Did not buffer a record with a transient error")
+	err = buffer.AppendRecord(context.Background(), "b", Record{Timestamp: 2, Value: "4"})
+	assert.Equal(nil, err, "Did not buffer a record behind the failing one")
+	assert.Equal(2, buffer.Depth("b"), "Rejected a record before the retries")
+	buffer.retry()
+	assert.Equal(2, buffer.Depth("b"), "Rejected a record before MaxAttempts")
+	buffer.retry()
+	assert.Equal(0, buffer.Depth("b"), "Did not reject the record after MaxAttempts")
+	assert.Equal([]string{"1", "2", "3", "4"}, recordValues(sink.written()), "Incorrect written records")
+}
+
+func rejectedCount(name string) int64 {
+	if count, ok := bufferRejected.Get(name).(*expvar.Int); ok {
+		return count.Value()
+	}
+	return 0
+}
+
+func recordValues(records []Record) (result []string) {
+	for _, record := range records {
+		result = append(result, record.Value)
+	}
+	return
+}
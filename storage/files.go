@@ -0,0 +1,442 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type FileConfig struct {
+	Directory             string
+	Format                string
+	RotateDaily           bool
+	MaxSizeBytes          int64
+	VersionCollectionName string
+	ErrorCollectionName   string
+	AlertCollectionName   string
+}
+
+// Stores every series as a set of append-only CSV or JSON Lines files in a separate directory
+type FileStorage struct {
+	config FileConfig
+	mutex  sync.Mutex
+	now    func() time.Time
+}
+
+var recordColumns = []string{"timestamp", "value", "version", "fetch_duration_ms", "http_status", "response_size", "content_hash", "backend", "hostname", "fields"}
+var versionColumns = []string{"name", "version", "hash"}
+var errorColumns = []string{"timestamp", "name", "stage", "message", "version", "repeated"}
+var alertColumns = []string{"timestamp", "name", "rule", "state", "value", "version"}
+
+func NewFileStorage(config FileConfig) (result *FileStorage, err error) {
+	if config.Format != "csv" && config.Format != "jsonl" {
+		return nil, errors.New("unsupported file format: " + config.Format)
+	}
+	err = os.MkdirAll(config.Directory, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &FileStorage{config: config, now: time.Now}, nil
+}
+
+func (f *FileStorage) fileName(period string, index int) string {
+	if period == "" {
+		return fmt.Sprintf("%04d.%v", index, f.config.Format)
+	}
+	return fmt.Sprintf("%v-%04d.%v", period, index, f.config.Format)
+}
+
+func (f *FileStorage) parseFileName(name string) (period string, index int, ok bool) {
+	var base, found = strings.CutSuffix(name, "."+f.config.Format)
+	if !found {
+		return
+	}
+	var indexString = base
+	if separator := strings.LastIndex(base, "-"); separator >= 0 {
+		period = base[:separator]
+		indexString = base[separator+1:]
+	}
+	index, err := strconv.Atoi(indexString)
+	return period, index, err == nil
+}
+
+// Returns the data files of the series sorted from the oldest to the newest
+func (f *FileStorage) listFiles(series string) (result []string, err error) {
+	entries, err := os.ReadDir(filepath.Join(f.config.Directory, series))
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if _, _, ok := f.parseFileName(entry.Name()); ok && !entry.IsDir() {
+			result = append(result, entry.Name())
+		}
+	}
+	sort.Strings(result)
+	return
+}
+
+func (f *FileStorage) headerMatches(path string, columns []string) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	if f.config.Format != "csv" {
+		// JSON Lines have no header, the lines written by older versions have no metadata
+		var scanner = bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		if !scanner.Scan() {
+			return true, scanner.Err()
+		}
+		var decoded map[string]any
+		err = json.Unmarshal(scanner.Bytes(), &decoded)
+		if err != nil {
+			return false, err
+		}
+		_, ok := decoded["metadata"]
+		return ok, nil
+	}
+
+	var reader = csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err == io.EOF {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return slices.Equal(header, columns), nil
+}
+
+func (f *FileStorage) currentFile(series string, columns []string) (path string, err error) {
+	var period = ""
+	if f.config.RotateDaily {
+		period = f.now().UTC().Format("20060102")
+	}
+
+	files, err := f.listFiles(series)
+	if err != nil {
+		return "", err
+	}
+
+	var index = -1
+	for _, name := range files {
+		if filePeriod, fileIndex, _ := f.parseFileName(name); filePeriod == period && fileIndex > index {
+			index = fileIndex
+		}
+	}
+	if index < 0 {
+		return filepath.Join(f.config.Directory, series, f.fileName(period, 0)), nil
+	}
+
+	path = filepath.Join(f.config.Directory, series, f.fileName(period, index))
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if f.config.MaxSizeBytes > 0 && info.Size() >= f.config.MaxSizeBytes {
+		return filepath.Join(f.config.Directory, series, f.fileName(period, index+1)), nil
+	}
+	// Files written by older versions with a different set of columns are not continued
+	matches, err := f.headerMatches(path, columns)
+	if err != nil {
+		return "", err
+	}
+	if !matches {
+		path = filepath.Join(f.config.Directory, series, f.fileName(period, index+1))
+	}
+	return
+}
+
+func (f *FileStorage) appendRow(path string, columns []string, row []string, value any) (err error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	switch f.config.Format {
+	case "csv":
+		info, err := file.Stat()
+		if err != nil {
+			return err
+		}
+		var writer = csv.NewWriter(file)
+		// Every file is self-describing so that rotated files can be used independently
+		if info.Size() == 0 {
+			writer.Write(columns)
+		}
+		writer.Write(row)
+		writer.Flush()
+		return writer.Error()
+	default:
+		line, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		_, err = file.Write(append(line, '\n'))
+		return err
+	}
+}
+
+func (f *FileStorage) readRows(path string) (result []map[string]string, err error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	switch f.config.Format {
+	case "csv":
+		var reader = csv.NewReader(file)
+		// Older files may have a different set of columns
+		reader.FieldsPerRecord = -1
+		header, err := reader.Read()
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		for {
+			row, err := reader.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			var values = map[string]string{}
+			for i := 0; i < len(header) && i < len(row); i++ {
+				values[header[i]] = row[i]
+			}
+			result = append(result, values)
+		}
+	default:
+		var scanner = bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			if len(strings.TrimSpace(scanner.Text())) == 0 {
+				continue
+			}
+			var decoder = json.NewDecoder(strings.NewReader(scanner.Text()))
+			decoder.UseNumber()
+			var decoded map[string]any
+			err = decoder.Decode(&decoded)
+			if err != nil {
+				return nil, err
+			}
+			var values = map[string]string{}
+			for key, value := range decoded {
+				values[key] = fmt.Sprint(value)
+			}
+			result = append(result, values)
+		}
+		err = scanner.Err()
+	}
+	return
+}
+
+func rowToRecord(row map[string]string) (record Record, err error) {
+	record.Timestamp, err = strconv.ParseInt(row["timestamp"], 10, 64)
+	if err != nil {
+		return
+	}
+	// Rows written by older versions have neither the metadata nor the timestamps in milliseconds
+	_, csvMetadata := row["fetch_duration_ms"]
+	_, jsonMetadata := row["metadata"]
+	if !csvMetadata && !jsonMetadata {
+		record.Timestamp *= 1000
+	}
+	record.Value = row["value"]
+	record.Version, err = strconv.ParseInt(row["version"], 10, 64)
+	return
+}
+
+func rowToVersion(row map[string]string) (record VersionRecord, err error) {
+	record.Name = row["name"]
+	record.Version, err = strconv.ParseInt(row["version"], 10, 64)
+	record.Hash = row["hash"]
+	return
+}
+
+// Iterates over the records of the series from the newest to the oldest until the callback returns true
+func (f *FileStorage) findRecord(series string, match func(record Record) bool) (*Record, error) {
+	files, err := f.listFiles(series)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := len(files) - 1; i >= 0; i-- {
+		rows, err := f.readRows(filepath.Join(f.config.Directory, series, files[i]))
+		if err != nil {
+			return nil, err
+		}
+		for j := len(rows) - 1; j >= 0; j-- {
+			record, err := rowToRecord(rows[j])
+			if err != nil {
+				return nil, err
+			}
+			if match(record) {
+				return &record, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+func (f *FileStorage) findVersion(match func(record VersionRecord) bool) (result *VersionRecord, err error) {
+	rows, err := f.readRows(filepath.Join(f.config.Directory, f.config.VersionCollectionName+"."+f.config.Format))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, row := range rows {
+		record, err := rowToVersion(row)
+		if err != nil {
+			return nil, err
+		}
+		if match(record) && (result == nil || record.Version > result.Version) {
+			result = &record
+		}
+	}
+	return
+}
+
+func (f *FileStorage) CreateSeries(name string) error {
+	return os.MkdirAll(filepath.Join(f.config.Directory, name), 0755)
+}
+
+// Local file operations are not cancelled
+func (f *FileStorage) AppendRecord(ctx context.Context, series string, record Record) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	path, err := f.currentFile(series, recordColumns)
+	if err != nil {
+		return err
+	}
+	var row = []string{strconv.FormatInt(record.Timestamp, 10), record.Value, strconv.FormatInt(record.Version, 10), "", "", "", "", "", "", ""}
+	if metadata := record.Metadata; metadata != nil {
+		row = append(row[:3],
+			strconv.FormatInt(metadata.FetchDurationMilliseconds, 10), strconv.Itoa(metadata.HttpStatus), strconv.FormatInt(metadata.ResponseSize, 10),
+			metadata.ContentHash, metadata.Backend, metadata.Hostname, "")
+	}
+	// Fields are stored as a JSON object in a single column
+	if len(record.Fields) > 0 {
+		fields, err := json.Marshal(record.Fields)
+		if err != nil {
+			return err
+		}
+		row[len(row)-1] = string(fields)
+	}
+	return f.appendRow(path, recordColumns, row, newJsonRecord(record))
+}
+
+func (f *FileStorage) LastRecord(ctx context.Context, series string) (*Record, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.findRecord(series, func(record Record) bool {
+		return true
+	})
+}
+
+func (f *FileStorage) FindByValue(ctx context.Context, series string, value string, version int64) (*Record, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.findRecord(series, func(record Record) bool {
+		return record.Value == value && record.Version == version
+	})
+}
+
+func (f *FileStorage) LastVersion(name string) (*VersionRecord, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.findVersion(func(record VersionRecord) bool {
+		return record.Name == name
+	})
+}
+
+func (f *FileStorage) FindVersionByHash(name string, hash string) (*VersionRecord, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.findVersion(func(record VersionRecord) bool {
+		return record.Name == name && record.Hash == hash
+	})
+}
+
+func (f *FileStorage) AppendVersion(record VersionRecord) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	var row = []string{record.Name, strconv.FormatInt(record.Version, 10), record.Hash}
+	return f.appendRow(filepath.Join(f.config.Directory, f.config.VersionCollectionName+"."+f.config.Format), versionColumns, row, record)
+}
+
+func (f *FileStorage) AppendError(record ErrorRecord) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	var row = []string{strconv.FormatInt(record.Timestamp, 10), record.Name, record.Stage, record.Message, strconv.FormatInt(record.Version, 10), strconv.FormatInt(record.Repeated, 10)}
+	return f.appendRow(filepath.Join(f.config.Directory, f.config.ErrorCollectionName+"."+f.config.Format), errorColumns, row, record)
+}
+
+func (f *FileStorage) AppendAlert(record AlertRecord) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	var row = []string{strconv.FormatInt(record.Timestamp, 10), record.Name, record.Rule, record.State, record.Value, strconv.FormatInt(record.Version, 10)}
+	return f.appendRow(filepath.Join(f.config.Directory, f.config.AlertCollectionName+"."+f.config.Format), alertColumns, row, record)
+}
+
+func (f *FileStorage) LastAlert(name string, rule string) (*AlertRecord, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	rows, err := f.readRows(filepath.Join(f.config.Directory, f.config.AlertCollectionName+"."+f.config.Format))
+	if err != nil {
+		return nil, err
+	}
+	for i := len(rows) - 1; i >= 0; i-- {
+		if rows[i]["name"] != name || rows[i]["rule"] != rule {
+			continue
+		}
+		var record = AlertRecord{Name: name, Rule: rule, State: rows[i]["state"], Value: rows[i]["value"]}
+		record.Timestamp, err = strconv.ParseInt(rows[i]["timestamp"], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		record.Version, err = strconv.ParseInt(rows[i]["version"], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		return &record, nil
+	}
+	return nil, nil
+}
+
+func (f *FileStorage) Close() error {
+	// Files are closed after every write
+	return nil
+}
@@ -0,0 +1,186 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestFileStorage(t *testing.T, format string, rotateDaily bool, maxSizeBytes int64) *FileStorage {
+	var store, err = NewFileStorage(FileConfig{
+		Directory:             t.TempDir(),
+		Format:                format,
+		RotateDaily:           rotateDaily,
+		MaxSizeBytes:          maxSizeBytes,
+		VersionCollectionName: "_version",
+		ErrorCollectionName:   "_errors",
+		AlertCollectionName:   "_alerts",
+	})
+	assert.Equal(t, nil, err, "Did not create a file storage")
+	return store
+}
+
+func TestFileStorageInvalid(t *testing.T) {
+	var assert = assert.New(t)
+
+	var _, err = NewFileStorage(FileConfig{Directory: t.TempDir(), Format: "xml"})
+	assert.NotEqual(nil, err, "Was able to use an unsupported format")
+}
+
+func TestFileStorageRecords(t *testing.T) {
+	var assert = assert.New(t)
+
+	for _, format := range []string{"csv", "jsonl"} {
+		var store = newTestFileStorage(t, format, false, 0)
+
+		var err = store.CreateSeries("test")
+		assert.Equal(nil, err, "Did not create a series "+format)
+
+		record, err := store.LastRecord(context.Background(), "test")
+		assert.Equal(nil, err, "Returned an error for an empty series "+format)
+		assert.True(record == nil, "Returned a record for an empty series "+format)
+
+		err = store.AppendRecord(context.Background(), "test", Record{Timestamp: 1, Value: "a, \"quoted\"", Version: 0})
+		assert.Equal(nil, err, "Did not append a record 1 "+format)
+		err = store.AppendRecord(context.Background(), "test", Record{Timestamp: 2, Value: "b", Version: 1})
+		assert.Equal(nil, err, "Did not append a record 2 "+format)
+
+		record, err = store.LastRecord(context.Background(), "test")
+		assert.Equal(nil, err, "Did not return the last record "+format)
+		assert.Equal(Record{Timestamp: 2, Value: "b", Version: 1}, *record, "Incorrect last record "+format)
+
+		record, err = store.FindByValue(context.Background(), "test", "a, \"quoted\"", 0)
+		assert.Equal(nil, err, "Did not find a record by value "+format)
+		assert.Equal(int64(1), record.Timestamp, "Incorrect record found by value "+format)
+
+		record, err = store.FindByValue(context.Background(), "test", "b", 0)
+		assert.Equal(nil, err, "Returned an error for a missing value "+format)
+		assert.True(record == nil, "Found a record with a different version "+format)
+	}
+}
+
+func TestFileStorageCsvLayout(t *testing.T) {
+	var assert = assert.New(t)
+
+	var store = newTestFileStorage(t, "csv", false, 0)
+	store.CreateSeries("test")
+	store.AppendRecord(context.Background(), "test", Record{Timestamp: 1, Value: "a", Version: 0})
+	store.AppendRecord(context.Background(), "test", Record{Timestamp: 2, Value: "b", Version: 0, Metadata: &RecordMetadata{FetchDurationMilliseconds: 120, HttpStatus: 200, ResponseSize: 512, ContentHash: "hash", Backend: "go", Hostname: "host"}})
+	store.AppendRecord(context.Background(), "test", Record{Timestamp: 3, Value: "c", Version: 0, Fields: map[string]string{"title": "c"}})
+
+	var data, err = os.ReadFile(filepath.Join(store.config.Directory, "test", "0000.csv"))
+	assert.Equal(nil, err, "Did not write a file 1")
+	assert.Equal("timestamp,value,version,fetch_duration_ms,http_status,response_size,content_hash,backend,hostname,fields\n1,a,0,,,,,,,\n2,b,0,120,200,512,hash,go,host,\n3,c,0,,,,,,,\"{\"\"title\"\":\"\"c\"\"}\"\n", string(data), "Incorrect file content")
+
+	// A file with a different header is not continued
+	err = os.WriteFile(filepath.Join(store.config.Directory, "test", "0000.csv"), []byte("timestamp,value,version\n1,a,0\n"), 0644)
+	assert.Equal(nil, err, "Did not write a file 2")
+	store.AppendRecord(context.Background(), "test", Record{Timestamp: 4, Value: "d", Version: 0})
+	files, err := store.listFiles("test")
+	assert.Equal(nil, err, "Did not list the files")
+	assert.Equal([]string{"0000.csv", "0001.csv"}, files, "Did not start a new file")
+}
+
+func TestFileStorageLegacyFiles(t *testing.T) {
+	var assert = assert.New(t)
+
+	var legacy = map[string]string{"csv": "timestamp,value,version\n1,a,0\n", "jsonl": "{\"timestamp\":1,\"value\":\"a\",\"version\":0}\n"}
+	for format, content := range legacy {
+		var store = newTestFileStorage(t, format, false, 0)
+		store.CreateSeries("test")
+		var err = os.WriteFile(filepath.Join(store.config.Directory, "test", "0000."+format), []byte(content), 0644)
+		assert.Equal(nil, err, "Did not write a file "+format)
+
+		// Files with the timestamps in seconds are not continued
+		err = store.AppendRecord(context.Background(), "test", Record{Timestamp: 2000, Value: "b", Version: 0})
+		assert.Equal(nil, err, "Did not append a record "+format)
+		err = store.AppendRecord(context.Background(), "test", Record{Timestamp: 3000, Value: "c", Version: 0})
+		assert.Equal(nil, err, "Did not append a record 2 "+format)
+		files, err := store.listFiles("test")
+		assert.Equal(nil, err, "Did not list the files "+format)
+		assert.Equal([]string{"0000." + format, "0001." + format}, files, "Did not start a new file "+format)
+
+		record, err := store.FindByValue(context.Background(), "test", "a", 0)
+		assert.Equal(nil, err, "Did not find a legacy record "+format)
+		assert.Equal(int64(1000), record.Timestamp, "Did not convert the legacy timestamp "+format)
+		record, err = store.FindByValue(context.Background(), "test", "b", 0)
+		assert.Equal(nil, err, "Did not find a new record "+format)
+		assert.Equal(int64(2000), record.Timestamp, "Converted a new timestamp "+format)
+	}
+}
+
+func TestFileStorageRotation(t *testing.T) {
+	var assert = assert.New(t)
+
+	var store = newTestFileStorage(t, "jsonl", true, 60)
+	var now = time.Date(2024, 10, 20, 23, 0, 0, 0, time.UTC)
+	store.now = func() time.Time { return now }
+	store.CreateSeries("test")
+
+	// Each line is 56 bytes, so the second line exceeds the limit
+	store.AppendRecord(context.Background(), "test", Record{Timestamp: 1, Value: "a", Version: 0})
+	store.AppendRecord(context.Background(), "test", Record{Timestamp: 2, Value: "b", Version: 0})
+	store.AppendRecord(context.Background(), "test", Record{Timestamp: 3, Value: "c", Version: 0})
+	now = now.Add(2 * time.Hour)
+	store.AppendRecord(context.Background(), "test", Record{Timestamp: 4, Value: "d", Version: 0})
+
+	var files, err = store.listFiles("test")
+	assert.Equal(nil, err, "Did not list the files")
+	assert.Equal([]string{"20241020-0000.jsonl", "20241020-0001.jsonl", "20241021-0000.jsonl"}, files, "Incorrect rotated files")
+
+	record, err := store.FindByValue(context.Background(), "test", "a", 0)
+	assert.Equal(nil, err, "Did not find a record in a rotated file")
+	assert.Equal(int64(1), record.Timestamp, "Incorrect record found in a rotated file")
+
+	record, err = store.LastRecord(context.Background(), "test")
+	assert.Equal(nil, err, "Did not return the last record")
+	assert.Equal("d", record.Value, "Incorrect last record")
+}
+
+func TestFileStorageVersions(t *testing.T) {
+	var assert = assert.New(t)
+
+	for _, format := range []string{"csv", "jsonl"} {
+		var store = newTestFileStorage(t, format, true, 1)
+
+		version, err := store.LastVersion("query")
+		assert.Equal(nil, err, "Returned an error for a missing version "+format)
+		assert.True(version == nil, "Returned a version for a new query "+format)
+
+		store.AppendVersion(VersionRecord{Name: "query", Version: 0, Hash: "a"})
+		store.AppendVersion(VersionRecord{Name: "query", Version: 1, Hash: "b"})
+		store.AppendVersion(VersionRecord{Name: "other", Version: 5, Hash: "a"})
+
+		version, err = store.LastVersion("query")
+		assert.Equal(nil, err, "Did not return the last version "+format)
+		assert.Equal(VersionRecord{Name: "query", Version: 1, Hash: "b"}, *version, "Incorrect last version "+format)
+
+		version, err = store.FindVersionByHash("query", "a")
+		assert.Equal(nil, err, "Did not find a version by hash "+format)
+		assert.Equal(int64(0), version.Version, "Incorrect version found by hash "+format)
+	}
+}
+
+func TestFileStorageAlerts(t *testing.T) {
+	var assert = assert.New(t)
+
+	for _, format := range []string{"csv", "jsonl"} {
+		var store = newTestFileStorage(t, format, false, 0)
+
+		alert, err := store.LastAlert("query", "above 10")
+		assert.Equal(nil, err, "Returned an error for a missing alert "+format)
+		assert.True(alert == nil, "Returned an alert for a new rule "+format)
+
+		store.AppendAlert(AlertRecord{Timestamp: 1, Name: "query", Rule: "above 10", State: "firing", Value: "11", Version: 0})
+		store.AppendAlert(AlertRecord{Timestamp: 2, Name: "query", Rule: "above 10", State: "resolved", Value: "9", Version: 0})
+		store.AppendAlert(AlertRecord{Timestamp: 3, Name: "other", Rule: "above 10", State: "firing", Value: "12", Version: 0})
+
+		alert, err = store.LastAlert("query", "above 10")
+		assert.Equal(nil, err, "Did not return the last alert "+format)
+		assert.Equal(AlertRecord{Timestamp: 2, Name: "query", Rule: "above 10", State: "resolved", Value: "9", Version: 0}, *alert, "Incorrect last alert "+format)
+	}
+}
@@ -0,0 +1,620 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+	"webtrack/mongodb"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+type MongoConfig struct {
+	ConnectionUrl          string
+	DatabaseName           string
+	VersionCollectionName  string
+	ArchiveCollectionName  string
+	SnapshotCollectionName string
+	ErrorCollectionName    string
+	AlertCollectionName    string
+	// Batching is disabled if BatchSize is 0
+	BatchSize     int
+	BatchInterval time.Duration
+}
+
+type MongoStorage struct {
+	db     mongodb.MongoDB
+	batch  *mongodb.BatchWriter
+	config MongoConfig
+	// Series stored in time-series collections use a different document layout
+	timeSeries map[string]bool
+	mutex      sync.Mutex
+}
+
+func NewMongoStorage(config MongoConfig) (result *MongoStorage, err error) {
+	db, err := mongodb.NewMongoDB(config.ConnectionUrl, config.DatabaseName)
+	if err != nil {
+		return nil, err
+	}
+	result = &MongoStorage{db: db, config: config, timeSeries: map[string]bool{}}
+
+	// Create the default versions collection
+	err = db.CreateCollection(config.VersionCollectionName, bson.D{{Key: "name", Value: 1}, {Key: "version", Value: 1}}, bson.D{{Key: "name", Value: 1}, {Key: "hash", Value: 1}})
+	if err != nil {
+		db.Disconnect()
+		return nil, err
+	}
+
+	err = db.CreateCollection(config.ErrorCollectionName, bson.D{{Key: "name", Value: 1}, {Key: "timestamp", Value: 1}})
+	if err != nil {
+		db.Disconnect()
+		return nil, err
+	}
+
+	err = db.CreateCollection(config.AlertCollectionName, bson.D{{Key: "name", Value: 1}, {Key: "rule", Value: 1}, {Key: "timestamp", Value: 1}})
+	if err != nil {
+		db.Disconnect()
+		return nil, err
+	}
+
+	if config.BatchSize > 0 {
+		result.batch, err = db.NewBatchWriter(config.BatchSize, config.BatchInterval)
+		if err != nil {
+			db.Disconnect()
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// Returns the records accepted by the batch writer which may not be visible in MongoDB yet, oldest first
+func (m *MongoStorage) pendingRecords(series string) (result []Record, err error) {
+	if m.batch == nil {
+		return nil, nil
+	}
+
+	for _, document := range m.batch.Pending(series) {
+		raw, err := bson.Marshal(document)
+		if err != nil {
+			return nil, err
+		}
+		record, err := recordFromRaw(raw)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, record)
+	}
+	return
+}
+
+func (m *MongoStorage) isTimeSeries(series string) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.timeSeries[series]
+}
+
+// Timestamps are stored as BSON dates, older versions stored them as an integer number of seconds
+func timestampCondition(operator string, timestamp int64) bson.E {
+	var conditions = bson.A{bson.D{{Key: "timestamp", Value: bson.D{{Key: operator, Value: bson.DateTime(timestamp)}}}}}
+	// Round up so that the bounds include the same seconds as the milliseconds would
+	var seconds = timestamp / 1000
+	if timestamp%1000 > 0 {
+		seconds++
+	}
+	if operator != "$eq" || timestamp%1000 == 0 {
+		conditions = append(conditions, bson.D{{Key: "timestamp", Value: bson.D{{Key: operator, Value: seconds}}}})
+	}
+	return bson.E{Key: "$or", Value: conditions}
+}
+
+func timestampFromRaw(raw bson.Raw) (int64, error) {
+	var timestamp = raw.Lookup("timestamp")
+	switch timestamp.Type {
+	case bson.TypeDateTime:
+		return timestamp.DateTime(), nil
+	default:
+		seconds, ok := timestamp.AsInt64OK()
+		if !ok {
+			return 0, errors.New("unsupported timestamp type: " + timestamp.Type.String())
+		}
+		return seconds * 1000, nil
+	}
+}
+
+func (m *MongoStorage) valueValue(series string, value string) (any, error) {
+	if m.isTimeSeries(series) {
+		return strconv.ParseFloat(value, 64)
+	}
+	return value, nil
+}
+
+func (m *MongoStorage) recordDocument(series string, record Record) (bson.D, error) {
+	return newRecordDocument(series, record, m.isTimeSeries(series))
+}
+
+func newRecordDocument(series string, record Record, timeSeries bool) (bson.D, error) {
+	var value any = record.Value
+	if timeSeries {
+		var err error
+		value, err = strconv.ParseFloat(record.Value, 64)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var document = bson.D{{Key: "timestamp", Value: bson.DateTime(record.Timestamp)}, {Key: "value", Value: value}, {Key: "version", Value: record.Version}}
+	if record.Metadata != nil {
+		document = append(document, bson.E{Key: "metadata", Value: *record.Metadata})
+	}
+	if len(record.Fields) > 0 {
+		document = append(document, bson.E{Key: "fields", Value: record.Fields})
+	}
+	if timeSeries {
+		document = append(document, bson.E{Key: "meta", Value: bson.D{{Key: "name", Value: series}, {Key: "version", Value: record.Version}}})
+	}
+	return document, nil
+}
+
+func recordFromRaw(raw bson.Raw) (record Record, err error) {
+	record.Timestamp, err = timestampFromRaw(raw)
+	if err != nil {
+		return
+	}
+
+	var value = raw.Lookup("value")
+	switch value.Type {
+	case bson.TypeString:
+		record.Value = value.StringValue()
+	case bson.TypeDouble:
+		record.Value = strconv.FormatFloat(value.Double(), 'f', -1, 64)
+	default:
+		return record, errors.New("unsupported value type: " + value.Type.String())
+	}
+
+	var ok bool
+	record.Version, ok = raw.Lookup("version").AsInt64OK()
+	if !ok {
+		return record, errors.New("unsupported version type")
+	}
+
+	if metadata, ok := raw.Lookup("metadata").DocumentOK(); ok {
+		record.Metadata = &RecordMetadata{}
+		err = bson.Unmarshal(metadata, record.Metadata)
+		if err != nil {
+			return
+		}
+	}
+	if fields, ok := raw.Lookup("fields").DocumentOK(); ok {
+		err = bson.Unmarshal(fields, &record.Fields)
+	}
+	return
+}
+
+func decodeDocument[T any](document *mongo.SingleResult, err error) (*T, error) {
+	if err != nil || document == nil {
+		return nil, err
+	}
+
+	var decoded T
+	err = document.Decode(&decoded)
+	if err != nil {
+		return nil, err
+	}
+	return &decoded, nil
+}
+
+func decodeRecord(document *mongo.SingleResult, err error) (*Record, error) {
+	if err != nil || document == nil {
+		return nil, err
+	}
+
+	raw, err := document.Raw()
+	if err != nil {
+		return nil, err
+	}
+	record, err := recordFromRaw(raw)
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// The last documents are sorted by timestamp and _id, so the indexes end with both to avoid sorting in memory
+var seriesIndexes = []bson.D{
+	{{Key: "timestamp", Value: 1}, {Key: "_id", Value: 1}},
+	{{Key: "value", Value: 1}, {Key: "version", Value: 1}, {Key: "timestamp", Value: 1}, {Key: "_id", Value: 1}},
+}
+
+func (m *MongoStorage) CreateSeries(name string) error {
+	return m.db.CreateCollection(name, seriesIndexes...)
+}
+
+func (m *MongoStorage) AppendRecord(ctx context.Context, series string, record Record) error {
+	document, err := m.recordDocument(series, record)
+	if err != nil {
+		return err
+	}
+	if m.batch != nil {
+		return m.batch.Write(series, document)
+	}
+	return m.db.WriteContext(ctx, series, document)
+}
+
+func (m *MongoStorage) LastRecord(ctx context.Context, series string) (*Record, error) {
+	// Pending records are always newer than the inserted ones
+	pending, err := m.pendingRecords(series)
+	if err != nil {
+		return nil, err
+	}
+	if len(pending) > 0 {
+		return &pending[len(pending)-1], nil
+	}
+	return decodeRecord(m.db.GetLastDocumentFilteredContext(ctx, series, "timestamp", bson.D{}))
+}
+
+func (m *MongoStorage) FindByValue(ctx context.Context, series string, value string, version int64) (*Record, error) {
+	pending, err := m.pendingRecords(series)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(pending) - 1; i >= 0; i-- {
+		if pending[i].Value == value && pending[i].Version == version {
+			return &pending[i], nil
+		}
+	}
+	filterValue, err := m.valueValue(series, value)
+	if err != nil {
+		// A non-numeric value cannot exist in a time series
+		return nil, nil
+	}
+	return decodeRecord(m.db.GetLastDocumentFilteredContext(ctx, series, "timestamp", bson.D{{Key: "value", Value: filterValue}, {Key: "version", Value: version}}))
+}
+
+func (m *MongoStorage) CreateFieldIndex(series string, field string) error {
+	return m.db.CreateCollection(series, bson.D{{Key: "fields." + field, Value: 1}, {Key: "timestamp", Value: 1}, {Key: "_id", Value: 1}})
+}
+
+func (m *MongoStorage) LastRecordByField(ctx context.Context, series string, field string, value string) (*Record, error) {
+	pending, err := m.pendingRecords(series)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(pending) - 1; i >= 0; i-- {
+		if pending[i].Fields[field] == value {
+			return &pending[i], nil
+		}
+	}
+	return decodeRecord(m.db.GetLastDocumentFilteredContext(ctx, series, "timestamp", bson.D{{Key: "fields." + field, Value: value}}))
+}
+
+func (m *MongoStorage) LastVersion(name string) (*VersionRecord, error) {
+	return decodeDocument[VersionRecord](m.db.GetLastDocumentFiltered(m.config.VersionCollectionName, "version", bson.D{{Key: "name", Value: name}}))
+}
+
+func (m *MongoStorage) FindVersionByHash(name string, hash string) (*VersionRecord, error) {
+	return decodeDocument[VersionRecord](m.db.GetLastDocumentFiltered(m.config.VersionCollectionName, "version", bson.D{{Key: "name", Value: name}, {Key: "hash", Value: hash}}))
+}
+
+func (m *MongoStorage) AppendVersion(record VersionRecord) error {
+	return m.db.Write(m.config.VersionCollectionName, bson.D{{Key: "name", Value: record.Name}, {Key: "version", Value: record.Version}, {Key: "hash", Value: record.Hash}})
+}
+
+func (m *MongoStorage) Close() error {
+	if m.batch != nil {
+		err := m.batch.Close()
+		if err != nil {
+			fmt.Printf("Failed to write the last batch to MongoDB: %v\n", err)
+		}
+	}
+	return m.db.Disconnect()
+}
+
+func (m *MongoStorage) AppendError(record ErrorRecord) error {
+	return m.db.Write(m.config.ErrorCollectionName, bson.D{
+		{Key: "timestamp", Value: bson.DateTime(record.Timestamp)},
+		{Key: "name", Value: record.Name},
+		{Key: "stage", Value: record.Stage},
+		{Key: "message", Value: record.Message},
+		{Key: "version", Value: record.Version},
+		{Key: "repeated", Value: record.Repeated},
+	})
+}
+
+func (m *MongoStorage) AppendAlert(record AlertRecord) error {
+	return m.db.Write(m.config.AlertCollectionName, bson.D{
+		{Key: "timestamp", Value: bson.DateTime(record.Timestamp)},
+		{Key: "name", Value: record.Name},
+		{Key: "rule", Value: record.Rule},
+		{Key: "state", Value: record.State},
+		{Key: "value", Value: record.Value},
+		{Key: "version", Value: record.Version},
+	})
+}
+
+type alertDocument struct {
+	Timestamp bson.DateTime
+	Name      string
+	Rule      string
+	State     string
+	Value     string
+	Version   int64
+}
+
+func (m *MongoStorage) LastAlert(name string, rule string) (*AlertRecord, error) {
+	document, err := decodeDocument[alertDocument](m.db.GetLastDocumentFiltered(m.config.AlertCollectionName, "timestamp", bson.D{{Key: "name", Value: name}, {Key: "rule", Value: rule}}))
+	if err != nil || document == nil {
+		return nil, err
+	}
+	return &AlertRecord{Timestamp: int64(document.Timestamp), Name: document.Name, Rule: document.Rule, State: document.State, Value: document.Value, Version: document.Version}, nil
+}
+
+type archivedBody struct {
+	Hash string `bson:"_id"`
+	Body []byte
+}
+
+func (m *MongoStorage) ArchiveBody(hash string, body []byte) error {
+	existing, err := m.db.GetLastDocumentFiltered(m.config.ArchiveCollectionName, "_id", bson.D{{Key: "_id", Value: hash}})
+	if err != nil || existing != nil {
+		return err
+	}
+	err = m.db.Write(m.config.ArchiveCollectionName, bson.D{{Key: "_id", Value: hash}, {Key: "body", Value: body}})
+	// Another tracker may have archived the same body in the meantime
+	if mongo.IsDuplicateKeyError(err) {
+		return nil
+	}
+	return err
+}
+
+func (m *MongoStorage) LoadBody(hash string) ([]byte, error) {
+	decoded, err := decodeDocument[archivedBody](m.db.GetLastDocumentFiltered(m.config.ArchiveCollectionName, "_id", bson.D{{Key: "_id", Value: hash}}))
+	if err != nil {
+		return nil, err
+	}
+	if decoded == nil {
+		return nil, errors.New("archived body not found: " + hash)
+	}
+	return decoded.Body, nil
+}
+
+func (m *MongoStorage) AppendSnapshot(snapshot Snapshot) error {
+	return m.db.Write(m.config.SnapshotCollectionName, bson.D{{Key: "name", Value: snapshot.Name}, {Key: "timestamp", Value: bson.DateTime(snapshot.Timestamp)}, {Key: "hash", Value: snapshot.Hash}, {Key: "version", Value: snapshot.Version}})
+}
+
+func (m *MongoStorage) Snapshots(name string) (result []Snapshot, err error) {
+	documents, err := m.db.GetAllDocumentsFiltered(m.config.SnapshotCollectionName, "timestamp", bson.D{{Key: "name", Value: name}})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, document := range documents {
+		raw, err := bson.Marshal(document)
+		if err != nil {
+			return nil, err
+		}
+		// Timestamps are dates which cannot be decoded into integers directly
+		var decoded struct {
+			Name    string
+			Hash    string
+			Version int64
+		}
+		err = bson.Unmarshal(raw, &decoded)
+		if err != nil {
+			return nil, err
+		}
+		var snapshot = Snapshot{Name: decoded.Name, Hash: decoded.Hash, Version: decoded.Version}
+		snapshot.Timestamp, err = timestampFromRaw(raw)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, snapshot)
+	}
+	return
+}
+
+func (m *MongoStorage) FindByTimestamp(series string, timestamp int64, version int64) (*Record, error) {
+	return decodeRecord(m.db.GetLastDocumentFiltered(series, "timestamp", bson.D{timestampCondition("$eq", timestamp), {Key: "version", Value: version}}))
+}
+
+func (m *MongoStorage) CreateTimeSeries(name string, options TimeSeriesOptions) error {
+	var err = m.db.CreateTimeSeriesCollection(name, "timestamp", "meta", options.Granularity, options.ExpireAfterSeconds)
+	if err != nil {
+		return fmt.Errorf("%w. Run \"webtrack migrate %v\" to convert it", err, name)
+	}
+	// The time and meta fields are indexed automatically
+	err = m.db.CreateCollection(name, bson.D{{Key: "value", Value: 1}, {Key: "version", Value: 1}})
+	if err != nil {
+		return err
+	}
+
+	m.mutex.Lock()
+	m.timeSeries[name] = true
+	m.mutex.Unlock()
+	return nil
+}
+
+// Converts all the records of the collection into the time-series documents
+func (m *MongoStorage) timeSeriesDocuments(name string, collection string) (timestamps []int64, documents []bson.D, err error) {
+	all, err := m.db.GetAllDocumentsFiltered(collection, "timestamp", bson.D{})
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, document := range all {
+		raw, err := bson.Marshal(document)
+		if err != nil {
+			return nil, nil, err
+		}
+		record, err := recordFromRaw(raw)
+		if err != nil {
+			return nil, nil, err
+		}
+		converted, err := newRecordDocument(name, record, true)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to convert the record with timestamp %v: %w", record.Timestamp, err)
+		}
+		timestamps = append(timestamps, record.Timestamp)
+		documents = append(documents, converted)
+	}
+	return timestamps, documents, nil
+}
+
+func (m *MongoStorage) MigrateToTimeSeries(name string, options TimeSeriesOptions) error {
+	exists, collectionType, err := m.db.GetCollectionType(name)
+	if err != nil {
+		return err
+	}
+	// The original collection is renamed and dropped once all the records are copied
+	var legacyName = name + "_legacy"
+	legacyExists, _, err := m.db.GetCollectionType(legacyName)
+	if err != nil {
+		return err
+	}
+	var regular = exists && collectionType != "timeseries"
+	if !regular && !legacyExists {
+		return m.CreateTimeSeries(name, options)
+	}
+	if regular && legacyExists {
+		return errors.New("both " + name + " and " + legacyName + " exist, one of them has to be removed manually")
+	}
+
+	// A previous migration may have stopped after the rename, it is resumed from the legacy collection
+	var source = legacyName
+	if regular {
+		source = name
+	}
+
+	// All the records are converted before changing anything, so an invalid one leaves the collection as it was
+	timestamps, converted, err := m.timeSeriesDocuments(name, source)
+	if err != nil {
+		return err
+	}
+
+	if regular {
+		err = m.db.RenameCollection(name, legacyName)
+		if err != nil {
+			return err
+		}
+	}
+	err = m.CreateTimeSeries(name, options)
+	if err != nil {
+		return err
+	}
+
+	// An interrupted migration or the tracker may have written some of the records already
+	written, err := m.db.GetAllDocumentsFiltered(name, "timestamp", bson.D{})
+	if err != nil {
+		return err
+	}
+	var existing = map[int64]bool{}
+	for _, document := range written {
+		raw, err := bson.Marshal(document)
+		if err != nil {
+			return err
+		}
+		timestamp, err := timestampFromRaw(raw)
+		if err != nil {
+			return err
+		}
+		existing[timestamp] = true
+	}
+	var remaining = []bson.D{}
+	for i, document := range converted {
+		if !existing[timestamps[i]] {
+			remaining = append(remaining, document)
+		}
+	}
+
+	for i := 0; i < len(remaining); i += 1000 {
+		err = m.db.WriteMany(name, remaining[i:min(i+1000, len(remaining))])
+		if err != nil {
+			return fmt.Errorf("%w. Run the migration again to copy the remaining records from %v", err, legacyName)
+		}
+	}
+	err = m.db.DropCollection(legacyName)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Migrated %v records of %v into a time-series collection, %v of them were already present\n", len(converted), name, len(converted)-len(remaining))
+	return nil
+}
+
+func (m *MongoStorage) RecordsBetween(series string, from int64, to int64) (result []Record, err error) {
+	var filter = bson.D{{Key: "$and", Value: bson.A{bson.D{timestampCondition("$gte", from)}, bson.D{timestampCondition("$lt", to)}}}}
+	documents, err := m.db.GetAllDocumentsFiltered(series, "timestamp", filter)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, document := range documents {
+		raw, err := bson.Marshal(document)
+		if err != nil {
+			return nil, err
+		}
+		record, err := recordFromRaw(raw)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, record)
+	}
+	return
+}
+
+func (m *MongoStorage) FirstRecord(series string) (*Record, error) {
+	return decodeRecord(m.db.GetFirstDocument(series, "timestamp"))
+}
+
+func (m *MongoStorage) DeleteBefore(series string, timestamp int64) error {
+	_, err := m.db.DeleteMany(series, bson.D{timestampCondition("$lt", timestamp)})
+	return err
+}
+
+func (m *MongoStorage) CreateRollupSeries(name string) error {
+	return m.db.CreateCollection(name, seriesIndexes[0])
+}
+
+func (m *MongoStorage) AppendRollup(series string, rollup Rollup) error {
+	return m.db.Write(series, bson.D{
+		{Key: "timestamp", Value: bson.DateTime(rollup.Timestamp)},
+		{Key: "version", Value: rollup.Version},
+		{Key: "min", Value: rollup.Min},
+		{Key: "max", Value: rollup.Max},
+		{Key: "avg", Value: rollup.Avg},
+		{Key: "last", Value: rollup.Last},
+		{Key: "count", Value: rollup.Count},
+	})
+}
+
+func (m *MongoStorage) LastRollup(series string) (*Rollup, error) {
+	document, err := m.db.GetLastDocument(series, "timestamp")
+	if err != nil || document == nil {
+		return nil, err
+	}
+
+	raw, err := document.Raw()
+	if err != nil {
+		return nil, err
+	}
+	var decoded struct {
+		Version int64
+		Min     float64
+		Max     float64
+		Avg     float64
+		Last    float64
+		Count   int64
+	}
+	err = bson.Unmarshal(raw, &decoded)
+	if err != nil {
+		return nil, err
+	}
+	var rollup = Rollup{Version: decoded.Version, Min: decoded.Min, Max: decoded.Max, Avg: decoded.Avg, Last: decoded.Last, Count: decoded.Count}
+	rollup.Timestamp, err = timestampFromRaw(raw)
+	if err != nil {
+		return nil, err
+	}
+	return &rollup, nil
+}
@@ -0,0 +1,292 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func newTestMongoStorage(t *testing.T) *MongoStorage {
+	var store, err = NewMongoStorage(MongoConfig{
+		ConnectionUrl:          "mongodb://0.0.0.0:27017",
+		DatabaseName:           "test",
+		VersionCollectionName:  "storage_versions",
+		ArchiveCollectionName:  "storage_archive",
+		SnapshotCollectionName: "storage_snapshots",
+		ErrorCollectionName:    "storage_errors",
+		AlertCollectionName:    "storage_alerts",
+	})
+	assert.Equal(t, nil, err, "Did not connect to a database")
+
+	// Start every test from empty collections
+	for _, collection := range []string{"storage_test", "storage_versions", "storage_archive", "storage_snapshots", "storage_alerts"} {
+		err = store.db.DropCollection(collection)
+		assert.Equal(t, nil, err, "Did not drop a collection")
+	}
+	return store
+}
+
+func TestMongoStorageRecords(t *testing.T) {
+	var assert = assert.New(t)
+
+	var store = newTestMongoStorage(t)
+	defer store.Close()
+
+	var err = store.CreateSeries("storage_test")
+	assert.Equal(nil, err, "Did not create a series")
+
+	record, err := store.LastRecord(context.Background(), "storage_test")
+	assert.Equal(nil, err, "Returned an error for an empty series")
+	assert.True(record == nil, "Returned a record for an empty series")
+
+	err = store.AppendRecord(context.Background(), "storage_test", Record{Timestamp: 1, Value: "a", Version: 0})
+	assert.Equal(nil, err, "Did not append a record 1")
+	err = store.AppendRecord(context.Background(), "storage_test", Record{Timestamp: 2, Value: "b", Version: 1})
+	assert.Equal(nil, err, "Did not append a record 2")
+
+	record, err = store.LastRecord(context.Background(), "storage_test")
+	assert.Equal(nil, err, "Did not return the last record")
+	assert.Equal(Record{Timestamp: 2, Value: "b", Version: 1}, *record, "Incorrect last record")
+
+	record, err = store.FindByValue(context.Background(), "storage_test", "a", 0)
+	assert.Equal(nil, err, "Did not find a record by value")
+	assert.Equal(int64(1), record.Timestamp, "Incorrect record found by value")
+
+	record, err = store.FindByValue(context.Background(), "storage_test", "a", 1)
+	assert.Equal(nil, err, "Returned an error for a missing value")
+	assert.True(record == nil, "Found a record with a different version")
+}
+
+func TestMongoStorageVersions(t *testing.T) {
+	var assert = assert.New(t)
+
+	var store = newTestMongoStorage(t)
+	defer store.Close()
+
+	version, err := store.LastVersion("query")
+	assert.Equal(nil, err, "Returned an error for a missing version")
+	assert.True(version == nil, "Returned a version for a new query")
+
+	err = store.AppendVersion(VersionRecord{Name: "query", Version: 0, Hash: "a"})
+	assert.Equal(nil, err, "Did not append a version 1")
+	err = store.AppendVersion(VersionRecord{Name: "query", Version: 1, Hash: "b"})
+	assert.Equal(nil, err, "Did not append a version 2")
+
+	version, err = store.LastVersion("query")
+	assert.Equal(nil, err, "Did not return the last version")
+	assert.Equal(int64(1), version.Version, "Incorrect last version")
+
+	version, err = store.FindVersionByHash("query", "a")
+	assert.Equal(nil, err, "Did not find a version by hash")
+	assert.Equal(int64(0), version.Version, "Incorrect version found by hash")
+}
+
+func TestMongoStorageArchive(t *testing.T) {
+	var assert = assert.New(t)
+
+	var store = newTestMongoStorage(t)
+	defer store.Close()
+
+	var err = store.ArchiveBody("hash", []byte("body"))
+	assert.Equal(nil, err, "Did not archive a body 1")
+	err = store.ArchiveBody("hash", []byte("body"))
+	assert.Equal(nil, err, "Did not skip an existing body")
+
+	body, err := store.LoadBody("hash")
+	assert.Equal(nil, err, "Did not load a body")
+	assert.Equal([]byte("body"), body, "Incorrect body")
+
+	_, err = store.LoadBody("missing")
+	assert.NotEqual(nil, err, "Did not return an error for a missing body")
+
+	err = store.AppendSnapshot(Snapshot{Name: "query", Timestamp: 2, Hash: "hash", Version: 0})
+	assert.Equal(nil, err, "Did not append a snapshot 1")
+	err = store.AppendSnapshot(Snapshot{Name: "query", Timestamp: 1, Hash: "hash", Version: 0})
+	assert.Equal(nil, err, "Did not append a snapshot 2")
+
+	snapshots, err := store.Snapshots("query")
+	assert.Equal(nil, err, "Did not return snapshots")
+	assert.Equal(2, len(snapshots), "Incorrect snapshots count")
+	assert.Equal(int64(1), snapshots[0].Timestamp, "Snapshots are not sorted")
+}
+
+func TestMongoStorageAlerts(t *testing.T) {
+	var assert = assert.New(t)
+
+	var store = newTestMongoStorage(t)
+	defer store.Close()
+
+	record, err := store.LastAlert("query", "above 10")
+	assert.Equal(nil, err, "Returned an error for a missing alert")
+	assert.True(record == nil, "Returned an alert for a new rule")
+
+	err = store.AppendAlert(AlertRecord{Timestamp: 1000, Name: "query", Rule: "above 10", State: "firing", Value: "11", Version: 1})
+	assert.Equal(nil, err, "Did not append an alert 1")
+	err = store.AppendAlert(AlertRecord{Timestamp: 2000, Name: "query", Rule: "above 10", State: "resolved", Value: "9", Version: 1})
+	assert.Equal(nil, err, "Did not append an alert 2")
+
+	record, err = store.LastAlert("query", "above 10")
+	assert.Equal(nil, err, "Did not return the last alert")
+	assert.Equal(AlertRecord{Timestamp: 2000, Name: "query", Rule: "above 10", State: "resolved", Value: "9", Version: 1}, *record, "Incorrect last alert")
+}
+
+func TestRecordFromRaw(t *testing.T) {
+	var assert = assert.New(t)
+
+	var raw, err = bson.Marshal(bson.D{{Key: "timestamp", Value: int64(10)}, {Key: "value", Value: "a"}, {Key: "version", Value: int64(1)}})
+	assert.Equal(nil, err, "Failed to marshal a document 1")
+	record, err := recordFromRaw(raw)
+	assert.Equal(nil, err, "Did not decode a regular record")
+	assert.Equal(Record{Timestamp: 10000, Value: "a", Version: 1}, record, "Incorrect legacy record")
+
+	raw, err = bson.Marshal(bson.D{{Key: "timestamp", Value: bson.NewDateTimeFromTime(time.Unix(20, 0))}, {Key: "value", Value: 12.5}, {Key: "version", Value: int64(2)}, {Key: "meta", Value: bson.D{{Key: "name", Value: "test"}}}})
+	assert.Equal(nil, err, "Failed to marshal a document 2")
+	record, err = recordFromRaw(raw)
+	assert.Equal(nil, err, "Did not decode a time-series record")
+	assert.Equal(Record{Timestamp: 20000, Value: "12.5", Version: 2}, record, "Incorrect time-series record")
+
+	var metadata = RecordMetadata{FetchDurationMilliseconds: 120, HttpStatus: 200, ResponseSize: 512, ContentHash: "hash", Backend: "go", Hostname: "host"}
+	raw, err = bson.Marshal(bson.D{{Key: "timestamp", Value: bson.DateTime(1500)}, {Key: "value", Value: "a"}, {Key: "version", Value: int64(0)}, {Key: "metadata", Value: metadata}})
+	assert.Equal(nil, err, "Failed to marshal a document 3")
+	record, err = recordFromRaw(raw)
+	assert.Equal(nil, err, "Did not decode a record with metadata")
+	assert.Equal(Record{Timestamp: 1500, Value: "a", Version: 0, Metadata: &metadata}, record, "Incorrect record with metadata")
+
+	raw, err = bson.Marshal(bson.D{{Key: "timestamp", Value: bson.DateTime(1500)}, {Key: "value", Value: "guid"}, {Key: "version", Value: int64(0)}, {Key: "fields", Value: map[string]string{"title": "a"}}})
+	assert.Equal(nil, err, "Failed to marshal a document 4")
+	record, err = recordFromRaw(raw)
+	assert.Equal(nil, err, "Did not decode a record with fields")
+	assert.Equal(Record{Timestamp: 1500, Value: "guid", Version: 0, Fields: map[string]string{"title": "a"}}, record, "Incorrect record with fields")
+
+	raw, err = bson.Marshal(bson.D{{Key: "timestamp", Value: "invalid"}, {Key: "value", Value: "a"}, {Key: "version", Value: int64(1)}})
+	assert.Equal(nil, err, "Failed to marshal a document 5")
+	_, err = recordFromRaw(raw)
+	assert.NotEqual(nil, err, "Did not return an error for an invalid timestamp")
+}
+
+func TestTimestampCondition(t *testing.T) {
+	var assert = assert.New(t)
+
+	var condition = timestampCondition("$gte", 1500)
+	assert.Equal(bson.E{Key: "$or", Value: bson.A{
+		bson.D{{Key: "timestamp", Value: bson.D{{Key: "$gte", Value: bson.DateTime(1500)}}}},
+		bson.D{{Key: "timestamp", Value: bson.D{{Key: "$gte", Value: int64(2)}}}},
+	}}, condition, "Incorrect range condition")
+
+	// Legacy timestamps can only be equal to whole seconds
+	condition = timestampCondition("$eq", 1500)
+	assert.Equal(1, len(condition.Value.(bson.A)), "Incorrect equality condition")
+}
+
+func TestMongoStorageTimeSeries(t *testing.T) {
+	var assert = assert.New(t)
+
+	var store = newTestMongoStorage(t)
+	defer store.Close()
+	store.db.DropCollection("storage_timeseries")
+	store.db.DropCollection("storage_timeseries_legacy")
+
+	// Start from a regular collection to validate the migration
+	var err = store.CreateSeries("storage_timeseries")
+	assert.Equal(nil, err, "Did not create a series")
+	err = store.AppendRecord(context.Background(), "storage_timeseries", Record{Timestamp: 1, Value: "1.5", Version: 0})
+	assert.Equal(nil, err, "Did not append a regular record")
+
+	err = store.CreateTimeSeries("storage_timeseries", TimeSeriesOptions{Granularity: "seconds"})
+	assert.NotEqual(nil, err, "Was able to use a regular collection as a time series")
+
+	err = store.MigrateToTimeSeries("storage_timeseries", TimeSeriesOptions{Granularity: "seconds"})
+	assert.Equal(nil, err, "Did not migrate a collection")
+	_, collectionType, err := store.db.GetCollectionType("storage_timeseries")
+	assert.Equal(nil, err, "Did not return the collection type")
+	assert.Equal("timeseries", collectionType, "Collection was not converted")
+
+	err = store.AppendRecord(context.Background(), "storage_timeseries", Record{Timestamp: 2, Value: "3", Version: 0})
+	assert.Equal(nil, err, "Did not append a time-series record")
+	err = store.AppendRecord(context.Background(), "storage_timeseries", Record{Timestamp: 3, Value: "not a number", Version: 0})
+	assert.NotEqual(nil, err, "Was able to append a non-numeric value")
+
+	record, err := store.LastRecord(context.Background(), "storage_timeseries")
+	assert.Equal(nil, err, "Did not return the last record")
+	assert.Equal(Record{Timestamp: 2, Value: "3", Version: 0}, *record, "Incorrect last record")
+
+	record, err = store.FindByValue(context.Background(), "storage_timeseries", "1.5", 0)
+	assert.Equal(nil, err, "Did not find a migrated record")
+	assert.Equal(int64(1), record.Timestamp, "Incorrect migrated record")
+}
+
+func TestMongoStorageMigrationValidation(t *testing.T) {
+	var assert = assert.New(t)
+
+	var store = newTestMongoStorage(t)
+	defer store.Close()
+	store.db.DropCollection("storage_migration")
+	store.db.DropCollection("storage_migration_legacy")
+
+	var err = store.CreateSeries("storage_migration")
+	assert.Equal(nil, err, "Did not create a series")
+	store.AppendRecord(context.Background(), "storage_migration", Record{Timestamp: 1000, Value: "1", Version: 0})
+	store.AppendRecord(context.Background(), "storage_migration", Record{Timestamp: 2000, Value: "not a number", Version: 0})
+
+	// The collection is not renamed if a record can not be converted
+	err = store.MigrateToTimeSeries("storage_migration", TimeSeriesOptions{Granularity: "seconds"})
+	assert.NotEqual(nil, err, "Migrated a non-numeric value")
+	_, collectionType, err := store.db.GetCollectionType("storage_migration")
+	assert.Equal(nil, err, "Returned an error 1")
+	assert.Equal("collection", collectionType, "Changed the collection")
+	legacyExists, _, err := store.db.GetCollectionType("storage_migration_legacy")
+	assert.Equal(nil, err, "Returned an error 2")
+	assert.False(legacyExists, "Renamed the collection")
+
+	// A migration stopped after the rename is resumed
+	store.db.DeleteMany("storage_migration", bson.D{{Key: "value", Value: "not a number"}})
+	err = store.db.RenameCollection("storage_migration", "storage_migration_legacy")
+	assert.Equal(nil, err, "Did not rename the collection")
+	err = store.MigrateToTimeSeries("storage_migration", TimeSeriesOptions{Granularity: "seconds"})
+	assert.Equal(nil, err, "Did not resume the migration")
+	record, err := store.LastRecord(context.Background(), "storage_migration")
+	assert.Equal(nil, err, "Returned an error 3")
+	assert.Equal(Record{Timestamp: 1000, Value: "1", Version: 0}, *record, "Did not migrate the records")
+	legacyExists, _, err = store.db.GetCollectionType("storage_migration_legacy")
+	assert.Equal(nil, err, "Returned an error 4")
+	assert.False(legacyExists, "Did not drop the legacy collection")
+}
+
+func TestMongoStorageMigrationInterrupted(t *testing.T) {
+	var assert = assert.New(t)
+
+	var store = newTestMongoStorage(t)
+	defer store.Close()
+	store.db.DropCollection("storage_interrupted")
+	store.db.DropCollection("storage_interrupted_legacy")
+
+	var err = store.CreateSeries("storage_interrupted")
+	assert.Equal(nil, err, "Did not create a series")
+	for _, timestamp := range []int64{1000, 2000, 3000} {
+		store.AppendRecord(context.Background(), "storage_interrupted", Record{Timestamp: timestamp, Value: "1", Version: 0})
+	}
+
+	// The migration stopped after copying the first record, then the tracker wrote a new one
+	err = store.db.RenameCollection("storage_interrupted", "storage_interrupted_legacy")
+	assert.Equal(nil, err, "Did not rename the collection")
+	err = store.CreateTimeSeries("storage_interrupted", TimeSeriesOptions{Granularity: "seconds"})
+	assert.Equal(nil, err, "Did not create a time series")
+	store.AppendRecord(context.Background(), "storage_interrupted", Record{Timestamp: 1000, Value: "1", Version: 0})
+	store.AppendRecord(context.Background(), "storage_interrupted", Record{Timestamp: 4000, Value: "2", Version: 0})
+
+	err = store.MigrateToTimeSeries("storage_interrupted", TimeSeriesOptions{Granularity: "seconds"})
+	assert.Equal(nil, err, "Did not resume the migration")
+	records, err := store.RecordsBetween("storage_interrupted", 0, 5000)
+	assert.Equal(nil, err, "Returned an error 1")
+	var timestamps = []int64{}
+	for _, record := range records {
+		timestamps = append(timestamps, record.Timestamp)
+	}
+	assert.Equal([]int64{1000, 2000, 3000, 4000}, timestamps, "Did not copy the remaining records once")
+	legacyExists, _, err := store.db.GetCollectionType("storage_interrupted_legacy")
+	assert.Equal(nil, err, "Returned an error 2")
+	assert.False(legacyExists, "Did not drop the legacy collection")
+}
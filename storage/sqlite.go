@@ -0,0 +1,361 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	_ "modernc.org/sqlite"
+)
+
+type SqliteConfig struct {
+	Path                   string
+	VersionCollectionName  string
+	ArchiveCollectionName  string
+	SnapshotCollectionName string
+	ErrorCollectionName    string
+	AlertCollectionName    string
+}
+
+type SqliteStorage struct {
+	db     *sql.DB
+	config SqliteConfig
+}
+
+// Increased whenever the layout of the existing tables changes
+const sqliteSchemaVersion = 2
+
+var recordMetadataColumns = "fetch_duration_ms INTEGER, http_status INTEGER, response_size INTEGER, content_hash TEXT, backend TEXT, hostname TEXT"
+
+// Fields are stored as a JSON object
+var recordFieldsColumn = "fields TEXT"
+
+func quoteIdentifier(name string) string {
+	return "\"" + strings.ReplaceAll(name, "\"", "\"\"") + "\""
+}
+
+func NewSqliteStorage(config SqliteConfig) (result *SqliteStorage, err error) {
+	db, err := sql.Open("sqlite", config.Path)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows only a single writer, serialize the access instead of failing with "database is locked"
+	db.SetMaxOpenConns(1)
+	result = &SqliteStorage{db: db, config: config}
+
+	err = result.migrate()
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to migrate the database: %w", err)
+	}
+
+	var statements = []string{
+		"CREATE TABLE IF NOT EXISTS " + quoteIdentifier(config.VersionCollectionName) + " (name TEXT NOT NULL, version INTEGER NOT NULL, hash TEXT NOT NULL)",
+		"CREATE INDEX IF NOT EXISTS " + quoteIdentifier(config.VersionCollectionName+"_name") + " ON " + quoteIdentifier(config.VersionCollectionName) + " (name, version)",
+		"CREATE TABLE IF NOT EXISTS " + quoteIdentifier(config.ArchiveCollectionName) + " (hash TEXT PRIMARY KEY, body BLOB NOT NULL)",
+		"CREATE TABLE IF NOT EXISTS " + quoteIdentifier(config.SnapshotCollectionName) + " (name TEXT NOT NULL, timestamp INTEGER NOT NULL, hash TEXT NOT NULL, version INTEGER NOT NULL)",
+		"CREATE TABLE IF NOT EXISTS " + quoteIdentifier(config.ErrorCollectionName) + " (name TEXT NOT NULL, timestamp INTEGER NOT NULL, stage TEXT NOT NULL, message TEXT NOT NULL, version INTEGER NOT NULL, repeated INTEGER NOT NULL)",
+		"CREATE TABLE IF NOT EXISTS " + quoteIdentifier(config.AlertCollectionName) + " (name TEXT NOT NULL, rule TEXT NOT NULL, timestamp INTEGER NOT NULL, state TEXT NOT NULL, value TEXT NOT NULL, version INTEGER NOT NULL)",
+	}
+	for _, statement := range statements {
+		_, err = db.Exec(statement)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func (s *SqliteStorage) migrate() (err error) {
+	var version int
+	err = s.db.QueryRow("PRAGMA user_version").Scan(&version)
+	if err != nil || version >= sqliteSchemaVersion {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Tables with timestamps are either series (with the id and the value), rollups or internal collections
+	rows, err := tx.Query("SELECT m.name, SUM(c.name IN ('id', 'value')) = 2 FROM sqlite_master m JOIN pragma_table_info(m.name) c WHERE m.type = 'table' GROUP BY m.name HAVING SUM(c.name = 'timestamp') > 0")
+	if err != nil {
+		return err
+	}
+	var tables = map[string]bool{}
+	for rows.Next() {
+		var name string
+		var isSeries bool
+		err = rows.Scan(&name, &isSeries)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		tables[name] = isSeries
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	// Errors and alerts were always stored in milliseconds
+	var internal = map[string]bool{s.config.VersionCollectionName: true, s.config.ArchiveCollectionName: true, s.config.ErrorCollectionName: true, s.config.AlertCollectionName: true}
+	for name, isSeries := range tables {
+		if internal[name] {
+			continue
+		}
+		// Snapshots are converted with the series but have no value columns
+		isSeries = isSeries && name != s.config.SnapshotCollectionName
+		var columns []string
+		// Version 1: timestamps are stored in milliseconds instead of seconds and records carry the fetch metadata
+		if version < 1 {
+			_, err = tx.Exec("UPDATE " + quoteIdentifier(name) + " SET timestamp = timestamp * 1000")
+			if err != nil {
+				return err
+			}
+			columns = append(columns, strings.Split(recordMetadataColumns, ", ")...)
+		}
+		// Version 2: records carry the fields of the structured values
+		if version < 2 {
+			columns = append(columns, recordFieldsColumn)
+		}
+		if !isSeries {
+			continue
+		}
+		for _, column := range columns {
+			_, err = tx.Exec("ALTER TABLE " + quoteIdentifier(name) + " ADD COLUMN " + column)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %v", sqliteSchemaVersion))
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SqliteStorage) queryRecord(ctx context.Context, query string, args ...any) (*Record, error) {
+	var record Record
+	var err = s.db.QueryRowContext(ctx, query, args...).Scan(&record.Timestamp, &record.Value, &record.Version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+func (s *SqliteStorage) queryVersion(query string, args ...any) (*VersionRecord, error) {
+	var record VersionRecord
+	var err = s.db.QueryRow(query, args...).Scan(&record.Name, &record.Version, &record.Hash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+func (s *SqliteStorage) CreateSeries(name string) error {
+	var statements = []string{
+		"CREATE TABLE IF NOT EXISTS " + quoteIdentifier(name) + " (id INTEGER PRIMARY KEY AUTOINCREMENT, timestamp INTEGER NOT NULL, value TEXT NOT NULL, version INTEGER NOT NULL, " + recordMetadataColumns + ", " + recordFieldsColumn + ")",
+		// Used by LastRecord and FindByValue, also created for the series of the older versions
+		"CREATE INDEX IF NOT EXISTS " + quoteIdentifier(name+"_timestamp") + " ON " + quoteIdentifier(name) + " (timestamp, id)",
+		"CREATE INDEX IF NOT EXISTS " + quoteIdentifier(name+"_value") + " ON " + quoteIdentifier(name) + " (value, version)",
+	}
+	for _, statement := range statements {
+		_, err := s.db.Exec(statement)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SqliteStorage) AppendRecord(ctx context.Context, series string, record Record) error {
+	var fields any
+	if len(record.Fields) > 0 {
+		encoded, err := json.Marshal(record.Fields)
+		if err != nil {
+			return err
+		}
+		fields = string(encoded)
+	}
+
+	if record.Metadata == nil {
+		_, err := s.db.ExecContext(ctx, "INSERT INTO "+quoteIdentifier(series)+" (timestamp, value, version, fields) VALUES (?, ?, ?, ?)", record.Timestamp, record.Value, record.Version, fields)
+		return err
+	}
+
+	var metadata = record.Metadata
+	_, err := s.db.ExecContext(ctx, "INSERT INTO "+quoteIdentifier(series)+" (timestamp, value, version, fetch_duration_ms, http_status, response_size, content_hash, backend, hostname, fields) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		record.Timestamp, record.Value, record.Version,
+		metadata.FetchDurationMilliseconds, metadata.HttpStatus, metadata.ResponseSize, metadata.ContentHash, metadata.Backend, metadata.Hostname, fields)
+	return err
+}
+
+func (s *SqliteStorage) LastRecord(ctx context.Context, series string) (*Record, error) {
+	return s.queryRecord(ctx, "SELECT timestamp, value, version FROM "+quoteIdentifier(series)+" ORDER BY timestamp DESC, id DESC LIMIT 1")
+}
+
+func (s *SqliteStorage) FindByValue(ctx context.Context, series string, value string, version int64) (*Record, error) {
+	return s.queryRecord(ctx, "SELECT timestamp, value, version FROM "+quoteIdentifier(series)+" WHERE value = ? AND version = ? ORDER BY timestamp DESC, id DESC LIMIT 1", value, version)
+}
+
+// The JSON path of the field, the same expression has to be used by the index and the queries
+func fieldExpression(field string) string {
+	return "json_extract(fields, '$." + strings.ReplaceAll(field, "'", "''") + "')"
+}
+
+func (s *SqliteStorage) CreateFieldIndex(series string, field string) error {
+	_, err := s.db.Exec("CREATE INDEX IF NOT EXISTS " + quoteIdentifier(series+"_field_"+field) + " ON " + quoteIdentifier(series) + " (" + fieldExpression(field) + ", timestamp, id)")
+	return err
+}
+
+func (s *SqliteStorage) LastRecordByField(ctx context.Context, series string, field string, value string) (*Record, error) {
+	return s.queryRecord(ctx, "SELECT timestamp, value, version FROM "+quoteIdentifier(series)+" WHERE "+fieldExpression(field)+" = ? ORDER BY timestamp DESC, id DESC LIMIT 1", value)
+}
+
+func (s *SqliteStorage) LastVersion(name string) (*VersionRecord, error) {
+	return s.queryVersion("SELECT name, version, hash FROM "+quoteIdentifier(s.config.VersionCollectionName)+" WHERE name = ? ORDER BY version DESC LIMIT 1", name)
+}
+
+func (s *SqliteStorage) FindVersionByHash(name string, hash string) (*VersionRecord, error) {
+	return s.queryVersion("SELECT name, version, hash FROM "+quoteIdentifier(s.config.VersionCollectionName)+" WHERE name = ? AND hash = ? ORDER BY version DESC LIMIT 1", name, hash)
+}
+
+func (s *SqliteStorage) AppendVersion(record VersionRecord) error {
+	_, err := s.db.Exec("INSERT INTO "+quoteIdentifier(s.config.VersionCollectionName)+" (name, version, hash) VALUES (?, ?, ?)", record.Name, record.Version, record.Hash)
+	return err
+}
+
+func (s *SqliteStorage) AppendError(record ErrorRecord) error {
+	_, err := s.db.Exec("INSERT INTO "+quoteIdentifier(s.config.ErrorCollectionName)+" (name, timestamp, stage, message, version, repeated) VALUES (?, ?, ?, ?, ?, ?)",
+		record.Name, record.Timestamp, record.Stage, record.Message, record.Version, record.Repeated)
+	return err
+}
+
+func (s *SqliteStorage) AppendAlert(record AlertRecord) error {
+	_, err := s.db.Exec("INSERT INTO "+quoteIdentifier(s.config.AlertCollectionName)+" (name, rule, timestamp, state, value, version) VALUES (?, ?, ?, ?, ?, ?)",
+		record.Name, record.Rule, record.Timestamp, record.State, record.Value, record.Version)
+	return err
+}
+
+func (s *SqliteStorage) LastAlert(name string, rule string) (*AlertRecord, error) {
+	var record AlertRecord
+	var err = s.db.QueryRow("SELECT name, rule, timestamp, state, value, version FROM "+quoteIdentifier(s.config.AlertCollectionName)+" WHERE name = ? AND rule = ? ORDER BY rowid DESC LIMIT 1", name, rule).
+		Scan(&record.Name, &record.Rule, &record.Timestamp, &record.State, &record.Value, &record.Version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+func (s *SqliteStorage) Close() error {
+	return s.db.Close()
+}
+
+func (s *SqliteStorage) ArchiveBody(hash string, body []byte) error {
+	_, err := s.db.Exec("INSERT OR IGNORE INTO "+quoteIdentifier(s.config.ArchiveCollectionName)+" (hash, body) VALUES (?, ?)", hash, body)
+	return err
+}
+
+func (s *SqliteStorage) LoadBody(hash string) (body []byte, err error) {
+	err = s.db.QueryRow("SELECT body FROM "+quoteIdentifier(s.config.ArchiveCollectionName)+" WHERE hash = ?", hash).Scan(&body)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errors.New("archived body not found: " + hash)
+	}
+	return
+}
+
+func (s *SqliteStorage) AppendSnapshot(snapshot Snapshot) error {
+	_, err := s.db.Exec("INSERT INTO "+quoteIdentifier(s.config.SnapshotCollectionName)+" (name, timestamp, hash, version) VALUES (?, ?, ?, ?)", snapshot.Name, snapshot.Timestamp, snapshot.Hash, snapshot.Version)
+	return err
+}
+
+func (s *SqliteStorage) Snapshots(name string) (result []Snapshot, err error) {
+	rows, err := s.db.Query("SELECT name, timestamp, hash, version FROM "+quoteIdentifier(s.config.SnapshotCollectionName)+" WHERE name = ? ORDER BY timestamp", name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var snapshot Snapshot
+		err = rows.Scan(&snapshot.Name, &snapshot.Timestamp, &snapshot.Hash, &snapshot.Version)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, snapshot)
+	}
+	return result, rows.Err()
+}
+
+func (s *SqliteStorage) FindByTimestamp(series string, timestamp int64, version int64) (*Record, error) {
+	return s.queryRecord(context.Background(), "SELECT timestamp, value, version FROM "+quoteIdentifier(series)+" WHERE timestamp = ? AND version = ? LIMIT 1", timestamp, version)
+}
+
+func (s *SqliteStorage) RecordsBetween(series string, from int64, to int64) (result []Record, err error) {
+	rows, err := s.db.Query("SELECT timestamp, value, version FROM "+quoteIdentifier(series)+" WHERE timestamp >= ? AND timestamp < ? ORDER BY timestamp, id", from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var record Record
+		err = rows.Scan(&record.Timestamp, &record.Value, &record.Version)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, record)
+	}
+	return result, rows.Err()
+}
+
+func (s *SqliteStorage) FirstRecord(series string) (*Record, error) {
+	return s.queryRecord(context.Background(), "SELECT timestamp, value, version FROM "+quoteIdentifier(series)+" ORDER BY timestamp, id LIMIT 1")
+}
+
+func (s *SqliteStorage) DeleteBefore(series string, timestamp int64) error {
+	_, err := s.db.Exec("DELETE FROM "+quoteIdentifier(series)+" WHERE timestamp < ?", timestamp)
+	return err
+}
+
+func (s *SqliteStorage) CreateRollupSeries(name string) error {
+	_, err := s.db.Exec("CREATE TABLE IF NOT EXISTS " + quoteIdentifier(name) + " (timestamp INTEGER NOT NULL, version INTEGER NOT NULL, min REAL NOT NULL, max REAL NOT NULL, avg REAL NOT NULL, last REAL NOT NULL, count INTEGER NOT NULL)")
+	return err
+}
+
+func (s *SqliteStorage) AppendRollup(series string, rollup Rollup) error {
+	_, err := s.db.Exec("INSERT INTO "+quoteIdentifier(series)+" (timestamp, version, min, max, avg, last, count) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		rollup.Timestamp, rollup.Version, rollup.Min, rollup.Max, rollup.Avg, rollup.Last, rollup.Count)
+	return err
+}
+
+func (s *SqliteStorage) LastRollup(series string) (*Rollup, error) {
+	var rollup Rollup
+	var err = s.db.QueryRow("SELECT timestamp, version, min, max, avg, last, count FROM "+quoteIdentifier(series)+" ORDER BY timestamp DESC LIMIT 1").
+		Scan(&rollup.Timestamp, &rollup.Version, &rollup.Min, &rollup.Max, &rollup.Avg, &rollup.Last, &rollup.Count)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &rollup, nil
+}
@@ -0,0 +1,283 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestSqliteStorage(t *testing.T) *SqliteStorage {
+	var store, err = NewSqliteStorage(SqliteConfig{
+		Path:                   filepath.Join(t.TempDir(), "test.db"),
+		VersionCollectionName:  "_version",
+		ArchiveCollectionName:  "_archive",
+		SnapshotCollectionName: "_snapshots",
+		ErrorCollectionName:    "_errors",
+		AlertCollectionName:    "_alerts",
+	})
+	assert.Equal(t, nil, err, "Did not open a database")
+	return store
+}
+
+func TestSqliteStorageRecords(t *testing.T) {
+	var assert = assert.New(t)
+
+	var store = newTestSqliteStorage(t)
+	defer store.Close()
+
+	var err = store.CreateSeries("test")
+	assert.Equal(nil, err, "Did not create a series 1")
+	err = store.CreateSeries("test")
+	assert.Equal(nil, err, "Did not skip an existing series")
+	err = store.CreateSeries("quoted \"name\"")
+	assert.Equal(nil, err, "Did not create a series 2")
+
+	record, err := store.LastRecord(context.Background(), "test")
+	assert.Equal(nil, err, "Returned an error for an empty series")
+	assert.True(record == nil, "Returned a record for an empty series")
+
+	err = store.AppendRecord(context.Background(), "test", Record{Timestamp: 1, Value: "a", Version: 0})
+	assert.Equal(nil, err, "Did not append a record 1")
+	err = store.AppendRecord(context.Background(), "test", Record{Timestamp: 2, Value: "b", Version: 1})
+	assert.Equal(nil, err, "Did not append a record 2")
+	err = store.AppendRecord(context.Background(), "test", Record{Timestamp: 2, Value: "c", Version: 1})
+	assert.Equal(nil, err, "Did not append a record 3")
+
+	record, err = store.LastRecord(context.Background(), "test")
+	assert.Equal(nil, err, "Did not return the last record")
+	assert.Equal(Record{Timestamp: 2, Value: "c", Version: 1}, *record, "Incorrect last record")
+
+	record, err = store.FindByValue(context.Background(), "test", "a", 0)
+	assert.Equal(nil, err, "Did not find a record by value")
+	assert.Equal(int64(1), record.Timestamp, "Incorrect record found by value")
+
+	record, err = store.FindByValue(context.Background(), "test", "a", 1)
+	assert.Equal(nil, err, "Returned an error for a missing value")
+	assert.True(record == nil, "Found a record with a different version")
+
+	record, err = store.FindByTimestamp("test", 2, 1)
+	assert.Equal(nil, err, "Did not find a record by timestamp")
+	assert.Equal("b", record.Value, "Incorrect record found by timestamp")
+
+	var metadata = RecordMetadata{FetchDurationMilliseconds: 120, HttpStatus: 200, ResponseSize: 512, ContentHash: "hash", Backend: "go", Hostname: "host"}
+	err = store.AppendRecord(context.Background(), "test", Record{Timestamp: 3, Value: "d", Version: 1, Metadata: &metadata})
+	assert.Equal(nil, err, "Did not append a record with metadata")
+	var status int
+	err = store.db.QueryRow("SELECT http_status FROM test WHERE timestamp = 3").Scan(&status)
+	assert.Equal(nil, err, "Did not store the metadata")
+	assert.Equal(200, status, "Incorrect metadata stored")
+
+	err = store.AppendRecord(context.Background(), "missing", Record{})
+	assert.NotEqual(nil, err, "Was able to write to a missing series")
+}
+
+func TestSqliteStorageIndexes(t *testing.T) {
+	var assert = assert.New(t)
+
+	var store = newTestSqliteStorage(t)
+	defer store.Close()
+	var err = store.CreateSeries("test")
+	assert.Equal(nil, err, "Did not create a series")
+	err = store.CreateFieldIndex("test", "url")
+	assert.Equal(nil, err, "Did not create a field index")
+
+	// The queries of LastRecord, FindByValue, LastRecordByField and LastVersion must not scan the whole table
+	for _, query := range []string{
+		"SELECT timestamp, value, version FROM test ORDER BY timestamp DESC, id DESC LIMIT 1",
+		"SELECT timestamp, value, version FROM test WHERE " + fieldExpression("url") + " = 'a' ORDER BY timestamp DESC, id DESC LIMIT 1",
+		"SELECT timestamp, value, version FROM test WHERE value = 'a' AND version = 0 ORDER BY timestamp DESC, id DESC LIMIT 1",
+		"SELECT name, version, hash FROM _version WHERE name = 'test' ORDER BY version DESC LIMIT 1",
+	} {
+		var id, parent, unused int
+		var detail string
+		err = store.db.QueryRow("EXPLAIN QUERY PLAN "+query).Scan(&id, &parent, &unused, &detail)
+		assert.Equal(nil, err, "Did not explain the query "+query)
+		assert.Contains(detail, "USING INDEX", "Did not use an index for "+query)
+	}
+}
+
+func TestSqliteStorageFieldSearch(t *testing.T) {
+	var assert = assert.New(t)
+
+	var store = newTestSqliteStorage(t)
+	defer store.Close()
+	store.CreateSeries("test")
+	store.AppendRecord(context.Background(), "test", Record{Timestamp: 1000, Value: "1", Fields: map[string]string{"url": "a"}})
+	store.AppendRecord(context.Background(), "test", Record{Timestamp: 2000, Value: "2", Fields: map[string]string{"url": "b"}})
+	store.AppendRecord(context.Background(), "test", Record{Timestamp: 3000, Value: "3", Fields: map[string]string{"url": "a"}})
+
+	record, err := store.LastRecordByField(context.Background(), "test", "url", "a")
+	assert.Equal(nil, err, "Returned an error 1")
+	assert.Equal("3", record.Value, "Incorrect last record of the field")
+	record, err = store.LastRecordByField(context.Background(), "test", "url", "c")
+	assert.Equal(nil, err, "Returned an error 2")
+	assert.True(record == nil, "Returned a record for a missing field value")
+}
+
+func TestSqliteStorageErrors(t *testing.T) {
+	var assert = assert.New(t)
+
+	var store = newTestSqliteStorage(t)
+	defer store.Close()
+
+	var err = store.AppendError(ErrorRecord{Timestamp: 1000, Name: "test", Stage: "fetch", Message: "timeout", Version: 1, Repeated: 3})
+	assert.Equal(nil, err, "Did not append an error")
+	var record ErrorRecord
+	err = store.db.QueryRow("SELECT timestamp, name, stage, message, version, repeated FROM _errors").
+		Scan(&record.Timestamp, &record.Name, &record.Stage, &record.Message, &record.Version, &record.Repeated)
+	assert.Equal(nil, err, "Did not store the error")
+	assert.Equal(ErrorRecord{Timestamp: 1000, Name: "test", Stage: "fetch", Message: "timeout", Version: 1, Repeated: 3}, record, "Incorrect error stored")
+}
+
+func TestSqliteStorageAlerts(t *testing.T) {
+	var assert = assert.New(t)
+
+	var store = newTestSqliteStorage(t)
+	defer store.Close()
+
+	record, err := store.LastAlert("test", "above 10")
+	assert.Equal(nil, err, "Returned an error for a missing alert")
+	assert.True(record == nil, "Returned an alert for a new rule")
+
+	err = store.AppendAlert(AlertRecord{Timestamp: 1000, Name: "test", Rule: "above 10", State: "firing", Value: "11", Version: 1})
+	assert.Equal(nil, err, "Did not append an alert 1")
+	err = store.AppendAlert(AlertRecord{Timestamp: 1000, Name: "test", Rule: "above 10", State: "resolved", Value: "9", Version: 1})
+	assert.Equal(nil, err, "Did not append an alert 2")
+	err = store.AppendAlert(AlertRecord{Timestamp: 2000, Name: "test", Rule: "below 5", State: "firing", Value: "4", Version: 1})
+	assert.Equal(nil, err, "Did not append an alert 3")
+
+	record, err = store.LastAlert("test", "above 10")
+	assert.Equal(nil, err, "Did not return the last alert")
+	assert.Equal(AlertRecord{Timestamp: 1000, Name: "test", Rule: "above 10", State: "resolved", Value: "9", Version: 1}, *record, "Incorrect last alert")
+}
+
+func TestSqliteStorageMigration(t *testing.T) {
+	var assert = assert.New(t)
+
+	// Database created by an older version with the timestamps in seconds
+	var path = filepath.Join(t.TempDir(), "test.db")
+	var db, err = sql.Open("sqlite", path)
+	assert.Equal(nil, err, "Did not open a database")
+	var statements = []string{
+		"CREATE TABLE test (id INTEGER PRIMARY KEY AUTOINCREMENT, timestamp INTEGER NOT NULL, value TEXT NOT NULL, version INTEGER NOT NULL)",
+		"CREATE TABLE _snapshots (name TEXT NOT NULL, timestamp INTEGER NOT NULL, hash TEXT NOT NULL, version INTEGER NOT NULL)",
+		"INSERT INTO test (timestamp, value, version) VALUES (10, 'a', 0)",
+		"INSERT INTO _snapshots (name, timestamp, hash, version) VALUES ('test', 10, 'hash', 0)",
+	}
+	for _, statement := range statements {
+		_, err = db.Exec(statement)
+		assert.Equal(nil, err, "Did not prepare the database")
+	}
+	db.Close()
+
+	for i := 0; i < 2; i++ {
+		store, err := NewSqliteStorage(SqliteConfig{Path: path, VersionCollectionName: "_version", ArchiveCollectionName: "_archive", SnapshotCollectionName: "_snapshots", ErrorCollectionName: "_errors", AlertCollectionName: "_alerts"})
+		assert.Equal(nil, err, "Did not migrate the database")
+
+		// The migration is applied only once
+		record, err := store.LastRecord(context.Background(), "test")
+		assert.Equal(nil, err, "Did not return the last record")
+		assert.Equal(Record{Timestamp: 10000, Value: "a", Version: 0}, *record, "Incorrect migrated record")
+		snapshots, err := store.Snapshots("test")
+		assert.Equal(nil, err, "Did not return the snapshots")
+		assert.Equal(int64(10000), snapshots[0].Timestamp, "Incorrect migrated snapshot")
+
+		err = store.AppendRecord(context.Background(), "test", Record{Timestamp: 20000, Value: "b", Version: 0, Metadata: &RecordMetadata{Backend: "go"}, Fields: map[string]string{"title": "b"}})
+		assert.Equal(nil, err, "Did not append a record with metadata")
+		store.db.Exec("DELETE FROM test WHERE timestamp = 20000")
+		store.Close()
+	}
+
+	// Database of the version 1 already has the timestamps in milliseconds
+	path = filepath.Join(t.TempDir(), "test.db")
+	db, err = sql.Open("sqlite", path)
+	assert.Equal(nil, err, "Did not open a database")
+	statements = []string{
+		"CREATE TABLE test (id INTEGER PRIMARY KEY AUTOINCREMENT, timestamp INTEGER NOT NULL, value TEXT NOT NULL, version INTEGER NOT NULL, " + recordMetadataColumns + ")",
+		"INSERT INTO test (timestamp, value, version) VALUES (10000, 'a', 0)",
+		"CREATE TABLE _alerts (name TEXT NOT NULL, rule TEXT NOT NULL, timestamp INTEGER NOT NULL, state TEXT NOT NULL, value TEXT NOT NULL, version INTEGER NOT NULL)",
+		"PRAGMA user_version = 1",
+	}
+	for _, statement := range statements {
+		_, err = db.Exec(statement)
+		assert.Equal(nil, err, "Did not prepare the database")
+	}
+	db.Close()
+
+	store, err := NewSqliteStorage(SqliteConfig{Path: path, VersionCollectionName: "_version", ArchiveCollectionName: "_archive", SnapshotCollectionName: "_snapshots", ErrorCollectionName: "_errors", AlertCollectionName: "_alerts"})
+	assert.Equal(nil, err, "Did not migrate the database")
+	defer store.Close()
+	record, err := store.LastRecord(context.Background(), "test")
+	assert.Equal(nil, err, "Did not return the last record")
+	assert.Equal(int64(10000), record.Timestamp, "Timestamps were converted again")
+	err = store.AppendRecord(context.Background(), "test", Record{Timestamp: 20000, Value: "b", Version: 0, Fields: map[string]string{"title": "b"}})
+	assert.Equal(nil, err, "Did not append a record with fields")
+	var fields string
+	err = store.db.QueryRow("SELECT fields FROM test WHERE timestamp = 20000").Scan(&fields)
+	assert.Equal(nil, err, "Did not store the fields")
+	assert.Equal(`{"title":"b"}`, fields, "Incorrect fields")
+
+	// Only the series tables are changed
+	var columns int
+	err = store.db.QueryRow("SELECT COUNT(*) FROM pragma_table_info('_alerts')").Scan(&columns)
+	assert.Equal(nil, err, "Did not return the columns")
+	assert.Equal(6, columns, "Changed the alerts table")
+}
+
+func TestSqliteStorageVersions(t *testing.T) {
+	var assert = assert.New(t)
+
+	var store = newTestSqliteStorage(t)
+	defer store.Close()
+
+	version, err := store.LastVersion("query")
+	assert.Equal(nil, err, "Returned an error for a missing version")
+	assert.True(version == nil, "Returned a version for a new query")
+
+	err = store.AppendVersion(VersionRecord{Name: "query", Version: 0, Hash: "a"})
+	assert.Equal(nil, err, "Did not append a version 1")
+	err = store.AppendVersion(VersionRecord{Name: "query", Version: 1, Hash: "b"})
+	assert.Equal(nil, err, "Did not append a version 2")
+	err = store.AppendVersion(VersionRecord{Name: "other", Version: 5, Hash: "a"})
+	assert.Equal(nil, err, "Did not append a version 3")
+
+	version, err = store.LastVersion("query")
+	assert.Equal(nil, err, "Did not return the last version")
+	assert.Equal(VersionRecord{Name: "query", Version: 1, Hash: "b"}, *version, "Incorrect last version")
+
+	version, err = store.FindVersionByHash("query", "a")
+	assert.Equal(nil, err, "Did not find a version by hash")
+	assert.Equal(int64(0), version.Version, "Incorrect version found by hash")
+}
+
+func TestSqliteStorageArchive(t *testing.T) {
+	var assert = assert.New(t)
+
+	var store = newTestSqliteStorage(t)
+	defer store.Close()
+
+	var err = store.ArchiveBody("hash", []byte("body"))
+	assert.Equal(nil, err, "Did not archive a body 1")
+	err = store.ArchiveBody("hash", []byte("other"))
+	assert.Equal(nil, err, "Did not skip an existing body")
+
+	body, err := store.LoadBody("hash")
+	assert.Equal(nil, err, "Did not load a body")
+	assert.Equal([]byte("body"), body, "Incorrect body")
+
+	_, err = store.LoadBody("missing")
+	assert.NotEqual(nil, err, "Did not return an error for a missing body")
+
+	err = store.AppendSnapshot(Snapshot{Name: "query", Timestamp: 2, Hash: "hash", Version: 0})
+	assert.Equal(nil, err, "Did not append a snapshot 1")
+	err = store.AppendSnapshot(Snapshot{Name: "query", Timestamp: 1, Hash: "hash", Version: 0})
+	assert.Equal(nil, err, "Did not append a snapshot 2")
+
+	snapshots, err := store.Snapshots("query")
+	assert.Equal(nil, err, "Did not return snapshots")
+	assert.Equal(2, len(snapshots), "Incorrect snapshots count")
+	assert.Equal(int64(1), snapshots[0].Timestamp, "Snapshots are not sorted")
+}
@@ -0,0 +1,174 @@
+package storage
+
+import "context"
+
+type Record struct {
+	// Milliseconds since the Unix epoch
+	Timestamp int64           `json:"timestamp"`
+	Value     string          `json:"value"`
+	Version   int64           `json:"version"`
+	Metadata  *RecordMetadata `json:"metadata,omitempty"`
+	// Named parts of a structured value, e.g. the title and link of a feed item
+	Fields map[string]string `json:"fields,omitempty"`
+}
+
+// JSON Lines representation of a record. The metadata key is always present, since the lines written by older
+// versions without it have the timestamps in seconds
+type jsonRecord struct {
+	Record
+	Metadata *RecordMetadata `json:"metadata"`
+}
+
+func newJsonRecord(record Record) jsonRecord {
+	return jsonRecord{Record: record, Metadata: record.Metadata}
+}
+
+// Describes the fetch which produced the record
+type RecordMetadata struct {
+	FetchDurationMilliseconds int64  `json:"fetch_duration_ms" bson:"fetch_duration_ms"`
+	HttpStatus                int    `json:"http_status" bson:"http_status"`
+	ResponseSize              int64  `json:"response_size" bson:"response_size"`
+	ContentHash               string `json:"content_hash" bson:"content_hash"`
+	Backend                   string `json:"backend" bson:"backend"`
+	Hostname                  string `json:"hostname" bson:"hostname"`
+}
+
+type VersionRecord struct {
+	Name    string `json:"name"`
+	Version int64  `json:"version"`
+	Hash    string `json:"hash"`
+}
+
+type Snapshot struct {
+	Name string
+	// Milliseconds since the Unix epoch
+	Timestamp int64
+	Hash      string
+	Version   int64
+}
+
+// Failure of a single tracker cycle
+type ErrorRecord struct {
+	// Milliseconds since the Unix epoch
+	Timestamp int64  `json:"timestamp"`
+	Name      string `json:"name"`
+	// One of fetch, extract, convert, write, notify or unknown
+	Stage   string `json:"stage"`
+	Message string `json:"message"`
+	Version int64  `json:"version"`
+	// Number of identical errors which were not recorded since the previous record
+	Repeated int64 `json:"repeated"`
+}
+
+// Change of the state of an alert rule
+type AlertRecord struct {
+	// Milliseconds since the Unix epoch
+	Timestamp int64  `json:"timestamp"`
+	Name      string `json:"name"`
+	Rule      string `json:"rule"`
+	// Either firing or resolved
+	State   string `json:"state"`
+	Value   string `json:"value"`
+	Version int64  `json:"version"`
+}
+
+// Write-only destination for the collected records
+type Sink interface {
+	CreateSeries(name string) error
+	// The context allows cancelling the write, e.g. during the shutdown
+	AppendRecord(ctx context.Context, series string, record Record) error
+	Close() error
+}
+
+type Storage interface {
+	Sink
+	// Returns nil if the series is empty
+	LastRecord(ctx context.Context, series string) (*Record, error)
+	// Returns nil if there is no record with the value and version
+	FindByValue(ctx context.Context, series string, value string, version int64) (*Record, error)
+	LastVersion(name string) (*VersionRecord, error)
+	FindVersionByHash(name string, hash string) (*VersionRecord, error)
+	AppendVersion(record VersionRecord) error
+}
+
+// Optional interface for the backends which can store the fetched response bodies
+type Archive interface {
+	// Must not store the body again if the hash already exists
+	ArchiveBody(hash string, body []byte) error
+	LoadBody(hash string) ([]byte, error)
+	AppendSnapshot(snapshot Snapshot) error
+	Snapshots(name string) ([]Snapshot, error)
+	FindByTimestamp(series string, timestamp int64, version int64) (*Record, error)
+}
+
+// Optional interface for the backends which can store the tracker failures
+type ErrorLog interface {
+	AppendError(record ErrorRecord) error
+}
+
+// Optional interface for the backends which can persist the state of the alerts
+type AlertLog interface {
+	AppendAlert(record AlertRecord) error
+	// Returns nil if the state of the rule was never changed
+	LastAlert(name string, rule string) (*AlertRecord, error)
+}
+
+// Optional interface for the backends which can search the records by a field, e.g. by the page of a sitemap
+type FieldSearch interface {
+	// Creates the index used by LastRecordByField
+	CreateFieldIndex(series string, field string) error
+	// Returns nil if there is no record with the field value
+	LastRecordByField(ctx context.Context, series string, field string, value string) (*Record, error)
+}
+
+type TimeSeriesOptions struct {
+	Granularity        string
+	ExpireAfterSeconds int64
+}
+
+// Optional interface for the backends with a dedicated storage format for numeric series
+type TimeSeriesStorage interface {
+	// Must fail if the series already exists in a regular format
+	CreateTimeSeries(name string, options TimeSeriesOptions) error
+	// Converts an existing regular series into a time series
+	MigrateToTimeSeries(name string, options TimeSeriesOptions) error
+}
+
+// Returns the storage or one of the storages wrapped by it which implements T
+func As[T any](store Storage) (result T, ok bool) {
+	for {
+		if result, ok = store.(T); ok {
+			return
+		}
+		wrapper, isWrapper := store.(interface{ Unwrap() Storage })
+		if !isWrapper {
+			return
+		}
+		store = wrapper.Unwrap()
+	}
+}
+
+type Rollup struct {
+	// Beginning of the aggregated interval in milliseconds since the Unix epoch
+	Timestamp int64
+	Version   int64
+	Min       float64
+	Max       float64
+	Avg       float64
+	Last      float64
+	Count     int64
+}
+
+// Optional interface for the backends which support removing and aggregating the old records
+type Maintainer interface {
+	// Returns the records with from <= timestamp < to, oldest first
+	RecordsBetween(series string, from int64, to int64) ([]Record, error)
+	// Returns nil if the series is empty
+	FirstRecord(series string) (*Record, error)
+	// Removes both records and rollups
+	DeleteBefore(series string, timestamp int64) error
+	CreateRollupSeries(name string) error
+	AppendRollup(series string, rollup Rollup) error
+	// Returns nil if the series is empty
+	LastRollup(series string) (*Rollup, error)
+}
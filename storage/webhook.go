@@ -0,0 +1,94 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Returned by SendJson for the responses outside of the 2xx range
+type WebhookStatusError struct {
+	// Only the scheme and the host, the webhooks usually carry a secret in the path
+	Origin     string
+	Status     string
+	StatusCode int
+}
+
+func (e WebhookStatusError) Error() string {
+	return fmt.Sprintf("webhook %v returned status %v", e.Origin, e.Status)
+}
+
+func webhookOrigin(address string) string {
+	parsed, err := url.Parse(address)
+	if err != nil || parsed.Host == "" {
+		return "webhook"
+	}
+	return parsed.Scheme + "://" + parsed.Host
+}
+
+// Sends the JSON body to the URL, used by the webhook sink and the change notifications.
+// The errors only contain the scheme and the host of the URL.
+func SendJson(ctx context.Context, client *http.Client, method string, address string, body []byte) error {
+	var err = sendJson(ctx, client, method, address, body)
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		urlErr.URL = webhookOrigin(address)
+	}
+	return err
+}
+
+func sendJson(ctx context.Context, client *http.Client, method string, address string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, method, address, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return WebhookStatusError{Origin: webhookOrigin(address), Status: resp.Status, StatusCode: resp.StatusCode}
+	}
+	return nil
+}
+
+// Sends every record as a JSON object to the configured URL
+type WebhookSink struct {
+	url    string
+	client *http.Client
+}
+
+type webhookPayload struct {
+	Series string `json:"series"`
+	Record
+}
+
+func NewWebhookSink(url string) *WebhookSink {
+	return &WebhookSink{url: url, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (w *WebhookSink) CreateSeries(name string) error {
+	// No action required
+	return nil
+}
+
+func (w *WebhookSink) AppendRecord(ctx context.Context, series string, record Record) error {
+	body, err := json.Marshal(webhookPayload{Series: series, Record: record})
+	if err != nil {
+		return err
+	}
+	return SendJson(ctx, w.client, http.MethodPost, w.url, body)
+}
+
+func (w *WebhookSink) Close() error {
+	w.client.CloseIdleConnections()
+	return nil
+}
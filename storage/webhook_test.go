@@ -0,0 +1,44 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhookSink(t *testing.T) {
+	var assert = assert.New(t)
+
+	var received map[string]any
+	var server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		json.Unmarshal(body, &received)
+		if received["value"] == "fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	var sink = NewWebhookSink(server.URL + "/services/secret")
+	defer sink.Close()
+
+	var err = sink.AppendRecord(context.Background(), "test", Record{Timestamp: 1, Value: "a", Version: 2})
+	assert.Equal(nil, err, "Returned an error")
+	assert.Equal(map[string]any{"series": "test", "timestamp": 1.0, "value": "a", "version": 2.0}, received, "Incorrect payload")
+
+	err = sink.AppendRecord(context.Background(), "test", Record{Value: "fail"})
+	assert.NotEqual(nil, err, "Did not return an error for a failed request")
+	var status WebhookStatusError
+	assert.True(errors.As(err, &status) && status.StatusCode == http.StatusInternalServerError, "Did not return the status")
+	assert.NotContains(err.Error(), "secret", "Returned the path of the webhook")
+
+	err = NewWebhookSink("http://127.0.0.1:0/services/secret").AppendRecord(context.Background(), "test", Record{})
+	assert.NotEqual(nil, err, "Did not return an error for an invalid URL")
+	assert.NotContains(err.Error(), "secret", "Returned the path of the webhook in a connection error")
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+	"webtrack/storage"
+)
+
+// Trackers of all series of a query file
+type runningTracker struct {
+	hash    string
+	configs []QueryConfig
+	sinks   [][]querySink
+	states  []*trackerState
+	cancel  context.CancelFunc
+	done    []chan any
+}
+
+type trackerSupervisor struct {
+	globalConfig Config
+	store        storage.Storage
+	registry     *SinkRegistry
+	scheduler    *scheduler
+	trackers     map[string]*runningTracker
+	// Hashes of the query files which failed to start, they are retried only after a modification
+	failed map[string]string
+}
+
+func newTrackerSupervisor(globalConfig Config, store storage.Storage, registry *SinkRegistry, scheduler *scheduler) *trackerSupervisor {
+	return &trackerSupervisor{globalConfig: globalConfig, store: store, registry: registry, scheduler: scheduler, trackers: map[string]*runningTracker{}, failed: map[string]string{}}
+}
+
+// Reserve the internal collection names since they are used for query versioning, archiving, failures and alerts
+func validateQueryName(globalConfig Config, name string) error {
+	if name == globalConfig.VersionCollectionName {
+		return errors.New("version collection name is reserved")
+	}
+	if name == globalConfig.ArchiveCollectionName || name == globalConfig.SnapshotCollectionName {
+		return errors.New("archive collection names are reserved")
+	}
+	if name == globalConfig.ErrorCollectionName {
+		return errors.New("error collection name is reserved")
+	}
+	if name == globalConfig.AlertCollectionName {
+		return errors.New("alert collection name is reserved")
+	}
+	return nil
+}
+
+// Creates the series of the query in the storage and in its sinks
+func (s *trackerSupervisor) prepare(config QueryConfig, configPath string, names queryNames) (result QueryConfig, sinks []querySink, err error) {
+	err = validateQueryName(s.globalConfig, config.Name)
+	if err != nil {
+		return config, nil, err
+	}
+	if config.RetentionDays > 0 || len(config.DownsampleIntervals) > 0 {
+		if _, ok := storage.As[storage.Maintainer](s.store); !ok {
+			return config, nil, errors.New("RetentionDays and DownsampleIntervals are not supported by the " + s.globalConfig.StorageBackend + " storage backend")
+		}
+	}
+	err = names.checkRollups(config)
+	if err != nil {
+		return config, nil, err
+	}
+	if _, found := names.series[config.DependsOn]; config.DependsOn != "" && !found {
+		return config, nil, errors.New("DependsOn of " + config.Name + " refers to an unknown query " + config.DependsOn)
+	}
+	if config.JitterPercent < 0 {
+		config.JitterPercent = s.globalConfig.JitterPercent
+	}
+	if config.StartupStaggerSeconds < 0 {
+		config.StartupStaggerSeconds = s.globalConfig.StartupStaggerSeconds
+	}
+	err = createQuerySeries(s.store, config)
+	if err != nil {
+		return config, nil, err
+	}
+	sinks, err = s.registry.Resolve(config)
+	if err != nil {
+		return config, nil, err
+	}
+	for _, sink := range sinks {
+		// The main storage is already initialized
+		if sink.sink == storage.Sink(s.store) {
+			continue
+		}
+		err = sink.sink.CreateSeries(config.Name)
+		if err != nil {
+			return config, sinks, err
+		}
+	}
+	config.Version, err = checkQueryVersion(s.store, config.Name, configPath)
+	return config, sinks, err
+}
+
+// Reads the query file and prepares all its series without starting the trackers.
+// Either all series of the query are prepared or none of them.
+func (s *trackerSupervisor) load(ctx context.Context, configPath string, hash string, names queryNames) (result *runningTracker, err error) {
+	configs, err := ReadQueries(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var tracker = &runningTracker{hash: hash}
+	defer func() {
+		if err != nil {
+			s.release(tracker)
+		}
+	}()
+	for _, config := range configs {
+		config, sinks, err := s.prepare(config, configPath, names)
+		tracker.sinks = append(tracker.sinks, sinks)
+		if err != nil {
+			return nil, err
+		}
+		state, err := newTrackerState(ctx, config, s.store)
+		if err != nil {
+			return nil, err
+		}
+		tracker.configs = append(tracker.configs, config)
+		tracker.states = append(tracker.states, state)
+	}
+	return tracker, nil
+}
+
+func (s *trackerSupervisor) start(ctx context.Context, configPath string, tracker *runningTracker) {
+	trackerCtx, cancel := context.WithCancel(ctx)
+	tracker.cancel = cancel
+	s.trackers[configPath] = tracker
+	for i, config := range tracker.configs {
+		var done = make(chan any)
+		tracker.done = append(tracker.done, done)
+		go trackerThread(trackerCtx, config, tracker.states[i], s.store, tracker.sinks[i], s.scheduler, time.Duration(s.globalConfig.ErrorDeduplicationSeconds)*time.Second, done)
+	}
+}
+
+func (t *runningTracker) reloadStates(ctx context.Context, store storage.Storage) (err error) {
+	for i, config := range t.configs {
+		t.states[i], err = newTrackerState(ctx, config, store)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *trackerSupervisor) release(tracker *runningTracker) {
+	for _, sinks := range tracker.sinks {
+		s.registry.Release(sinks)
+	}
+}
+
+func (s *trackerSupervisor) stop(configPath string) {
+	var tracker = s.trackers[configPath]
+	tracker.cancel()
+	for _, done := range tracker.done {
+		<-done
+	}
+	s.release(tracker)
+	delete(s.trackers, configPath)
+}
+
+func (s *trackerSupervisor) stopAll() {
+	for configPath := range s.trackers {
+		s.stop(configPath)
+	}
+}
+
+// Starts the new queries, stops the deleted ones and restarts the modified ones.
+// Returns the errors of the queries which could not be started.
+func (s *trackerSupervisor) sync(ctx context.Context, queries []string) (errs []error) {
+	// Only read when a query has to be loaded
+	var names *queryNames
+	var existing = map[string]bool{}
+	for _, configPath := range queries {
+		existing[configPath] = true
+		hash, err := GetFileHash(configPath)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if s.failed[configPath] == hash {
+			continue
+		}
+		delete(s.failed, configPath)
+
+		var previous, running = s.trackers[configPath]
+		if running && previous.hash == hash {
+			continue
+		}
+
+		if names == nil {
+			var all = readQueryNames(queries)
+			names = &all
+		}
+		// The previous tracker keeps running if the modified file is invalid
+		tracker, err := s.load(ctx, configPath, hash, *names)
+		if err == nil && running {
+			fmt.Printf("Query %v was modified, restarting the tracker\n", configPath)
+			s.stop(configPath)
+			// The previous tracker may have written new values in the meantime
+			err = tracker.reloadStates(ctx, s.store)
+			if err != nil {
+				s.release(tracker)
+			}
+		}
+		if err != nil {
+			s.failed[configPath] = hash
+			errs = append(errs, fmt.Errorf("failed to start the query %v: %w", configPath, err))
+			continue
+		}
+		s.start(ctx, configPath, tracker)
+	}
+
+	for configPath := range s.trackers {
+		if !existing[configPath] {
+			fmt.Printf("Query %v was removed, stopping the tracker\n", configPath)
+			s.stop(configPath)
+		}
+	}
+	for configPath := range s.failed {
+		if !existing[configPath] {
+			delete(s.failed, configPath)
+		}
+	}
+	return
+}
+
+// Trackers stop when the context is cancelled, stopResponse is closed once all of them have stopped.
+// The queries directory is checked for changes every QueryReloadIntervalSeconds.
+func StartTrackers(ctx context.Context, dir string, globalConfig Config, store storage.Storage, registry *SinkRegistry, stopResponse chan any) error {
+	// The requests of all trackers are made by the shared pool of workers
+	var scheduler = newScheduler(globalConfig.WorkerPoolSize)
+	var schedulerCtx, cancelScheduler = context.WithCancel(ctx)
+	var schedulerStopResponse = make(chan any)
+	scheduler.Start(schedulerCtx, schedulerStopResponse)
+
+	var supervisor = newTrackerSupervisor(globalConfig, store, registry, scheduler)
+	// Invalid queries prevent the startup, later they are only reported
+	queries, err := ListIniFiles(dir)
+	var errs []error
+	if err != nil {
+		errs = append(errs, err)
+	} else {
+		errs = supervisor.sync(ctx, queries)
+	}
+	if len(errs) > 0 {
+		supervisor.stopAll()
+		cancelScheduler()
+		<-schedulerStopResponse
+		return errors.Join(errs...)
+	}
+
+	go func() {
+		defer close(stopResponse)
+		defer func() {
+			cancelScheduler()
+			<-schedulerStopResponse
+		}()
+
+		var reload <-chan time.Time
+		if globalConfig.QueryReloadIntervalSeconds > 0 {
+			var ticker = time.NewTicker(time.Duration(globalConfig.QueryReloadIntervalSeconds) * time.Second)
+			defer ticker.Stop()
+			reload = ticker.C
+		}
+
+		for {
+			select {
+			case <-ctx.Done():
+				supervisor.stopAll()
+				return
+			case <-reload:
+				// The running trackers are left as they are until the directory can be read again
+				queries, err := ListIniFiles(dir)
+				if err != nil {
+					fmt.Printf("Failed to list the queries: %v\n", err)
+					continue
+				}
+				for _, err := range supervisor.sync(ctx, queries) {
+					fmt.Printf("%v\n", err)
+				}
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func listTestFiles(t *testing.T, dir string) []string {
+	var files, err = ListIniFiles(dir)
+	assert.Equal(t, nil, err, "Did not list the files")
+	return files
+}
+
+func TestTrackerSupervisorSync(t *testing.T) {
+	var assert = assert.New(t)
+
+	var store = newTestStorage(t)
+	var config = Config{StorageBackend: "jsonl", VersionCollectionName: "_version", ErrorCollectionName: "_errors", ErrorDeduplicationSeconds: 3600}
+	var supervisor = newTrackerSupervisor(config, store, NewSinkRegistry(config, store), newScheduler(1))
+
+	var dir = t.TempDir()
+	var query = "Url=http://127.0.0.1:1\nBefore=<b>\nAfter=</b>\nRequestIntervalSeconds=3600\n"
+	var path = filepath.Join(dir, "test.ini")
+	os.WriteFile(path, []byte(query), 0644)
+
+	var ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	var errs = supervisor.sync(ctx, listTestFiles(t, dir))
+	assert.Equal(0, len(errs), "Returned an error 1")
+	assert.Equal(1, len(supervisor.trackers), "Did not start the tracker")
+	var tracker = supervisor.trackers[path]
+
+	// Unchanged files are left running
+	errs = supervisor.sync(ctx, listTestFiles(t, dir))
+	assert.Equal(0, len(errs), "Returned an error 2")
+	assert.True(supervisor.trackers[path] == tracker, "Restarted an unchanged tracker")
+
+	// Modified files restart the tracker with a new version
+	os.WriteFile(path, []byte(query+"OnlyIfDifferent=true\n"), 0644)
+	errs = supervisor.sync(ctx, listTestFiles(t, dir))
+	assert.Equal(0, len(errs), "Returned an error 3")
+	assert.True(supervisor.trackers[path] != tracker, "Did not restart the modified tracker")
+	version, err := store.LastVersion("test")
+	assert.Equal(nil, err, "Returned an error 4")
+	assert.Equal(int64(1), version.Version, "Did not increment the version")
+
+	// An invalid modification keeps the previous tracker running
+	tracker = supervisor.trackers[path]
+	os.WriteFile(path, []byte(query+"Timezone=Nowhere/Invalid\n"), 0644)
+	errs = supervisor.sync(ctx, listTestFiles(t, dir))
+	assert.Equal(1, len(errs), "Did not report the invalid modification")
+	assert.True(supervisor.trackers[path] == tracker, "Stopped the previous tracker")
+	os.WriteFile(path, []byte(query+"OnlyIfDifferent=true\n"), 0644)
+	errs = supervisor.sync(ctx, listTestFiles(t, dir))
+	assert.Equal(0, len(errs), "Returned an error after the fix")
+	assert.True(supervisor.trackers[path] == tracker, "Restarted the tracker after restoring the file")
+
+	// Invalid files are reported once and do not stop the others
+	var invalidPath = filepath.Join(dir, "invalid.ini")
+	os.WriteFile(invalidPath, []byte("Before=<b>\n"), 0644)
+	errs = supervisor.sync(ctx, listTestFiles(t, dir))
+	assert.Equal(1, len(errs), "Did not report the invalid query")
+	errs = supervisor.sync(ctx, listTestFiles(t, dir))
+	assert.Equal(0, len(errs), "Reported the unchanged invalid query again")
+	assert.Equal(1, len(supervisor.trackers), "Incorrect number of trackers")
+
+	// Failures of the setup are reported instead of exiting
+	os.WriteFile(invalidPath, []byte(query+"ArchiveResponses=true\n"), 0644)
+	errs = supervisor.sync(ctx, listTestFiles(t, dir))
+	assert.Equal(1, len(errs), "Did not report the failed setup")
+	assert.Equal(1, len(supervisor.trackers), "Started a tracker with a failed setup")
+	os.WriteFile(invalidPath, []byte(query+"RetentionDays=7\n"), 0644)
+	errs = supervisor.sync(ctx, listTestFiles(t, dir))
+	assert.Equal(1, len(errs), "Did not reject the retention with the file storage")
+
+	// The upstream query must exist
+	os.WriteFile(invalidPath, []byte(query+"DependsOn=missing\n"), 0644)
+	errs = supervisor.sync(ctx, listTestFiles(t, dir))
+	assert.Equal(1, len(errs), "Did not reject an unknown upstream query")
+	os.WriteFile(invalidPath, []byte(query+"DependsOn=test\n"), 0644)
+	errs = supervisor.sync(ctx, listTestFiles(t, dir))
+	assert.Equal(0, len(errs), "Rejected an existing upstream query")
+	assert.Equal(2, len(supervisor.trackers), "Did not start the dependent query")
+
+	// Removed files stop the tracker
+	os.Remove(path)
+	os.Remove(invalidPath)
+	errs = supervisor.sync(ctx, listTestFiles(t, dir))
+	assert.Equal(0, len(errs), "Returned an error 5")
+	assert.Equal(0, len(supervisor.trackers), "Did not stop the removed tracker")
+	assert.Equal(0, len(supervisor.failed), "Did not forget the removed invalid query")
+}
+
+func TestListIniFilesMissing(t *testing.T) {
+	var _, err = ListIniFiles(filepath.Join(t.TempDir(), "missing"))
+	assert.NotEqual(t, nil, err, "Did not return an error for a missing directory")
+}
@@ -1,29 +1,16 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"log"
+	"os"
+	"strings"
 	"time"
-	"webtrack/autoini"
-	"webtrack/mongodb"
+	"webtrack/storage"
 	"webtrack/webfetch"
-
-	"go.mongodb.org/mongo-driver/v2/bson"
 )
 
-type TrackedRecord struct {
-	Timestamp int64
-	Value     string
-	Version   int64
-}
-
-type VersionRecord struct {
-	Name    string
-	Version int64
-	Hash    string
-}
-
 func floatToNiceString(value float64) (res string) {
 	res = fmt.Sprintf("%f", value)
 	// Trim 0s past the decimal point
@@ -41,98 +28,300 @@ func floatToNiceString(value float64) (res string) {
 	return res[0:trimEnd]
 }
 
-func trackerThread(config QueryConfig, mongo mongodb.MongoDB, stopRequest chan any, threadStopResponse chan any) {
-	var fetcher = webfetch.NewFetcher(config.RequestBackend)
-	defer fetcher.Close()
-	defer close(threadStopResponse)
+func extractValue(config QueryConfig, html string) (res string, err error) {
+	// The values of all pages are combined into a list
+	if config.NextPageExtractor != "" {
+		var values []string
+		for _, page := range splitPages(config, html) {
+			values = append(values, ExtractAllValuesFromString(page, config.Before, config.After, config.AnyTag)...)
+		}
+		if len(values) == 0 {
+			return "", stageError{stage: "extract", err: errors.New("failed to find the requested section on any page")}
+		}
+		return strings.Join(values, "\n"), nil
+	}
 
-	var lastValue = ""
-	if config.OnlyIfDifferent {
-		var lastDocument, err = mongo.GetLastDocument(config.Name, "timestamp")
-		if lastDocument != nil {
-			if err != nil {
-				log.Fatal(err)
-			}
+	res, err = ExtractValueFromString(html, config.Before, config.After, config.AnyTag)
+	if err != nil {
+		return "", stageError{stage: "extract", err: fmt.Errorf("failed to find the requested section: %w", err)}
+	}
 
-			var decoded TrackedRecord
-			err = lastDocument.Decode(&decoded)
-			if err != nil {
-				log.Fatal(err)
-			}
-			lastValue = decoded.Value
+	if config.ResultType == "number" {
+		var number float64
+		number, err = ToNumber(res)
+		if err != nil {
+			return "", stageError{stage: "convert", err: fmt.Errorf("failed to convert %v to a number: %w", res, err)}
+		}
+		res = floatToNiceString(number)
+	}
+	return
+}
+
+// Loaded before the tracker starts, so that a failure prevents the start of the query
+type trackerState struct {
+	archive       storage.Archive
+	schedule      *querySchedule
+	notifications notifier
+	alerts        *alertEvaluator
+	lastValue     string
+}
+
+func newTrackerState(ctx context.Context, config QueryConfig, store storage.Storage) (result *trackerState, err error) {
+	result = &trackerState{}
+	if config.ArchiveResponses {
+		result.archive, err = getArchive(store)
+		if err != nil {
+			return nil, err
 		}
 	}
 
+	result.schedule, err = newQuerySchedule(config)
+	if err != nil {
+		return nil, err
+	}
+
+	result.notifications, err = newNotifier(config)
+	if err != nil {
+		return nil, err
+	}
+
+	// The last value is also needed to notify about the changes
+	if config.OnlyIfDifferent || result.notifications != nil {
+		lastRecord, err := store.LastRecord(ctx, config.Name)
+		if err != nil {
+			return nil, err
+		}
+		if lastRecord != nil {
+			result.lastValue = lastRecord.Value
+		}
+	}
+
+	if len(config.Alerts) > 0 {
+		result.alerts, err = newAlertEvaluator(store, config)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func trackerThread(ctx context.Context, config QueryConfig, state *trackerState, store storage.Storage, sinks []querySink, scheduler *scheduler, errorWindow time.Duration, threadStopResponse chan any) {
+	var errorReporter = newErrorReporter(store, config, errorWindow)
+	defer close(threadStopResponse)
+	defer scheduler.forget(config.Name)
+
+	var archive = state.archive
+	var schedule = state.schedule
+	var alerts = state.alerts
+	var lastValue = state.lastValue
+
+	// Recorded with every value to tell apart the instances writing into the same storage
+	hostname, err := os.Hostname()
+	if err != nil {
+		fmt.Printf("Failed to get the hostname: %v\n", err)
+	}
+
+	var notifications *notificationQueue
+	if state.notifications != nil {
+		notifications = startNotificationQueue(ctx, state.notifications, func(err error) {
+			err = redactError(config, err)
+			fmt.Printf("Failed to notify about the change of %v: %v\n", config.Name, err)
+			errorReporter.Report(stageError{stage: "notify", err: err}, time.Now())
+		})
+		defer notifications.Close()
+	}
+
+	// The last values of the sitemap pages are loaded from the main storage when it supports the search by the address
+	var sitemapValues = map[string]string{}
+	var sitemapSearch storage.FieldSearch
+	if search, ok := storage.As[storage.FieldSearch](store); ok && containsSink(sinks, store) {
+		sitemapSearch = search
+	}
+
+	// The URL of a dependent query is rendered with the latest value of the upstream query
+	var lastUpstream = ""
+	var waitingForUpstream = false
+
+	var next = schedule.First(time.Now())
+	var timer = time.NewTimer(time.Until(next))
+	defer timer.Stop()
 	for {
+		if next.IsZero() {
+			fmt.Printf("The schedule of %v has no upcoming runs, stopping the tracker\n", config.Name)
+			return
+		}
 		select {
-		case <-stopRequest:
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		var fetchStart = time.Now()
+		upstream, err := upstreamValue(ctx, store, config)
+		if err == nil {
+			waitingForUpstream = false
+		}
+		if err == nil && upstream != lastUpstream {
+			if lastUpstream != "" {
+				fmt.Printf("Upstream query %v of %v changed to %v\n", config.DependsOn, config.Name, upstream)
+			}
+			lastUpstream = upstream
+		}
+		var values = urlValues{upstream: upstream, page: 1}
+		var url string
+		var response webfetch.Response
+		if err == nil {
+			url, err = renderUrl(config, fetchStart, values)
+		}
+		// The secrets of the URL must not be printed or stored with the errors
+		var redactedUrl = redactMessage(config, url)
+		if err == nil && config.Source == "sitemap" {
+			var written, errs = trackSitemap(ctx, scheduler, config, sinks, url, next, hostname, sitemapValues, sitemapSearch)
+			if ctx.Err() != nil {
+				return
+			}
+			for _, err := range errs {
+				err = redactError(config, err)
+				fmt.Printf("Failed to process the sitemap %v: %v\n", redactedUrl, err)
+				errorReporter.Report(err, time.Now())
+			}
+			if written > 0 {
+				fmt.Printf("Wrote %v pages of %v at %v\n", written, config.Name, time.Now().UnixMilli())
+			}
+			schedule.Observe(written > 0)
+			next = schedule.Next(fetchStart, time.Now())
+			timer.Reset(time.Until(next))
+			continue
+		}
+		if err == nil {
+			response, err = fetchPages(ctx, scheduler, config, url, fetchStart, next, values)
+		}
+		if ctx.Err() != nil {
+			// The request was interrupted by the shutdown, it is not a failure of the query
 			return
-		default:
-			html, err := fetcher.FetchHtml(config.Url)
+		}
+		var html = response.Body
+		var fetchedAt = time.Now()
+		var timestamp = fetchedAt.UnixMilli()
+
+		if errors.Is(err, errNoUpstreamValue) {
+			// Printed once until the upstream query has a value
+			if !waitingForUpstream {
+				fmt.Printf("Skipping %v until %v has a value\n", config.Name, config.DependsOn)
+			}
+			waitingForUpstream = true
+		} else if err != nil {
+			// Not a critical issue, just log it
+			err = redactError(config, err)
+			fmt.Printf("Failed to query the page %v: %v\n", redactedUrl, err)
+			errorReporter.Report(stageError{stage: "fetch", err: err}, fetchedAt)
+		} else {
+			if archive != nil {
+				err = archiveResponse(archive, config, timestamp, html)
+				if err != nil {
+					fmt.Printf("Failed to archive the page %v: %v\n", redactedUrl, err)
+				}
+			}
 
-			// Time delays properly by taking into account the request time itself
-			var timeBefore = time.Now().UnixMilli()
+			var size, hash = describePages(config, html)
+			var metadata = storage.RecordMetadata{
+				FetchDurationMilliseconds: response.Duration.Milliseconds(),
+				HttpStatus:                response.StatusCode,
+				ResponseSize:              size,
+				ContentHash:               hash,
+				Backend:                   config.RequestBackend,
+				Hostname:                  hostname,
+			}
 
-			if err != nil {
-				// Not a critical issue, just log it
-				fmt.Printf("Failed to query the page %v: %v", config.Url, err)
+			if config.Source == "feed" {
+				var written, err = recordFeedItems(ctx, config, store, sinks, html, storage.Record{Timestamp: timestamp, Version: config.Version, Metadata: &metadata})
+				if err != nil {
+					err = redactError(config, err)
+					fmt.Printf("Failed to process the feed %v: %v\n", redactedUrl, err)
+					errorReporter.Report(err, fetchedAt)
+				}
+				if written > 0 {
+					fmt.Printf("Wrote %v new items of %v at %v\n", written, config.Name, timestamp)
+				}
+				schedule.Observe(written > 0)
 			} else {
-				var res, err = ExtractValueFromString(html, config.Before, config.After, config.AnyTag)
+				var res, err = extractValue(config, html)
 				if err != nil {
-					fmt.Printf("Failed to find the requested section on the page %v: %v\n", config.Url, err)
+					err = redactError(config, err)
+					fmt.Printf("Failed to process the page %v: %v\n", redactedUrl, err)
+					errorReporter.Report(err, fetchedAt)
 				} else {
-					if config.ResultType == "number" {
-						var number float64
-						number, err = ToNumber(res)
-						if err != nil {
-							fmt.Printf("Failed to convert %v to a number: %v", res, err)
-						} else {
-							res = floatToNiceString(number)
-						}
+					schedule.Observe(lastValue != res)
+					if alerts != nil {
+						alerts.Evaluate(res, fetchedAt)
 					}
-
 					// Respect the OnlyIfDifferent and OnlyIfUnique requirement
 					var onlyIfDifferentPassed = (!config.OnlyIfDifferent || lastValue != res)
-					// Small optimization: if the last record is the same as the current, then it is not necessary to search in MongoDB
+					// Small optimization: if the last record is the same as the current, then it is not necessary to search in the storage
 					var onlyIfUniquePassed = onlyIfDifferentPassed
 					if onlyIfUniquePassed && config.OnlyIfUnique {
 						onlyIfUniquePassed = false
-						existingDocument, err := mongo.GetLastDocumentFiltered(config.Name, "timestamp", bson.D{{Key: "value", Value: res}, {Key: "version", Value: config.Version}})
+						existingRecord, err := store.FindByValue(ctx, config.Name, res, config.Version)
 						if err != nil {
-							fmt.Printf("Failed the search for an existing record in MongoDB: %v", err)
-						} else if existingDocument == nil {
+							err = redactError(config, err)
+							fmt.Printf("Failed the search for an existing record of %v in the storage: %v\n", config.Name, err)
+							errorReporter.Report(stageError{stage: "write", err: err}, fetchedAt)
+						} else if existingRecord == nil {
 							onlyIfUniquePassed = true
 						}
 					}
 
 					if err == nil && onlyIfDifferentPassed && onlyIfUniquePassed {
-						var timestamp = time.Now().Unix()
-						err = mongo.Write(config.Name, bson.D{{Key: "timestamp", Value: timestamp}, {Key: "value", Value: res}, {Key: "version", Value: config.Version}})
+						var record = storage.Record{Timestamp: timestamp, Value: res, Version: config.Version, Metadata: &metadata}
+						var written, err = writeToSinks(ctx, sinks, config.Name, record)
 						if err != nil {
-							fmt.Printf("Failed to write to MongoDB: %v", err)
-						} else {
-							fmt.Printf("Wrote to MongoDB collection %v at %v\n", config.Name, timestamp)
+							errorReporter.Report(stageError{stage: "write", err: redactError(config, err)}, fetchedAt)
+						}
+						if len(written) > 0 {
+							fmt.Printf("Wrote %v to %v sinks at %v\n", config.Name, len(written), record.Timestamp)
+						}
+						// The first value of the query is not a change
+						if notifications != nil && len(written) > 0 && lastValue != "" && lastValue != res {
+							var err = notifications.Push(valueChange{Name: config.Name, Version: config.Version, Old: lastValue, New: res, Timestamp: record.Timestamp})
+							if err != nil {
+								err = redactError(config, err)
+								fmt.Printf("Failed to notify about the change of %v: %v\n", config.Name, err)
+								errorReporter.Report(stageError{stage: "notify", err: err}, time.Now())
+							}
+						}
+						// The main storage is used to check OnlyIfDifferent after restarts, so it is the one to follow if present
+						if containsSink(written, store) || (len(written) > 0 && !containsSink(sinks, store)) {
 							lastValue = res
 						}
 					}
 				}
 			}
-
-			var timeAfter = time.Now().UnixMilli()
-			var sleepDuration = int64(config.RequestIntervalSeconds)*1000 - (timeAfter - timeBefore)
-			if sleepDuration > 0 {
-				time.Sleep(time.Duration(sleepDuration) * time.Millisecond)
-			}
 		}
+
+		next = schedule.Next(fetchStart, time.Now())
+		timer.Reset(time.Until(next))
 	}
 }
 
-func writeQueryVersion(mongo mongodb.MongoDB, globalConfig Config, queryName string, queryHash string, version int64) error {
-	return mongo.Write(globalConfig.VersionCollectionName, bson.D{{Key: "name", Value: queryName}, {Key: "version", Value: version}, {Key: "hash", Value: queryHash}})
+var errNoUpstreamValue = errors.New("upstream query has no value yet")
+
+// Returns the latest value of the query this one depends on, or an empty string if there is no dependency
+func upstreamValue(ctx context.Context, store storage.Storage, config QueryConfig) (string, error) {
+	if config.DependsOn == "" {
+		return "", nil
+	}
+	record, err := store.LastRecord(ctx, config.DependsOn)
+	if err != nil {
+		return "", err
+	}
+	if record == nil {
+		return "", errNoUpstreamValue
+	}
+	return record.Value, nil
 }
 
-func checkQueryVersion(mongo mongodb.MongoDB, globalConfig Config, queryName string, configPath string) (int64, error) {
-	document, err := mongo.GetLastDocumentFiltered(globalConfig.VersionCollectionName, "version", bson.D{{Key: "name", Value: queryName}})
+func checkQueryVersion(store storage.Storage, queryName string, configPath string) (int64, error) {
+	latest, err := store.LastVersion(queryName)
 	if err != nil {
 		return 0, err
 	}
@@ -142,78 +331,81 @@ func checkQueryVersion(mongo mongodb.MongoDB, globalConfig Config, queryName str
 		return 0, err
 	}
 
-	// Document exists and we potentially need to increment the version
-	if document != nil {
-		var decoded VersionRecord
-		err = document.Decode(&decoded)
-		if err != nil {
-			return 0, err
-		}
-
-		if decoded.Hash != queryHash {
+	// Record exists and we potentially need to increment the version
+	if latest != nil {
+		if latest.Hash != queryHash {
 			// Check if some older query version is used
-			oldVersionDocument, err := mongo.GetLastDocumentFiltered(globalConfig.VersionCollectionName, "version", bson.D{{Key: "name", Value: queryName}, {Key: "hash", Value: queryHash}})
+			oldVersion, err := store.FindVersionByHash(queryName, queryHash)
 			if err != nil {
 				return 0, err
 			}
 
-			if oldVersionDocument != nil {
+			if oldVersion != nil {
 				// Found a matching old version
-				var decoded VersionRecord
-				err = oldVersionDocument.Decode(&decoded)
-				if err != nil {
-					return 0, err
-				}
-				return decoded.Version, nil
+				return oldVersion.Version, nil
 			} else {
 				// It is a new query which requires a version increment
-				decoded.Version++
-				return decoded.Version, writeQueryVersion(mongo, globalConfig, queryName, queryHash, decoded.Version)
+				var version = latest.Version + 1
+				return version, store.AppendVersion(storage.VersionRecord{Name: queryName, Version: version, Hash: queryHash})
 			}
 		}
 		// If the hash matches then no action is required, simply return the latest version
-		return decoded.Version, nil
+		return latest.Version, nil
 	} else {
 		// It is a new query without a version entry
-		return 0, writeQueryVersion(mongo, globalConfig, queryName, queryHash, 0)
+		return 0, store.AppendVersion(storage.VersionRecord{Name: queryName, Version: 0, Hash: queryHash})
 	}
 }
 
-func StartTrackers(queries []string, globalConfig Config, mongo mongodb.MongoDB, stopRequest chan any, stopResponse chan any) (err error) {
-	// Reserve the "versions" name since it is used for query versioning
-	for _, configPath := range queries {
-		var fileName = GetFileNameWithoutExtension(configPath)
-		if fileName == globalConfig.VersionCollectionName {
-			return errors.New("version collection name is reserved")
-		}
+func getTimeSeriesStorage(store storage.Storage) (storage.TimeSeriesStorage, error) {
+	if timeSeries, ok := storage.As[storage.TimeSeriesStorage](store); ok {
+		return timeSeries, nil
 	}
+	return nil, errors.New("storage backend does not support time series")
+}
 
-	go func() {
-		var stopChannels = []chan any{}
-		for _, configPath := range queries {
-			var threadStopResponse = make(chan any)
-			stopChannels = append(stopChannels, threadStopResponse)
-			var config, err = autoini.ReadIni[QueryConfig](configPath)
-			if err != nil {
-				log.Fatal(err)
-			}
-			config.Name = GetFileNameWithoutExtension(configPath)
-			err = mongo.CreateCollection(config.Name)
-			if err != nil {
-				log.Fatal(err)
-			}
-			config.Version, err = checkQueryVersion(mongo, globalConfig, config.Name, configPath)
-			if err != nil {
-				log.Fatal(err)
-			}
-			go trackerThread(config, mongo, stopRequest, threadStopResponse)
+func timeSeriesOptions(config QueryConfig) storage.TimeSeriesOptions {
+	return storage.TimeSeriesOptions{Granularity: config.TimeSeriesGranularity, ExpireAfterSeconds: int64(config.TimeSeriesExpireAfterSeconds)}
+}
+
+func createQuerySeries(store storage.Storage, config QueryConfig) error {
+	if !config.TimeSeries {
+		var err = store.CreateSeries(config.Name)
+		if err != nil {
+			return err
 		}
-		// Await all channels to terminate
-		for _, c := range stopChannels {
-			<-c
+		// The last values of the sitemap pages are searched by their addresses
+		if search, ok := storage.As[storage.FieldSearch](store); ok && config.Source == "sitemap" {
+			return search.CreateFieldIndex(config.Name, "url")
 		}
-		close(stopResponse)
-	}()
+		return nil
+	}
 
-	return
+	timeSeries, err := getTimeSeriesStorage(store)
+	if err != nil {
+		return err
+	}
+	return timeSeries.CreateTimeSeries(config.Name, timeSeriesOptions(config))
+}
+
+func MigrateQuery(store storage.Storage, configPath string) error {
+	configs, err := ReadQueries(configPath)
+	if err != nil {
+		return err
+	}
+
+	timeSeries, err := getTimeSeriesStorage(store)
+	if err != nil {
+		return err
+	}
+	for _, config := range configs {
+		if !config.TimeSeries {
+			return errors.New("TimeSeries is not enabled for the query " + config.Name)
+		}
+		err = timeSeries.MigrateToTimeSeries(config.Name, timeSeriesOptions(config))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
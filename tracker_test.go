@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+	"webtrack/storage"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// File storage with the internal collections of the default configuration
+func newTestStorage(t *testing.T) *storage.FileStorage {
+	var store, err = storage.NewFileStorage(storage.FileConfig{Directory: t.TempDir(), Format: "jsonl", VersionCollectionName: "_version", ErrorCollectionName: "_errors", AlertCollectionName: "_alerts"})
+	assert.Equal(t, nil, err, "Did not create a storage")
+	return store
+}
+
+func startTestTracker(t *testing.T, ctx context.Context, config QueryConfig, store storage.Storage, scheduler *scheduler, stopResponse chan any) {
+	var state, err = newTrackerState(ctx, config, store)
+	assert.Equal(t, nil, err, "Did not prepare the tracker")
+	go trackerThread(ctx, config, state, store, []querySink{{name: "storage", sink: store}}, scheduler, time.Minute, stopResponse)
+}
+
+func TestTrackerThreadCancel(t *testing.T) {
+	var assert = assert.New(t)
+
+	var server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<b>42</b>"))
+	}))
+	defer server.Close()
+
+	var store = newTestStorage(t)
+	store.CreateSeries("cancelled")
+
+	var config = QueryConfig{Name: "cancelled", Url: server.URL, Before: "<b>", After: "</b>", AnyTag: "*", ResultType: "number", RequestBackend: "go", RequestIntervalSeconds: 3600, Timezone: "UTC"}
+	var ctx, cancel = context.WithCancel(context.Background())
+	var scheduler = newScheduler(1)
+	scheduler.Start(ctx, make(chan any))
+	var stopResponse = make(chan any)
+	startTestTracker(t, ctx, config, store, scheduler, stopResponse)
+
+	var record *storage.Record
+	assert.Eventually(func() bool {
+		record, _ = store.LastRecord(context.Background(), "cancelled")
+		return record != nil
+	}, 5*time.Second, 10*time.Millisecond, "Tracker did not write a record")
+	if record != nil {
+		assert.Equal("42", record.Value, "Incorrect value written")
+	}
+
+	// The tracker must not wait for the hour long interval
+	cancel()
+	select {
+	case <-stopResponse:
+	case <-time.After(time.Second):
+		assert.Fail("Tracker did not stop after the cancellation")
+	}
+	assert.Equal(nil, queueLag.Get("cancelled"), "Did not remove the queue lag of the stopped tracker")
+}
+
+func TestTrackerThreadDependsOn(t *testing.T) {
+	var assert = assert.New(t)
+
+	var server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<b>" + r.URL.Path + "</b>"))
+	}))
+	defer server.Close()
+
+	var store = newTestStorage(t)
+	store.CreateSeries("upstream")
+	store.CreateSeries("test")
+
+	var config = QueryConfig{Name: "test", Url: server.URL + "/{{.upstream}}", DependsOn: "upstream", Before: "<b>", After: "</b>", AnyTag: "*", ResultType: "string", RequestBackend: "go", RequestIntervalSeconds: 1, Timezone: "UTC"}
+	var ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	var scheduler = newScheduler(1)
+	scheduler.Start(ctx, make(chan any))
+	startTestTracker(t, ctx, config, store, scheduler, make(chan any))
+
+	var hasValue = func(value string) func() bool {
+		return func() bool {
+			record, _ := store.LastRecord(context.Background(), "test")
+			return record != nil && record.Value == value
+		}
+	}
+
+	// Nothing is requested until the upstream query has a value
+	assert.Never(func() bool {
+		record, _ := store.LastRecord(context.Background(), "test")
+		return record != nil
+	}, 1500*time.Millisecond, 10*time.Millisecond, "Requested the page without the upstream value")
+
+	store.AppendRecord(context.Background(), "upstream", storage.Record{Timestamp: 1, Value: "first"})
+	assert.Eventually(hasValue("/first"), 5*time.Second, 10*time.Millisecond, "Did not use the upstream value")
+
+	store.AppendRecord(context.Background(), "upstream", storage.Record{Timestamp: 2, Value: "second"})
+	assert.Eventually(hasValue("/second"), 5*time.Second, 10*time.Millisecond, "Did not follow the upstream value")
+}
+
+func TestTrackerThreadNotifyOnChange(t *testing.T) {
+	var assert = assert.New(t)
+
+	var value = "first"
+	var mutex sync.Mutex
+	var server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		w.Write([]byte("<b>" + value + "</b>"))
+	}))
+	defer server.Close()
+	var notifications = make(chan string, 10)
+	var webhook = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		notifications <- string(body)
+	}))
+	defer webhook.Close()
+
+	var store = newTestStorage(t)
+	store.CreateSeries("test")
+
+	var config = QueryConfig{Name: "test", Url: server.URL, Before: "<b>", After: "</b>", AnyTag: "*", ResultType: "string", RequestBackend: "go", RequestIntervalSeconds: 1, Timezone: "UTC",
+		OnlyIfDifferent: true, NotifyOnChange: true, NotifyWebhookUrl: webhook.URL, NotifyWebhookMethod: "POST", NotifyWebhookBody: `{"old": {{json .old}}, "new": {{json .new}}}`}
+	var ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	var scheduler = newScheduler(1)
+	scheduler.Start(ctx, make(chan any))
+	startTestTracker(t, ctx, config, store, scheduler, make(chan any))
+
+	// The first value is not a change
+	assert.Eventually(func() bool {
+		record, _ := store.LastRecord(context.Background(), "test")
+		return record != nil
+	}, 5*time.Second, 10*time.Millisecond, "Tracker did not write the first value")
+	assert.Equal(0, len(notifications), "Notified about the first value")
+
+	mutex.Lock()
+	value = "second"
+	mutex.Unlock()
+	select {
+	case notification := <-notifications:
+		assert.Equal(`{"old": "first", "new": "second"}`, notification, "Incorrect notification")
+	case <-time.After(3 * time.Second):
+		assert.Fail("Did not notify about the change")
+	}
+}
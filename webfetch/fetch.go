@@ -5,22 +5,34 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"time"
 
 	"github.com/chromedp/cdproto/dom"
 	"github.com/chromedp/chromedp"
 )
 
 type Fetcher struct {
-	ctx     context.Context
-	cancel  context.CancelFunc
-	backend string
+	// The browser is shared by all requests of the fetcher, every request opens its own tab
+	browserCtx      context.Context
+	cancelBrowser   context.CancelFunc
+	cancelAllocator context.CancelFunc
+	browserStarted  bool
+	backend         string
+}
+
+type Response struct {
+	Body       string
+	StatusCode int
+	Duration   time.Duration
 }
 
 func NewFetcher(backend string) (result Fetcher) {
 	result.backend = backend
 	switch backend {
 	case "chrome":
-		result.ctx, result.cancel = chromedp.NewContext(context.Background())
+		var allocatorCtx context.Context
+		allocatorCtx, result.cancelAllocator = chromedp.NewExecAllocator(context.Background(), chromedp.DefaultExecAllocatorOptions[:]...)
+		result.browserCtx, result.cancelBrowser = chromedp.NewContext(allocatorCtx)
 	case "go":
 		// No action required
 	default:
@@ -31,39 +43,79 @@ func NewFetcher(backend string) (result Fetcher) {
 }
 
 func (f *Fetcher) Close() {
-	if f.cancel != nil {
-		f.cancel()
+	if f.cancelBrowser != nil {
+		f.cancelBrowser()
+		f.cancelAllocator()
 	}
 }
 
-func (f *Fetcher) FetchHtml(url string) (res string, err error) {
+// Cancelling the context aborts the request
+func (f *Fetcher) Fetch(ctx context.Context, url string) (res Response, err error) {
+	var start = time.Now()
+	defer func() {
+		res.Duration = time.Since(start)
+	}()
+
 	// NewFetcher should have validated backend field
 	switch f.backend {
 	case "chrome":
-		err = chromedp.Run(f.ctx,
-			chromedp.Navigate(url),
+		// The browser process is started by the first run in its own context, so that closing a tab does not stop it
+		if !f.browserStarted {
+			err = chromedp.Run(f.browserCtx)
+			if err != nil {
+				return res, err
+			}
+			f.browserStarted = true
+		}
+		tabCtx, cancel := chromedp.NewContext(f.browserCtx)
+		defer cancel()
+		var stop = context.AfterFunc(ctx, cancel)
+		defer stop()
+
+		// The response of the main document carries the HTTP status
+		navigation, err := chromedp.RunResponse(tabCtx, chromedp.Navigate(url))
+		if err != nil {
+			return res, err
+		}
+		if navigation != nil {
+			res.StatusCode = int(navigation.Status)
+		}
+		err = chromedp.Run(tabCtx,
 			chromedp.ActionFunc(func(ctx context.Context) error {
 				node, err := dom.GetDocument().Do(ctx)
 				if err != nil {
 					return err
 				}
-				res, err = dom.GetOuterHTML().WithNodeID(node.NodeID).Do(ctx)
+				res.Body, err = dom.GetOuterHTML().WithNodeID(node.NodeID).Do(ctx)
 				return err
 			}),
 		)
+		return res, err
 	default:
+		var req *http.Request
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return
+		}
 		var resp *http.Response
-		resp, err = http.Get(url)
+		resp, err = http.DefaultClient.Do(req)
 		if err != nil {
 			return
 		}
+		defer resp.Body.Close()
+		res.StatusCode = resp.StatusCode
 		var resBytes []byte
 		resBytes, err = io.ReadAll(resp.Body)
 		if err != nil {
 			return
 		}
-		res = string(resBytes[:])
+		res.Body = string(resBytes[:])
 	}
 
 	return
 }
+
+func (f *Fetcher) FetchHtml(ctx context.Context, url string) (res string, err error) {
+	response, err := f.Fetch(ctx, url)
+	return response.Body, err
+}
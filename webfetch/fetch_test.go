@@ -0,0 +1,60 @@
+package webfetch
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func hasChrome() bool {
+	for _, name := range []string{"headless-shell", "chromium", "chromium-browser", "google-chrome", "google-chrome-stable"} {
+		if _, err := exec.LookPath(name); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func TestFetchGo(t *testing.T) {
+	var assert = assert.New(t)
+
+	var server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("<b>missing</b>"))
+	}))
+	defer server.Close()
+
+	var fetcher = NewFetcher("go")
+	defer fetcher.Close()
+	var response, err = fetcher.Fetch(context.Background(), server.URL)
+	assert.Equal(nil, err, "Returned an error")
+	assert.Equal(http.StatusNotFound, response.StatusCode, "Incorrect status")
+	assert.Equal("<b>missing</b>", response.Body, "Incorrect body")
+}
+
+func TestFetchChromeReusesBrowser(t *testing.T) {
+	if !hasChrome() {
+		t.Skip("Chrome is not installed")
+	}
+	var assert = assert.New(t)
+
+	var server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<html><body><b>" + r.URL.Path + "</b></body></html>"))
+	}))
+	defer server.Close()
+
+	var fetcher = NewFetcher("chrome")
+	defer fetcher.Close()
+
+	// The end of the first request must not stop the browser
+	for _, path := range []string{"/first", "/second"} {
+		var response, err = fetcher.Fetch(context.Background(), server.URL+path)
+		assert.Equal(nil, err, "Returned an error for "+path)
+		assert.Equal(http.StatusOK, response.StatusCode, "Incorrect status for "+path)
+		assert.Contains(response.Body, "<b>"+path+"</b>", "Incorrect body for "+path)
+	}
+}